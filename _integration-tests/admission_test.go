@@ -0,0 +1,157 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAdmissionControl(t *testing.T) {
+	cases := []struct {
+		name  string
+		limit server.AdmissionLimit
+		opts  []server.Option
+		// clientOpts determine the transport of calls.
+		clientOpts []client.ConnectOption
+		// held is the metadata of the call holding the only slot. The other calls are admitted if they have the
+		// metadata of admitted, and rejected if they have the metadata of held.
+		held, admitted []string
+	}{
+		{
+			name:       "websocket-streams",
+			limit:      server.LimitWebSocketStreams,
+			opts:       []server.Option{server.MaxWebSocketStreams(1)},
+			clientOpts: []client.ConnectOption{client.UseWebSocket(true)},
+		},
+		{
+			name:  "websocket-streams-per-ip",
+			limit: server.LimitWebSocketStreamsPerIP,
+			opts: []server.Option{
+				server.MaxWebSocketStreamsPerIP(1),
+				server.TrustedProxies(netip.MustParsePrefix("127.0.0.0/8")),
+			},
+			clientOpts: []client.ConnectOption{client.UseWebSocket(true)},
+			held:       []string{"x-forwarded-for", "192.0.2.1"},
+			admitted:   []string{"x-forwarded-for", "192.0.2.2"},
+		},
+		{
+			name:  "websocket-streams-per-identity",
+			limit: server.LimitWebSocketStreamsPerIdentity,
+			opts: []server.Option{
+				server.MaxWebSocketStreamsPerIdentity(1, func(req *http.Request) string {
+					return req.Header.Get("X-User")
+				}),
+			},
+			clientOpts: []client.ConnectOption{client.UseWebSocket(true)},
+			held:       []string{"x-user", "alice"},
+			admitted:   []string{"x-user", "bob"},
+		},
+		{
+			name:       "downgraded-calls",
+			limit:      server.LimitDowngradedCalls,
+			opts:       []server.Option{server.MaxDowngradedCalls(1)},
+			clientOpts: []client.ConnectOption{client.ForceDowngrade(true)},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			started := make(chan struct{}, 1)
+			unblock := make(chan struct{})
+			grpcSrv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("block")) > 0 {
+					started <- struct{}{}
+					select {
+					case <-unblock:
+					case <-ctx.Done():
+					}
+				}
+				return handler(ctx, req)
+			}))
+			echo.RegisterEchoServer(grpcSrv, echoService{})
+			defer grpcSrv.Stop()
+
+			var metrics server.AdmissionMetrics
+			srv := &http.Server{}
+			var h2Srv http2.Server
+			require.NoError(t, http2.ConfigureServer(srv, &h2Srv))
+			opts := append([]server.Option{server.ReportAdmissionMetrics(&metrics)}, c.opts...)
+			srv.Handler = h2c.NewHandler(server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler(), opts...), &h2Srv)
+			lis := listenLocal(t)
+			go srv.Serve(lis)
+			defer func() { _ = srv.Close() }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			clientOpts := append([]client.ConnectOption{client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials()))}, c.clientOpts...)
+			conn, err := client.DialViaProxy(ctx, lis.Addr().String(), nil, clientOpts...)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			echoClient := echo.NewEchoClient(conn)
+
+			call := func(md ...string) error {
+				_, err := echoClient.UnaryEcho(metadata.AppendToOutgoingContext(ctx, md...), &echo.EchoRequest{Message: "hello"})
+				return err
+			}
+			active := func() int64 {
+				if c.limit == server.LimitDowngradedCalls {
+					return metrics.ActiveDowngradedCalls()
+				}
+				return metrics.ActiveWebSocketStreams()
+			}
+
+			heldErrC := make(chan error, 1)
+			go func() {
+				heldErrC <- call(append([]string{"block", "true"}, c.held...)...)
+			}()
+			select {
+			case <-started:
+			case <-ctx.Done():
+				require.FailNow(t, "held call did not start")
+			}
+			assert.EqualValues(t, 1, active())
+
+			err = call(c.held...)
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err), "unexpected error %v", err)
+			assert.EqualValues(t, 1, metrics.Rejected(c.limit))
+			if c.admitted != nil {
+				assert.NoError(t, call(c.admitted...))
+			}
+
+			close(unblock)
+			require.NoError(t, <-heldErrC)
+			assert.Eventually(t, func() bool { return active() == 0 }, 5*time.Second, 10*time.Millisecond)
+			assert.NoError(t, call(c.held...))
+			assert.EqualValues(t, 1, metrics.Rejected(c.limit))
+		})
+	}
+}
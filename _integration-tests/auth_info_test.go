@@ -0,0 +1,219 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/peer"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+func (ca *testCA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// Issue issues a certificate for the given common name, which is also used as DNS name, and the given URIs.
+func (ca *testCA) Issue(t *testing.T, commonName string, extKeyUsage x509.ExtKeyUsage, uris ...*url.URL) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		URIs:         uris,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{extKeyUsage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeCertificateFiles(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+}
+
+// rotatingTLSServer is a downgrading gRPC server whose certificate can be replaced, and which records the common
+// name of the last client certificate it saw.
+type rotatingTLSServer struct {
+	*httptest.Server
+
+	cert           atomic.Pointer[tls.Certificate]
+	mutex          sync.Mutex
+	lastClientName string
+}
+
+func newRotatingTLSServer(grpcSrv *grpc.Server, ca *testCA, cert tls.Certificate, enableHTTP2 bool) *rotatingTLSServer {
+	s := &rotatingTLSServer{}
+	s.cert.Store(&cert)
+
+	handler := server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler())
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			s.mutex.Lock()
+			s.lastClientName = req.TLS.PeerCertificates[0].Subject.CommonName
+			s.mutex.Unlock()
+		}
+		handler.ServeHTTP(w, req)
+	}))
+	s.EnableHTTP2 = enableHTTP2
+	s.TLS = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return s.cert.Load(), nil
+		},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  ca.CertPool(),
+	}
+	s.StartTLS()
+	return s
+}
+
+// Rotate replaces the certificate of the server, and closes all connections, as if the client had been sent to a
+// different backend.
+func (s *rotatingTLSServer) Rotate(cert tls.Certificate) {
+	s.cert.Store(&cert)
+	s.CloseClientConnections()
+}
+
+func (s *rotatingTLSServer) LastClientName() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastClientName
+}
+
+func TestAuthInfo(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	ca := newTestCA(t)
+	serverCert1 := ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth)
+	serverCert2 := ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth)
+	clientCert1 := ca.Issue(t, "client-1", x509.ExtKeyUsageClientAuth)
+	clientCert2 := ca.Issue(t, "client-2", x509.ExtKeyUsageClientAuth)
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			srv := newRotatingTLSServer(testCfg.grpcSrv, ca, serverCert1, true)
+			defer srv.Close()
+
+			dir := t.TempDir()
+			certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+			writeCertificateFiles(t, clientCert1, certFile, keyFile)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			tlsConf := &tls.Config{
+				RootCAs:    ca.CertPool(),
+				ServerName: "example.com",
+			}
+			opts := append([]client.ConnectOption{client.WithClientCertificateFiles(certFile, keyFile)}, mode.opts...)
+			conn, err := client.DialViaProxy(ctx, srv.Listener.Addr().String(), tlsConf, opts...)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			echoClient := echo.NewEchoClient(conn)
+			peerCert := func() *x509.Certificate {
+				var p peer.Peer
+				_, err := echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"}, grpc.Peer(&p))
+				if err != nil {
+					return nil
+				}
+				tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+				require.True(t, ok, "unexpected auth info %T", p.AuthInfo)
+				require.NotEmpty(t, tlsInfo.State.PeerCertificates)
+				return tlsInfo.State.PeerCertificates[0]
+			}
+
+			assert.True(t, serverCert1.Leaf.Equal(peerCert()))
+			assert.Equal(t, "client-1", srv.LastClientName())
+
+			writeCertificateFiles(t, clientCert2, certFile, keyFile)
+			srv.Rotate(serverCert2)
+
+			assert.Eventually(t, func() bool {
+				return serverCert2.Leaf.Equal(peerCert())
+			}, 5*time.Second, 10*time.Millisecond)
+			assert.Equal(t, "client-2", srv.LastClientName())
+		})
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/examples/features/proto/echo"
+)
+
+// authorityRecorder records the authority gRPC uses for calls, as seen by per-RPC credentials.
+type authorityRecorder struct {
+	mutex     sync.Mutex
+	authority string
+}
+
+func (r *authorityRecorder) GetRequestMetadata(_ context.Context, uri ...string) (map[string]string, error) {
+	u, err := url.Parse(uri[0])
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.authority = u.Host
+	return nil, nil
+}
+
+func (r *authorityRecorder) RequireTransportSecurity() bool {
+	return true
+}
+
+func (r *authorityRecorder) Authority() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.authority
+}
+
+func TestAuthorityHostAndServerName(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	var (
+		mutex                sync.Mutex
+		lastHost, serverName string
+	)
+	handler := server.CreateDowngradingHandler(testCfg.grpcSrv, http.NotFoundHandler())
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		lastHost, serverName = req.Host, req.TLS.ServerName
+		mutex.Unlock()
+		handler.ServeHTTP(w, req)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(srv.Certificate())
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			for _, tc := range []struct {
+				name               string
+				tlsServerName      string
+				opts               []client.ConnectOption
+				expectedAuthority  string
+				expectedHost       string
+				expectedServerName string
+			}{
+				{
+					name:               "tls-server-name",
+					tlsServerName:      "example.com",
+					expectedAuthority:  "example.com",
+					expectedHost:       "example.com",
+					expectedServerName: "example.com",
+				},
+				{
+					name:               "authority",
+					opts:               []client.ConnectOption{client.WithAuthority("example.com:8443")},
+					expectedAuthority:  "example.com:8443",
+					expectedHost:       "example.com:8443",
+					expectedServerName: "example.com",
+				},
+				{
+					name: "all-overrides",
+					opts: []client.ConnectOption{
+						client.WithAuthority("api.example.com"),
+						client.WithHost("vhost.example.com"),
+						client.WithServerName("example.com"),
+					},
+					expectedAuthority:  "api.example.com",
+					expectedHost:       "vhost.example.com",
+					expectedServerName: "example.com",
+				},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+
+					recorder := &authorityRecorder{}
+					opts := append([]client.ConnectOption{
+						client.DialOpts(grpc.WithPerRPCCredentials(recorder)),
+					}, mode.opts...)
+					opts = append(opts, tc.opts...)
+					tlsConf := &tls.Config{RootCAs: rootCAs, ServerName: tc.tlsServerName}
+					conn, err := client.DialViaProxy(ctx, srv.Listener.Addr().String(), tlsConf, opts...)
+					require.NoError(t, err)
+					defer func() { _ = conn.Close() }()
+
+					_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+					require.NoError(t, err)
+
+					assert.Equal(t, tc.expectedAuthority, recorder.Authority())
+					mutex.Lock()
+					defer mutex.Unlock()
+					assert.Equal(t, tc.expectedHost, lastHost)
+					assert.Equal(t, tc.expectedServerName, serverName)
+				})
+			}
+		})
+	}
+}
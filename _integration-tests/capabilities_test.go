@@ -0,0 +1,144 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+const capabilitiesHeader = "Grpc-Http1-Capabilities"
+
+func TestServerCapabilities(t *testing.T) {
+	expected := &client.ServerCapabilities{
+		ProtocolVersion:       1,
+		Transports:            []client.Transport{client.TransportGRPC, client.TransportGRPCWeb, client.TransportWebSocket},
+		WebSocketSubprotocols: []string{"grpc-ws.v2", "grpc-ws", "grpc-websockets"},
+	}
+
+	t.Run("header", func(t *testing.T) {
+		addr, _ := newPeerRecordingServer(t)
+
+		// Every response announces the capabilities, including those of gRPC calls.
+		var md http.Header
+		conn, err := client.DialViaProxy(context.Background(), addr, nil,
+			client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			client.WithResponseHook(func(resp *http.Response) error {
+				md = resp.Header.Clone()
+				return nil
+			}))
+		require.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+		_, err = echo.NewEchoClient(conn).UnaryEcho(context.Background(), &echo.EchoRequest{Message: "hello"})
+		require.NoError(t, err)
+		assert.Contains(t, md.Get(capabilitiesHeader), "transports=grpc grpc-web websocket")
+		assert.NotContains(t, md.Get(capabilitiesHeader), "version=")
+
+		// Without the well-known endpoint, the capabilities are taken from the header, which omits the version.
+		caps, err := client.FetchServerCapabilities(context.Background(), addr, nil)
+		require.NoError(t, err)
+		assert.Equal(t, expected, caps)
+	})
+
+	t.Run("well-known-endpoint", func(t *testing.T) {
+		addr, _ := newPeerRecordingServer(t, server.ServeCapabilities(true), server.PathPrefix("/api"))
+
+		resp, err := http.Get("http://" + addr + "/api/.well-known/grpc-http1")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		var doc map[string]interface{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+		assert.EqualValues(t, 1, doc["protocolVersion"])
+		assert.Equal(t, []interface{}{"grpc", "grpc-web", "websocket"}, doc["transports"])
+		assert.Equal(t, []interface{}{"grpc-ws.v2", "grpc-ws", "grpc-websockets"}, doc["webSocketSubprotocols"])
+
+		caps, err := client.FetchServerCapabilities(context.Background(), "http://"+addr+"/api", nil)
+		require.NoError(t, err)
+		caps.Version = ""
+		assert.Equal(t, expected, caps)
+
+		conn, err := client.DialViaProxy(context.Background(), "http://"+addr+"/api", nil,
+			client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+			client.UseWebSocket(true), client.VerifyServerCapabilities())
+		require.NoError(t, err)
+		_ = conn.Close()
+	})
+
+	t.Run("no-capabilities", func(t *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+		addr := strings.TrimPrefix(srv.URL, "http://")
+
+		_, err := client.FetchServerCapabilities(context.Background(), addr, nil)
+		assert.ErrorIs(t, err, client.ErrNoCapabilities)
+
+		// Servers not announcing their capabilities are assumed to be compatible.
+		conn, err := client.DialViaProxy(context.Background(), addr, nil,
+			client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())), client.VerifyServerCapabilities())
+		require.NoError(t, err)
+		_ = conn.Close()
+	})
+}
+
+func TestIncompatibleServer(t *testing.T) {
+	// A server that only accepts gRPC-Web calls, e.g., because WebSockets are not supported by its version.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set(capabilitiesHeader, "protocol=1; version=v0.1.0; transports=grpc-web")
+		http.Error(w, "not a WebSocket server", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	_, err := client.DialViaProxy(context.Background(), addr, nil,
+		client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		client.UseWebSocket(true), client.VerifyServerCapabilities())
+	require.ErrorIs(t, err, client.ErrIncompatibleServer)
+	assert.Contains(t, err.Error(), "server does not accept calls via websocket")
+
+	downgradingConn, err := client.DialViaProxy(context.Background(), addr, nil,
+		client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		client.ForceDowngrade(true), client.VerifyServerCapabilities())
+	require.NoError(t, err)
+	_ = downgradingConn.Close()
+
+	// Without verification, calls fail with a clear error instead of a failed handshake.
+	conn, err := client.DialViaProxy(context.Background(), addr, nil,
+		client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())), client.UseWebSocket(true))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+	s, _ := status.FromError(err)
+	assert.Equal(t, codes.Unimplemented, s.Code())
+	assert.Contains(t, s.Message(), "server does not accept calls via websocket, but only via [grpc-web]")
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+)
+
+const (
+	affinityCookie = "AWSALB"
+	affinityValue  = "backend-1"
+)
+
+// stickyServer mimics a load balancer with cookie-based session affinity. It records the affinity cookie of every
+// request, and sets it on responses to requests without it.
+type stickyServer struct {
+	*http.Server
+	addr string
+
+	mutex   sync.Mutex
+	cookies []string
+}
+
+func newStickyServer(t *testing.T, grpcSrv *grpc.Server) *stickyServer {
+	s := &stickyServer{}
+	handler := server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler())
+	s.Server = &http.Server{}
+	var h2Srv http2.Server
+	require.NoError(t, http2.ConfigureServer(s.Server, &h2Srv))
+	s.Handler = h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var value string
+		if cookie, err := req.Cookie(affinityCookie); err == nil {
+			value = cookie.Value
+		} else {
+			http.SetCookie(w, &http.Cookie{Name: affinityCookie, Value: affinityValue, Path: "/"})
+		}
+		s.mutex.Lock()
+		s.cookies = append(s.cookies, value)
+		s.mutex.Unlock()
+
+		handler.ServeHTTP(w, req)
+	}), &h2Srv)
+
+	lis := listenLocal(t)
+	go s.Serve(lis)
+	s.addr = lis.Addr().String()
+	return s
+}
+
+func (s *stickyServer) Cookies() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cookies
+}
+
+func TestCookieJar(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			ownJar, err := cookiejar.New(nil)
+			require.NoError(t, err)
+
+			for _, tc := range []struct {
+				name            string
+				jar             http.CookieJar
+				withoutJar      bool
+				expectedCookies []string
+			}{
+				{name: "no-jar", withoutJar: true, expectedCookies: []string{"", "", ""}},
+				{name: "default-jar", expectedCookies: []string{"", affinityValue, affinityValue}},
+				{name: "own-jar", jar: ownJar, expectedCookies: []string{"", affinityValue, affinityValue}},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					srv := newStickyServer(t, testCfg.grpcSrv)
+					defer srv.Close()
+
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+
+					opts := append([]client.ConnectOption{
+						client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+					}, mode.opts...)
+					if !tc.withoutJar {
+						opts = append(opts, client.WithCookieJar(tc.jar))
+					}
+					conn, err := client.DialViaProxy(ctx, srv.addr, nil, opts...)
+					require.NoError(t, err)
+					defer func() { _ = conn.Close() }()
+
+					echoClient := echo.NewEchoClient(conn)
+					for range tc.expectedCookies {
+						_, err := echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+						require.NoError(t, err)
+					}
+					assert.Equal(t, tc.expectedCookies, srv.Cookies())
+
+					if tc.jar != nil {
+						cookies := tc.jar.Cookies(&url.URL{Scheme: "http", Host: srv.addr})
+						require.Len(t, cookies, 1)
+						assert.Equal(t, affinityValue, cookies[0].Value)
+					}
+				})
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"io"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -32,6 +33,7 @@ var (
 
 // echoService implements an echo server, which also sets headers and trailers.
 // Given the 'ERROR:' keyword in the message or 'error' in the header, the call will trigger an error.
+// For server-streaming calls, a 'SLEEP:<duration>' line pauses the stream for the given duration.
 // This allows for testing for errors during various stages of the response.
 type echoService struct {
 	echo.UnimplementedEchoServer
@@ -92,6 +94,18 @@ func (s echoService) ServerStreamingEcho(req *echo.EchoRequest, server echo.Echo
 			}
 			continue
 		}
+		if durationStr, ok := strings.CutPrefix(line, "SLEEP:"); ok {
+			duration, err := time.ParseDuration(durationStr)
+			if err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+			select {
+			case <-time.After(duration):
+			case <-server.Context().Done():
+				return server.Context().Err()
+			}
+			continue
+		}
 		resp := &echo.EchoResponse{Message: line}
 		if err := server.Send(resp); err != nil {
 			return err
@@ -0,0 +1,198 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// unreachableEndpoint is an endpoint that only the forward proxy knows how to reach.
+	unreachableEndpoint = "backend.invalid:443"
+)
+
+// connectProxy is a forward proxy that only supports CONNECT requests with basic authentication. It tunnels all
+// connections to the same target, regardless of the requested address.
+type connectProxy struct {
+	target             string
+	username, password string
+
+	mutex   sync.Mutex
+	tunnels []string
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	username, password, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+	if !ok || username != p.username || password != p.password {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	targetConn, err := net.Dial("tcp", p.target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer func() { _ = targetConn.Close() }()
+
+	p.mutex.Lock()
+	p.tunnels = append(p.tunnels, req.Host)
+	p.mutex.Unlock()
+
+	clientConn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer func() { _ = clientConn.Close() }()
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(targetConn, rw)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(clientConn, targetConn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *connectProxy) Tunnels() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.tunnels...)
+}
+
+func parseProxyAuthorization(auth string) (string, string, bool) {
+	req := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	return req.BasicAuth()
+}
+
+func TestForwardProxy(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	tlsSrv := httptest.NewUnstartedServer(server.CreateDowngradingHandler(testCfg.grpcSrv, http.NotFoundHandler()))
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(tlsSrv.Certificate())
+	tlsClientConf := &tls.Config{
+		RootCAs: rootCAs,
+		// The test certificate is valid for example.com.
+		ServerName: "example.com",
+	}
+
+	for _, useTLS := range []bool{false, true} {
+		for _, mode := range []struct {
+			name string
+			opts []client.ConnectOption
+		}{
+			{name: "grpc-web"},
+			{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+			{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+		} {
+			name := mode.name + "-plaintext"
+			target := testCfg.TargetAddr(t, "downgrading-grpc")
+			var tlsConf *tls.Config
+			if useTLS {
+				name = mode.name + "-tls"
+				target = tlsSrv.Listener.Addr().String()
+				tlsConf = tlsClientConf
+			}
+
+			t.Run(name, func(t *testing.T) {
+				fwdProxy := &connectProxy{target: target, username: "user", password: "secret"}
+				fwdProxySrv := httptest.NewServer(fwdProxy)
+				defer fwdProxySrv.Close()
+
+				proxyURL, err := url.Parse(fwdProxySrv.URL)
+				require.NoError(t, err)
+
+				t.Run("authenticated", func(t *testing.T) {
+					proxyURL := *proxyURL
+					proxyURL.User = url.UserPassword("user", "secret")
+
+					conn := dialViaForwardProxy(t, tlsConf, &proxyURL, mode.opts...)
+					defer func() { _ = conn.Close() }()
+
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					resp, err := echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+					require.NoError(t, err)
+					assert.Equal(t, "hello", resp.GetMessage())
+
+					// The connection established for the gRPC TLS handshake is also used for the call.
+					assert.Equal(t, []string{unreachableEndpoint}, fwdProxy.Tunnels())
+				})
+
+				t.Run("unauthenticated", func(t *testing.T) {
+					conn := dialViaForwardProxy(t, tlsConf, proxyURL, mode.opts...)
+					defer func() { _ = conn.Close() }()
+
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+					_, err := echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+					require.Error(t, err)
+					assert.Equal(t, codes.Unavailable, status.Code(err))
+					assert.Contains(t, err.Error(), "requires authentication")
+				})
+			})
+		}
+	}
+}
+
+func dialViaForwardProxy(t *testing.T, tlsConf *tls.Config, proxyURL *url.URL, opts ...client.ConnectOption) *client.ProxyConn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	opts = append([]client.ConnectOption{client.WithForwardProxy(http.ProxyURL(proxyURL))}, opts...)
+	if tlsConf == nil {
+		opts = append(opts, client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	}
+	conn, err := client.DialViaProxy(ctx, unreachableEndpoint, tlsConf, opts...)
+	require.NoError(t, err)
+	return conn
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/peer"
+)
+
+// newPeerRecordingServer starts a plaintext downgrading server with the given options, and returns its address along
+// with a function returning the peer of the last call.
+func newPeerRecordingServer(t *testing.T, opts ...server.Option) (string, func() *peer.Peer) {
+	peers := make(chan *peer.Peer, 1)
+	grpcSrv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		p, _ := peer.FromContext(ctx)
+		peers <- p
+		return handler(ctx, req)
+	}))
+	echo.RegisterEchoServer(grpcSrv, echoService{})
+	t.Cleanup(grpcSrv.Stop)
+
+	srv := &http.Server{}
+	var h2Srv http2.Server
+	require.NoError(t, http2.ConfigureServer(srv, &h2Srv))
+	srv.Handler = h2c.NewHandler(server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler(), opts...), &h2Srv)
+	lis := listenLocal(t)
+	go srv.Serve(lis)
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return lis.Addr().String(), func() *peer.Peer {
+		select {
+		case p := <-peers:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("no call was recorded")
+			return nil
+		}
+	}
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	ca := newTestCA(t)
+	clientCert := ca.Issue(t, "client-1", x509.ExtKeyUsageClientAuth)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]})
+	spiffeID, err := url.Parse("spiffe://example.org/client-2")
+	require.NoError(t, err)
+
+	cases := []struct {
+		name    string
+		trusted string
+		headers http.Header
+		check   func(t *testing.T, p *peer.Peer)
+	}{
+		{
+			name:    "xfcc-with-certificate",
+			trusted: "127.0.0.0/8",
+			headers: http.Header{
+				"X-Forwarded-For":         {"198.51.100.1, 203.0.113.7, 127.0.0.2"},
+				"X-Forwarded-Proto":       {"https"},
+				"X-Forwarded-Client-Cert": {fmt.Sprintf(`By=spiffe://example.org/lb;Hash=abcd;Cert="%s";Subject="CN=client-1"`, url.PathEscape(string(certPEM)))},
+			},
+			check: func(t *testing.T, p *peer.Peer) {
+				assert.Equal(t, "203.0.113.7:0", p.Addr.String())
+				tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+				require.True(t, ok, "unexpected auth info %T", p.AuthInfo)
+				require.Len(t, tlsInfo.State.PeerCertificates, 1)
+				assert.True(t, clientCert.Leaf.Equal(tlsInfo.State.PeerCertificates[0]))
+			},
+		},
+		{
+			name:    "forwarded-with-identity",
+			trusted: "127.0.0.0/8",
+			headers: http.Header{
+				"Forwarded":               {`for="[2001:db8::1]:4711";proto=https, for=127.0.0.2`},
+				"X-Forwarded-For":         {"198.51.100.1"},
+				"X-Forwarded-Client-Cert": {`Hash=abcd;Subject="CN=client-2,O=Example\, Inc.";URI=spiffe://example.org/client-2;DNS=client-2.example.org`},
+			},
+			check: func(t *testing.T, p *peer.Peer) {
+				assert.Equal(t, "[2001:db8::1]:4711", p.Addr.String())
+				tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+				require.True(t, ok, "unexpected auth info %T", p.AuthInfo)
+				require.Len(t, tlsInfo.State.PeerCertificates, 1)
+				cert := tlsInfo.State.PeerCertificates[0]
+				assert.Equal(t, "client-2", cert.Subject.CommonName)
+				assert.Equal(t, []string{"Example, Inc."}, cert.Subject.Organization)
+				assert.Equal(t, []*url.URL{spiffeID}, cert.URIs)
+				assert.Equal(t, []string{"client-2.example.org"}, cert.DNSNames)
+			},
+		},
+		{
+			name:    "plaintext-client",
+			trusted: "127.0.0.0/8",
+			headers: http.Header{
+				"X-Forwarded-For":   {"203.0.113.7"},
+				"X-Forwarded-Proto": {"http"},
+			},
+			check: func(t *testing.T, p *peer.Peer) {
+				assert.Equal(t, "203.0.113.7:0", p.Addr.String())
+				assert.Nil(t, p.AuthInfo)
+			},
+		},
+		{
+			name:    "untrusted-proxy",
+			trusted: "10.0.0.0/8",
+			headers: http.Header{
+				"X-Forwarded-For":         {"203.0.113.7"},
+				"X-Forwarded-Proto":       {"https"},
+				"X-Forwarded-Client-Cert": {`Subject="CN=client-1"`},
+			},
+			check: func(t *testing.T, p *peer.Peer) {
+				host, _, err := net.SplitHostPort(p.Addr.String())
+				require.NoError(t, err)
+				assert.Equal(t, "127.0.0.1", host)
+				assert.Nil(t, p.AuthInfo)
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, lastPeer := newPeerRecordingServer(t, server.TrustedProxies(netip.MustParsePrefix(c.trusted)))
+
+			for _, mode := range []struct {
+				name string
+				opts []client.ConnectOption
+			}{
+				{name: "grpc-web"},
+				{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+				{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+			} {
+				t.Run(mode.name, func(t *testing.T) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+
+					opts := append([]client.ConnectOption{
+						client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+						client.WithHeaders(c.headers),
+					}, mode.opts...)
+					conn, err := client.DialViaProxy(ctx, addr, nil, opts...)
+					require.NoError(t, err)
+					defer func() { _ = conn.Close() }()
+
+					_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+					require.NoError(t, err)
+					c.check(t, lastPeer())
+				})
+			}
+		})
+	}
+}
+
+func TestForwardedClientCertHeader(t *testing.T) {
+	ca := newTestCA(t)
+	clientCert := ca.Issue(t, "client-1", x509.ExtKeyUsageClientAuth)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]})
+
+	addr, lastPeer := newPeerRecordingServer(t,
+		server.TrustedProxies(netip.MustParsePrefix("127.0.0.1/32")),
+		server.ForwardedClientCertHeader("ssl-client-cert"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := client.DialViaProxy(ctx, addr, nil,
+		client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		client.WithHeaders(http.Header{
+			"Ssl-Client-Cert": {url.PathEscape(string(certPEM))},
+			// The Envoy header is ignored if another header is configured.
+			"X-Forwarded-Client-Cert": {`Subject="CN=client-2"`},
+		}))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+	require.NoError(t, err)
+	tlsInfo, ok := lastPeer().AuthInfo.(credentials.TLSInfo)
+	require.True(t, ok)
+	require.Len(t, tlsInfo.State.PeerCertificates, 1)
+	assert.True(t, clientCert.Leaf.Equal(tlsInfo.State.PeerCertificates[0]))
+}
@@ -0,0 +1,176 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/mem"
+)
+
+// grpcWebSocketsResult is the result of a call via the grpc-websockets protocol.
+type grpcWebSocketsResult struct {
+	header    http.Header
+	responses []*echo.EchoResponse
+	trailer   http.Header
+}
+
+// grpcWebSocketsCall performs a gRPC call like the WebSocket transport of improbable-eng's grpc-web browser client:
+// request headers are sent in the first message, and every other message is prefixed with a flag byte. Each request
+// message is split across two WebSocket messages, as the protocol does not require message boundaries to be retained.
+func grpcWebSocketsCall(t *testing.T, ctx context.Context, addr, method string, header http.Header, requests ...*echo.EchoRequest) *grpcWebSocketsResult {
+	codec := encoding.GetCodecV2("proto")
+
+	conn, _, err := websocket.Dial(ctx, "ws://"+addr+method, &websocket.DialOptions{
+		Subprotocols: []string{"grpc-websockets"},
+	})
+	require.NoError(t, err)
+	defer func() { _ = conn.CloseNow() }()
+	require.Equal(t, "grpc-websockets", conn.Subprotocol())
+
+	var hdrMsg bytes.Buffer
+	hdrMsg.WriteString("content-type: application/grpc-web+proto\r\nx-grpc-web: 1\r\n")
+	for k, vs := range header {
+		hdrMsg.WriteString(k + ": " + strings.Join(vs, ", ") + "\r\n")
+	}
+	require.NoError(t, conn.Write(ctx, websocket.MessageBinary, hdrMsg.Bytes()))
+
+	for _, req := range requests {
+		payload, err := codec.Marshal(req)
+		require.NoError(t, err)
+		frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(payload.Len()))
+		frame = append(frame, payload.Materialize()...)
+
+		split := len(frame) / 2
+		require.NoError(t, conn.Write(ctx, websocket.MessageBinary, append([]byte{0}, frame[:split]...)))
+		require.NoError(t, conn.Write(ctx, websocket.MessageBinary, append([]byte{0}, frame[split:]...)))
+	}
+	require.NoError(t, conn.Write(ctx, websocket.MessageBinary, []byte{1}))
+
+	result := &grpcWebSocketsResult{}
+	for {
+		_, msg, err := conn.Read(ctx)
+		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+			return result
+		}
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, len(msg), 5)
+		require.Equal(t, int(binary.BigEndian.Uint32(msg[1:5])), len(msg)-5)
+
+		if msg[0]&0x80 == 0 {
+			resp := &echo.EchoResponse{}
+			require.NoError(t, codec.Unmarshal(mem.BufferSlice{mem.SliceBuffer(msg[5:])}, resp))
+			result.responses = append(result.responses, resp)
+			continue
+		}
+
+		reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(append(msg[5:], "\r\n"...))))
+		mimeHeader, err := reader.ReadMIMEHeader()
+		require.NoError(t, err)
+		// Like the browser client, treat the first metadata frame as headers, and the second one as trailers.
+		if result.header == nil {
+			result.header = http.Header(mimeHeader)
+		} else {
+			result.trailer = http.Header(mimeHeader)
+		}
+	}
+}
+
+func TestGRPCWebSockets(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	addr := testCfg.TargetAddr(t, "downgrading-grpc")
+
+	t.Run("unary", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		result := grpcWebSocketsCall(t, ctx, addr, "/grpc.examples.echo.Echo/UnaryEcho",
+			http.Header{"Header-Echo": {"hdr"}, "Trailer-Echo": {"trl"}},
+			&echo.EchoRequest{Message: "hello"})
+
+		assert.Equal(t, "hdr", result.header.Get("Header-Echo-Response"))
+		require.Len(t, result.responses, 1)
+		assert.Equal(t, "hello", result.responses[0].GetMessage())
+		assert.Equal(t, "0", result.trailer.Get("Grpc-Status"))
+		assert.Equal(t, "trl", result.trailer.Get("Trailer-Echo-Response"))
+	})
+
+	t.Run("client-streaming", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		result := grpcWebSocketsCall(t, ctx, addr, "/grpc.examples.echo.Echo/ClientStreamingEcho", nil,
+			&echo.EchoRequest{Message: "one"}, &echo.EchoRequest{Message: "two"}, &echo.EchoRequest{Message: "three"})
+
+		require.Len(t, result.responses, 1)
+		assert.Equal(t, "one\ntwo\nthree", result.responses[0].GetMessage())
+		assert.Equal(t, "0", result.trailer.Get("Grpc-Status"))
+	})
+
+	t.Run("server-streaming", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		result := grpcWebSocketsCall(t, ctx, addr, "/grpc.examples.echo.Echo/ServerStreamingEcho", nil,
+			&echo.EchoRequest{Message: "one\ntwo"})
+
+		require.Len(t, result.responses, 2)
+		assert.Equal(t, "one", result.responses[0].GetMessage())
+		assert.Equal(t, "two", result.responses[1].GetMessage())
+		assert.Equal(t, "0", result.trailer.Get("Grpc-Status"))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		result := grpcWebSocketsCall(t, ctx, addr, "/grpc.examples.echo.Echo/UnaryEcho", nil,
+			&echo.EchoRequest{Message: "ERROR:oops"})
+
+		assert.Empty(t, result.responses)
+		assert.Equal(t, "3", result.trailer.Get("Grpc-Status"))
+		assert.Equal(t, "oops", result.trailer.Get("Grpc-Message"))
+	})
+
+	t.Run("unsupported-content-type", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		conn, _, err := websocket.Dial(ctx, "ws://"+addr+"/grpc.examples.echo.Echo/UnaryEcho", &websocket.DialOptions{
+			Subprotocols: []string{"grpc-websockets"},
+		})
+		require.NoError(t, err)
+		defer func() { _ = conn.CloseNow() }()
+
+		require.NoError(t, conn.Write(ctx, websocket.MessageBinary, []byte("content-type: application/grpc-web-text\r\n")))
+		_, _, err = conn.Read(ctx)
+		assert.Equal(t, websocket.StatusProtocolError, websocket.CloseStatus(err))
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// transcriptServer replays a wire transcript of a third-party gRPC-Web server in response to every request, and
+// records the headers of the last request.
+type transcriptServer struct {
+	t          *testing.T
+	transcript []byte
+
+	mutex  sync.Mutex
+	header http.Header
+}
+
+func newTranscriptServer(t *testing.T, file string) *transcriptServer {
+	transcript, err := os.ReadFile(filepath.Join("..", "internal", "grpcweb", "testdata", file))
+	require.NoError(t, err)
+	return &transcriptServer{t: t, transcript: transcript}
+}
+
+func (s *transcriptServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	_, _ = io.Copy(io.Discard, req.Body)
+	s.mutex.Lock()
+	s.header = req.Header.Clone()
+	s.mutex.Unlock()
+
+	conn, bufRW, err := http.NewResponseController(w).Hijack()
+	if !assert.NoError(s.t, err) {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	_, _ = bufRW.Write(s.transcript)
+	_ = bufRW.Flush()
+}
+
+func (s *transcriptServer) requestHeader() http.Header {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.header
+}
+
+func TestThirdPartyGRPCWebServers(t *testing.T) {
+	cases := []struct {
+		file             string
+		serverStreaming  bool
+		expectedMessages []string
+		expectedTrailers map[string]string
+		expectedCode     codes.Code
+		expectedMessage  string
+	}{
+		{
+			file:             "envoy-unary.http",
+			expectedMessages: []string{"hello"},
+			expectedTrailers: map[string]string{"trailer-echo-response": "trl"},
+		},
+		{
+			file:             "envoy-server-streaming.http",
+			serverStreaming:  true,
+			expectedMessages: []string{"one", "two"},
+		},
+		{
+			file:            "envoy-trailers-only.http",
+			expectedCode:    codes.InvalidArgument,
+			expectedMessage: "oops",
+		},
+		{
+			file:             "grpcwebproxy-unary.http",
+			expectedMessages: []string{"hello"},
+			expectedTrailers: map[string]string{"trailer-echo-response": "trl"},
+		},
+		{
+			file:            "grpcwebproxy-error.http",
+			expectedCode:    codes.InvalidArgument,
+			expectedMessage: "oops",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(strings.TrimSuffix(c.file, ".http"), func(t *testing.T) {
+			srv := newTranscriptServer(t, c.file)
+			lis := listenLocal(t)
+			httpSrv := &http.Server{Handler: srv}
+			go httpSrv.Serve(lis)
+			defer httpSrv.Shutdown(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := client.DialViaProxy(ctx, lis.Addr().String(), nil,
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.ForceDowngrade(true),
+				client.WithContentType("application/grpc-web+proto"),
+				client.WithGRPCWebHeaders("grpc-web-test/1.0"))
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			var messages []string
+			var trailer metadata.MD
+			echoClient := echo.NewEchoClient(conn)
+			if c.serverStreaming {
+				var stream echo.Echo_ServerStreamingEchoClient
+				stream, err = echoClient.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "one\ntwo"})
+				require.NoError(t, err)
+				for {
+					var resp *echo.EchoResponse
+					resp, err = stream.Recv()
+					if err != nil {
+						break
+					}
+					messages = append(messages, resp.GetMessage())
+				}
+				if err == io.EOF {
+					err = nil
+				}
+				trailer = stream.Trailer()
+			} else {
+				var resp *echo.EchoResponse
+				resp, err = echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"}, grpc.Trailer(&trailer))
+				if err == nil {
+					messages = append(messages, resp.GetMessage())
+				}
+			}
+
+			st := status.Convert(err)
+			assert.Equal(t, c.expectedCode, st.Code(), st.Message())
+			assert.Equal(t, c.expectedMessage, st.Message())
+			assert.Equal(t, c.expectedMessages, messages)
+			for k, v := range c.expectedTrailers {
+				assert.Equal(t, []string{v}, trailer.Get(k))
+			}
+
+			header := srv.requestHeader()
+			require.NotNil(t, header)
+			assert.Equal(t, "application/grpc-web+proto", header.Get("Content-Type"))
+			assert.Equal(t, "1", header.Get("X-Grpc-Web"))
+			assert.Equal(t, "grpc-web-test/1.0", header.Get("X-User-Agent"))
+		})
+	}
+}
+
+func TestGRPCWebHeadersDefaultUserAgent(t *testing.T) {
+	srv := newTranscriptServer(t, "envoy-unary.http")
+	lis := listenLocal(t)
+	httpSrv := &http.Server{Handler: srv}
+	go httpSrv.Serve(lis)
+	defer httpSrv.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := client.DialViaProxy(ctx, lis.Addr().String(), nil,
+		client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithUserAgent("my-app/2.0")),
+		client.ForceDowngrade(true),
+		client.WithGRPCWebHeaders(""))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+	require.NoError(t, err)
+
+	header := srv.requestHeader()
+	require.NotNil(t, header)
+	assert.Equal(t, "1", header.Get("X-Grpc-Web"))
+	assert.True(t, strings.HasPrefix(header.Get("X-User-Agent"), "my-app/2.0 grpc-go/"), header.Get("X-User-Agent"))
+}
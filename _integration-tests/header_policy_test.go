@@ -0,0 +1,118 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	incoming := make(chan metadata.MD, 1)
+	grpcSrv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		incoming <- md
+		return handler(ctx, req)
+	}))
+	echo.RegisterEchoServer(grpcSrv, echoService{})
+	defer grpcSrv.Stop()
+
+	srv := &http.Server{}
+	var h2Srv http2.Server
+	require.NoError(t, http2.ConfigureServer(srv, &h2Srv))
+	srv.Handler = h2c.NewHandler(server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler(),
+		server.RequestHeaderPolicy(server.HeaderPolicy{
+			Allow:        []string{"authorization", "X-Request-*", "Header-Echo", "Trailer-Echo"},
+			Rename:       map[string]string{"Cookie": "Authorization"},
+			MaxValueSize: 32,
+		})), &h2Srv)
+	lis := listenLocal(t)
+	go srv.Serve(lis)
+	defer func() { _ = srv.Close() }()
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+		// native calls are regular gRPC calls, to which the request header policy does not apply.
+		native bool
+	}{
+		{name: "grpc-web", opts: []client.ConnectOption{client.ForceDowngrade(true)}},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}, native: true},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			opts := append([]client.ConnectOption{
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.WithHeaders(http.Header{
+					"Cookie":          {"session=abc"},
+					"X-Amzn-Trace-Id": {"Root=1-abc"},
+				}),
+				client.WithResponseHeaderPolicy(client.HeaderPolicy{
+					Deny:   []string{"Header-Echo-Response"},
+					Rename: map[string]string{"Trailer-Echo-Response": "Echoed-Trailer"},
+				}),
+			}, mode.opts...)
+			conn, err := client.DialViaProxy(ctx, lis.Addr().String(), nil, opts...)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			ctx = metadata.AppendToOutgoingContext(ctx,
+				"x-request-id", "1234",
+				"x-request-large", strings.Repeat("x", 40),
+				"header-echo", "header",
+				"trailer-echo", "trailer",
+				"other", "value")
+			var header, trailer metadata.MD
+			_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"},
+				grpc.Header(&header), grpc.Trailer(&trailer))
+			require.NoError(t, err)
+
+			md := <-incoming
+			assert.Equal(t, []string{"1234"}, md.Get("x-request-id"))
+			if mode.native {
+				assert.Empty(t, md.Get("authorization"))
+				for _, key := range []string{"cookie", "x-amzn-trace-id", "x-request-large", "other"} {
+					assert.NotEmpty(t, md.Get(key), "metadata %q", key)
+				}
+			} else {
+				assert.Equal(t, []string{"session=abc"}, md.Get("authorization"))
+				for _, key := range []string{"cookie", "x-amzn-trace-id", "x-request-large", "other", "user-agent"} {
+					assert.Empty(t, md.Get(key), "metadata %q", key)
+				}
+			}
+
+			assert.Empty(t, header.Get("header-echo-response"))
+			assert.Empty(t, trailer.Get("trailer-echo-response"))
+			assert.Equal(t, []string{"trailer"}, trailer.Get("echoed-trailer"))
+		})
+	}
+}
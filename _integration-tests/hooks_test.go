@@ -0,0 +1,179 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	accessTokenHeader = "Cf-Access-Jwt-Assertion"
+	accessToken       = "secret-token"
+	signatureHeader   = "X-Signature"
+	allowedOrigin     = "https://app.example.com"
+)
+
+func signature(req *http.Request) string {
+	return "signed:" + req.Method + " " + req.URL.Path
+}
+
+// newGatedServer returns a server that mimics a load balancer requiring an access token, a signature, and the
+// allowed origin for WebSocket upgrades. It sets a Server-Timing header on all responses it lets through.
+func newGatedServer(t *testing.T, grpcSrv *grpc.Server) (*http.Server, string) {
+	handler := server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler())
+	srv := &http.Server{}
+	var h2Srv http2.Server
+	require.NoError(t, http2.ConfigureServer(srv, &h2Srv))
+	srv.Handler = h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		isUpgrade := strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+		if req.Header.Get(accessTokenHeader) != accessToken ||
+			req.Header.Get(signatureHeader) != signature(req) ||
+			(isUpgrade && req.Header.Get("Origin") != allowedOrigin) {
+			http.Error(w, "access denied", http.StatusForbidden)
+			return
+		}
+		// Like a load balancer, do not pass on the Origin header, which the WebSocket handshake of the server would
+		// reject as cross-origin.
+		req.Header.Del("Origin")
+		w.Header().Set("Server-Timing", "lb;dur=1")
+		handler.ServeHTTP(w, req)
+	}), &h2Srv)
+
+	lis := listenLocal(t)
+	go srv.Serve(lis)
+	return srv, lis.Addr().String()
+}
+
+func TestRequestResponseHooks(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	srv, addr := newGatedServer(t, testCfg.grpcSrv)
+	defer srv.Close()
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var (
+				mutex        sync.Mutex
+				serverTiming []string
+			)
+			opts := append([]client.ConnectOption{
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.WithHeaders(http.Header{accessTokenHeader: {accessToken}}),
+				client.WithHeaders(http.Header{"Origin": {allowedOrigin}}),
+				client.WithRequestHook(func(req *http.Request) error {
+					req.Header.Set(signatureHeader, signature(req))
+					return nil
+				}),
+				client.WithResponseHook(func(resp *http.Response) error {
+					mutex.Lock()
+					defer mutex.Unlock()
+					serverTiming = append(serverTiming, resp.Header.Get("Server-Timing"))
+					return nil
+				}),
+			}, mode.opts...)
+			conn, err := client.DialViaProxy(ctx, addr, nil, opts...)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			resp, err := echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+			require.NoError(t, err)
+			assert.Equal(t, "hello", resp.GetMessage())
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			assert.Equal(t, []string{"lb;dur=1"}, serverTiming)
+		})
+	}
+}
+
+func TestRequestResponseHooks_Errors(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	srv, addr := newGatedServer(t, testCfg.grpcSrv)
+	defer srv.Close()
+
+	hookErr := status.Error(codes.Unauthenticated, "no access token available")
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			for _, tc := range []struct {
+				name string
+				opt  client.ConnectOption
+			}{
+				{
+					name: "request-hook",
+					opt:  client.WithRequestHook(func(*http.Request) error { return hookErr }),
+				},
+				{
+					name: "response-hook",
+					opt:  client.WithResponseHook(func(*http.Response) error { return hookErr }),
+				},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+
+					opts := append([]client.ConnectOption{
+						client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+						tc.opt,
+					}, mode.opts...)
+					conn, err := client.DialViaProxy(ctx, addr, nil, opts...)
+					require.NoError(t, err)
+					defer func() { _ = conn.Close() }()
+
+					_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+					assert.Equal(t, codes.Unauthenticated, status.Code(err))
+					assert.Contains(t, err.Error(), "no access token available")
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+func TestHTTPErrorStatus(t *testing.T) {
+	cases := []struct {
+		name            string
+		httpStatus      int
+		header          http.Header
+		body            string
+		expectedCode    codes.Code
+		expectedMessage string
+		expectedRetry   time.Duration
+	}{
+		{
+			name:            "bad-request",
+			httpStatus:      http.StatusBadRequest,
+			header:          http.Header{"Content-Type": {"text/plain"}},
+			body:            "malformed request",
+			expectedCode:    codes.Internal,
+			expectedMessage: "400 Bad Request: malformed request",
+		},
+		{
+			name:            "unauthorized-json",
+			httpStatus:      http.StatusUnauthorized,
+			header:          http.Header{"Content-Type": {"application/json"}, "Www-Authenticate": {`Bearer realm="example"`}},
+			body:            `{"message":"Unauthorized"}`,
+			expectedCode:    codes.Unauthenticated,
+			expectedMessage: "401 Unauthorized: Unauthorized",
+		},
+		{
+			name:            "forbidden-nested-json",
+			httpStatus:      http.StatusForbidden,
+			header:          http.Header{"Content-Type": {"application/json; charset=UTF-8"}},
+			body:            `{"error":{"code":403,"message":"Your client does not have permission","status":"PERMISSION_DENIED"}}`,
+			expectedCode:    codes.PermissionDenied,
+			expectedMessage: "403 Forbidden: Your client does not have permission",
+		},
+		{
+			name:            "not-found",
+			httpStatus:      http.StatusNotFound,
+			expectedCode:    codes.Unimplemented,
+			expectedMessage: "404 Not Found",
+		},
+		{
+			name:            "rate-limited",
+			httpStatus:      http.StatusTooManyRequests,
+			header:          http.Header{"Content-Type": {"text/plain"}, "Retry-After": {"7"}},
+			body:            "slow down",
+			expectedCode:    codes.Unavailable,
+			expectedMessage: "429 Too Many Requests: slow down",
+			expectedRetry:   7 * time.Second,
+		},
+		{
+			name:            "bad-gateway-html",
+			httpStatus:      http.StatusBadGateway,
+			header:          http.Header{"Content-Type": {"text/html"}, "Server": {"nginx"}},
+			body:            "<html><head><title>502 Bad Gateway</title></head><body><center><h1>502 Bad Gateway</h1></center><hr><center>nginx</center></body></html>",
+			expectedCode:    codes.Unavailable,
+			expectedMessage: "502 Bad Gateway: 502 Bad Gateway",
+		},
+		{
+			name:            "internal-server-error",
+			httpStatus:      http.StatusInternalServerError,
+			header:          http.Header{"Content-Type": {"text/plain"}},
+			body:            "oops",
+			expectedCode:    codes.Unknown,
+			expectedMessage: "500 Internal Server Error: oops",
+		},
+	}
+
+	modes := []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lis := listenLocal(t)
+			lbSrv := &http.Server{Handler: h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				for k, vs := range c.header {
+					w.Header()[k] = vs
+				}
+				w.WriteHeader(c.httpStatus)
+				_, _ = w.Write([]byte(c.body))
+			}), &http2.Server{})}
+			go lbSrv.Serve(lis)
+			defer lbSrv.Shutdown(context.Background())
+
+			for _, mode := range modes {
+				t.Run(mode.name, func(t *testing.T) {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+
+					opts := append([]client.ConnectOption{
+						client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+					}, mode.opts...)
+					conn, err := client.DialViaProxy(ctx, lis.Addr().String(), nil, opts...)
+					require.NoError(t, err)
+					defer func() { _ = conn.Close() }()
+
+					_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+					require.Error(t, err)
+					st := status.Convert(err)
+					assert.Equal(t, c.expectedCode, st.Code(), st.Message())
+					assert.Contains(t, st.Message(), c.expectedMessage)
+
+					var errInfo *errdetails.ErrorInfo
+					var debugInfo *errdetails.DebugInfo
+					var retryInfo *errdetails.RetryInfo
+					for _, detail := range st.Details() {
+						switch d := detail.(type) {
+						case *errdetails.ErrorInfo:
+							errInfo = d
+						case *errdetails.DebugInfo:
+							debugInfo = d
+						case *errdetails.RetryInfo:
+							retryInfo = d
+						}
+					}
+
+					require.NotNil(t, errInfo)
+					assert.Equal(t, client.HTTPErrorReason, errInfo.GetReason())
+					assert.Equal(t, client.ErrorDomain, errInfo.GetDomain())
+					assert.Equal(t, strconv.Itoa(c.httpStatus), errInfo.GetMetadata()[client.HTTPStatusMetadataKey])
+					for k, vs := range c.header {
+						assert.Equal(t, vs[0], errInfo.GetMetadata()[strings.ToLower(k)])
+					}
+
+					if c.body == "" {
+						assert.Nil(t, debugInfo)
+					} else {
+						require.NotNil(t, debugInfo)
+						assert.Equal(t, c.body, debugInfo.GetDetail())
+					}
+
+					if c.expectedRetry == 0 {
+						assert.Nil(t, retryInfo)
+					} else {
+						require.NotNil(t, retryInfo)
+						assert.Equal(t, c.expectedRetry, retryInfo.GetRetryDelay().AsDuration())
+					}
+				})
+			}
+		})
+	}
+}
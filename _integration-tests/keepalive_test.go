@@ -0,0 +1,170 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+// blackHoleForwarder forwards TCP connections to a target. Once frozen, it silently drops all data, like a NAT
+// gateway that has forgotten about a connection.
+type blackHoleForwarder struct {
+	lis    net.Listener
+	target string
+	frozen atomic.Bool
+}
+
+func newBlackHoleForwarder(t *testing.T, target string) *blackHoleForwarder {
+	f := &blackHoleForwarder{
+		lis:    listenLocal(t),
+		target: target,
+	}
+	go f.serve()
+	return f
+}
+
+func (f *blackHoleForwarder) serve() {
+	for {
+		conn, err := f.lis.Accept()
+		if err != nil {
+			return
+		}
+		targetConn, err := net.Dial("tcp", f.target)
+		if err != nil {
+			_ = conn.Close()
+			continue
+		}
+		go f.forward(conn, targetConn)
+		go f.forward(targetConn, conn)
+	}
+}
+
+func (f *blackHoleForwarder) forward(dst, src net.Conn) {
+	defer func() { _ = dst.Close() }()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 && !f.frozen.Load() {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				_ = src.Close()
+			}
+			return
+		}
+	}
+}
+
+func (f *blackHoleForwarder) Addr() string {
+	return f.lis.Addr().String()
+}
+
+func (f *blackHoleForwarder) Close() {
+	_ = f.lis.Close()
+}
+
+func TestKeepalive(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	cases := []struct {
+		name         string
+		useWebSocket bool
+		// Over HTTP/1, there is no way of telling an idle stream from a broken connection.
+		http1 bool
+	}{
+		{name: "http2"},
+		{name: "ws", useWebSocket: true},
+		{name: "grpc-web-http1", http1: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			opts := []client.ConnectOption{
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.UseWebSocket(c.useWebSocket),
+				client.ForceDowngrade(c.http1),
+				client.WithKeepalive(100*time.Millisecond, 200*time.Millisecond),
+			}
+			if !c.http1 {
+				opts = append(opts, client.ForceHTTP2())
+			}
+
+			t.Run("idle-stream-survives", func(t *testing.T) {
+				if c.http1 {
+					t.SkipNow()
+				}
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				cc, err := client.ConnectViaProxy(ctx, testCfg.TargetAddr(t, "downgrading-grpc"), nil, opts...)
+				require.NoError(t, err)
+				defer func() { _ = cc.Close() }()
+
+				stream, err := echo.NewEchoClient(cc).ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "first\nSLEEP:1s\nsecond"})
+				require.NoError(t, err)
+				for _, expected := range []string{"first", "second"} {
+					resp, err := stream.Recv()
+					require.NoError(t, err)
+					assert.Equal(t, expected, resp.GetMessage())
+				}
+				_, err = stream.Recv()
+				assert.Equal(t, io.EOF, err)
+			})
+
+			t.Run("broken-path-detected", func(t *testing.T) {
+				forwarder := newBlackHoleForwarder(t, testCfg.TargetAddr(t, "downgrading-grpc"))
+				defer forwarder.Close()
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+
+				cc, err := client.ConnectViaProxy(ctx, forwarder.Addr(), nil, opts...)
+				require.NoError(t, err)
+				defer func() { _ = cc.Close() }()
+
+				stream, err := echo.NewEchoClient(cc).ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "first\nSLEEP:3s\nsecond"})
+				require.NoError(t, err)
+				resp, err := stream.Recv()
+				require.NoError(t, err)
+				assert.Equal(t, "first", resp.GetMessage())
+
+				forwarder.frozen.Store(true)
+				start := time.Now()
+				_, err = stream.Recv()
+				assert.Equal(t, codes.Unavailable, status.Code(err), "unexpected error: %v", err)
+				assert.Less(t, time.Since(start), 2*time.Second)
+			})
+		})
+	}
+}
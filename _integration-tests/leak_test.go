@@ -0,0 +1,262 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	goroutineHeaderRegex = regexp.MustCompile(`^goroutine (\d+) \[`)
+
+	// Functions that indicate a goroutine belongs to the client side of a connection. Only the client proxy uses
+	// in-memory pipe connections.
+	clientGoroutineMarkers = []string{
+		"golang.stackrox.io/grpc-http1/client.",
+		"net.(*pipe).",
+		"net/http.(*persistConn)",
+		// Depending on the Go version, the HTTP/2 client lives in golang.org/x/net/http2 or net/http/internal/http2.
+		"http2.(*ClientConn).",
+		"http2.(*clientConnReadLoop).",
+	}
+)
+
+// clientGoroutines returns the stacks of all goroutines that belong to the client side of a connection, keyed by
+// goroutine ID.
+func clientGoroutines() map[string]string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	result := make(map[string]string)
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		stackStr := string(stack)
+		match := goroutineHeaderRegex.FindStringSubmatch(stackStr)
+		if match == nil {
+			continue
+		}
+		for _, marker := range clientGoroutineMarkers {
+			if strings.Contains(stackStr, marker) {
+				result[match[1]] = stackStr
+				break
+			}
+		}
+	}
+	return result
+}
+
+// assertNoNewClientGoroutines checks that no client goroutines exist that are not in the given set. Goroutines that
+// are on their way out are given a short grace period.
+func assertNoNewClientGoroutines(t *testing.T, before map[string]string) {
+	var leaked []string
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		leaked = leaked[:0]
+		for id, stack := range clientGoroutines() {
+			if _, ok := before[id]; !ok {
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Empty(t, leaked, "leaked goroutines:\n%s", strings.Join(leaked, "\n\n"))
+}
+
+func TestProxyConnCloseDoesNotLeak(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	targetAddr := testCfg.TargetAddr(t, "downgrading-grpc")
+	_, port, err := net.SplitHostPort(targetAddr)
+	require.NoError(t, err)
+
+	ca := newTestCA(t)
+	serverCert1 := ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth)
+	serverCert2 := ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth)
+	tlsSrv := newRotatingTLSServer(testCfg.grpcSrv, ca, serverCert1, true)
+	defer tlsSrv.Close()
+	tlsConf := &tls.Config{
+		RootCAs:      ca.CertPool(),
+		Certificates: []tls.Certificate{ca.Issue(t, "client-1", x509.ExtKeyUsageClientAuth)},
+		ServerName:   "example.com",
+	}
+
+	cases := []struct {
+		name string
+		// endpoint is the endpoint to connect to, which defaults to the address of the server.
+		endpoint string
+		opts     []client.ConnectOption
+		tls      bool
+		// rotateCert makes the server present a different certificate after the first call, such that the client
+		// proxy drains the session of the gRPC transport connection.
+		rotateCert bool
+		// forwardProxy makes the client tunnel all connections through a CONNECT proxy.
+		forwardProxy bool
+	}{
+		{
+			name: "http2",
+			opts: []client.ConnectOption{client.ForceHTTP2()},
+		},
+		{
+			name: "grpc-web",
+		},
+		{
+			name: "forced-downgrade",
+			opts: []client.ConnectOption{client.ForceDowngrade(true)},
+		},
+		{
+			name: "websocket",
+			opts: []client.ConnectOption{client.UseWebSocket(true)},
+		},
+		{
+			name: "websocket-with-keepalive",
+			opts: []client.ConnectOption{client.UseWebSocket(true), client.WithKeepalive(time.Second, 0)},
+		},
+		{
+			name:     "name-resolution",
+			endpoint: "dns:///localhost:" + port,
+		},
+		{
+			name: "http2-tls",
+			opts: []client.ConnectOption{client.ForceHTTP2()},
+			tls:  true,
+		},
+		{
+			name: "grpc-web-tls",
+			tls:  true,
+		},
+		{
+			name: "websocket-tls",
+			opts: []client.ConnectOption{client.UseWebSocket(true)},
+			tls:  true,
+		},
+		{
+			name:       "grpc-web-tls-rotated-certificate",
+			tls:        true,
+			rotateCert: true,
+		},
+		{
+			name:         "grpc-web-forward-proxy",
+			forwardProxy: true,
+		},
+		{
+			name:         "websocket-tls-forward-proxy",
+			opts:         []client.ConnectOption{client.UseWebSocket(true)},
+			tls:          true,
+			forwardProxy: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srvAddr, endpoint := targetAddr, c.endpoint
+			var clientTLSConf *tls.Config
+			opts := c.opts
+			if c.tls {
+				tlsSrv.Rotate(serverCert1)
+				srvAddr, clientTLSConf = tlsSrv.Listener.Addr().String(), tlsConf
+			} else {
+				opts = append([]client.ConnectOption{
+					client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				}, opts...)
+			}
+			if endpoint == "" {
+				endpoint = srvAddr
+			}
+			if c.forwardProxy {
+				fwdProxySrv := httptest.NewServer(&connectProxy{target: srvAddr, username: "user", password: "secret"})
+				defer fwdProxySrv.Close()
+				proxyURL, err := url.Parse(fwdProxySrv.URL)
+				require.NoError(t, err)
+				proxyURL.User = url.UserPassword("user", "secret")
+				opts = append([]client.ConnectOption{client.WithForwardProxy(http.ProxyURL(proxyURL))}, opts...)
+				endpoint = unreachableEndpoint
+			}
+
+			before := clientGoroutines()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := client.DialViaProxy(ctx, endpoint, clientTLSConf, opts...)
+			require.NoError(t, err)
+
+			echoClient := echo.NewEchoClient(conn)
+			resp, err := echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+			require.NoError(t, err)
+			assert.Equal(t, "hello", resp.GetMessage())
+
+			if c.rotateCert {
+				tlsSrv.Rotate(serverCert2)
+				assert.Eventually(t, func() bool {
+					var p peer.Peer
+					if _, err := echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"}, grpc.Peer(&p)); err != nil {
+						return false
+					}
+					tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+					return ok && len(tlsInfo.State.PeerCertificates) > 0 && serverCert2.Leaf.Equal(tlsInfo.State.PeerCertificates[0])
+				}, 3*time.Second, 10*time.Millisecond)
+			}
+
+			// Keep a call in flight while closing the connection.
+			stream, err := echoClient.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "first\nSLEEP:1m\nsecond"})
+			require.NoError(t, err)
+			resp, err = stream.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, "first", resp.GetMessage())
+
+			require.NoError(t, conn.Close())
+
+			_, err = stream.Recv()
+			assert.Equal(t, codes.Canceled, status.Code(err))
+
+			assertNoNewClientGoroutines(t, before)
+
+			// Closing again is a no-op.
+			assert.NoError(t, conn.Close())
+		})
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func newEchoServer(t *testing.T, opts ...server.Option) string {
+	grpcSrv := grpc.NewServer()
+	echo.RegisterEchoServer(grpcSrv, echoService{})
+	t.Cleanup(grpcSrv.Stop)
+
+	srv := &http.Server{}
+	var h2Srv http2.Server
+	require.NoError(t, http2.ConfigureServer(srv, &h2Srv))
+	srv.Handler = h2c.NewHandler(server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler(), opts...), &h2Srv)
+	lis := listenLocal(t)
+	go srv.Serve(lis)
+	t.Cleanup(func() { _ = srv.Close() })
+	return lis.Addr().String()
+}
+
+func TestClientMetadataLimits(t *testing.T) {
+	addr := newEchoServer(t)
+	largeValue := strings.Repeat("x", 20*1024)
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+		// md is echoed by the server in the metadata frames parsed by the client.
+		md []string
+	}{
+		{name: "grpc-web", opts: []client.ConnectOption{client.ForceDowngrade(true)}, md: []string{"trailer-echo", largeValue}},
+		{name: "websocket-header", opts: []client.ConnectOption{client.UseWebSocket(true)}, md: []string{"header-echo", largeValue}},
+		{name: "websocket-trailer", opts: []client.ConnectOption{client.UseWebSocket(true)}, md: []string{"trailer-echo", largeValue}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			call := func(opts ...client.ConnectOption) error {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				opts = append([]client.ConnectOption{client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials()))}, opts...)
+				conn, err := client.DialViaProxy(ctx, addr, nil, append(opts, mode.opts...)...)
+				require.NoError(t, err)
+				defer func() { _ = conn.Close() }()
+				ctx = metadata.AppendToOutgoingContext(ctx, mode.md...)
+				_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+				return err
+			}
+
+			// The default limit of 16KB is exceeded.
+			err := call()
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err), "unexpected error %v", err)
+			assert.Contains(t, status.Convert(err).Message(), "exceeds the limit of 16384 bytes")
+
+			assert.NoError(t, call(client.WithMetadataLimits(64*1024, 0)))
+
+			err = call(client.WithMetadataLimits(64*1024, 1))
+			assert.Equal(t, codes.ResourceExhausted, status.Code(err), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestServerMetadataLimits(t *testing.T) {
+	addr := newEchoServer(t, server.MetadataLimits(1024, 10))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("grpc-websockets-request-header", func(t *testing.T) {
+		conn, _, err := websocket.Dial(ctx, "ws://"+addr+"/grpc.examples.echo.Echo/UnaryEcho", &websocket.DialOptions{
+			Subprotocols: []string{"grpc-websockets"},
+		})
+		require.NoError(t, err)
+		defer func() { _ = conn.CloseNow() }()
+
+		hdr := "content-type: application/grpc-web+proto\r\nx-large: " + strings.Repeat("x", 2048) + "\r\n"
+		require.NoError(t, conn.Write(ctx, websocket.MessageBinary, []byte(hdr)))
+		_, _, err = conn.Read(ctx)
+		assert.Equal(t, websocket.StatusMessageTooBig, websocket.CloseStatus(err), "unexpected error %v", err)
+	})
+
+	t.Run("grpc-ws-metadata-frame", func(t *testing.T) {
+		conn, _, err := websocket.Dial(ctx, "ws://"+addr+"/grpc.examples.echo.Echo/UnaryEcho", &websocket.DialOptions{
+			Subprotocols: []string{"grpc-ws.v2"},
+			HTTPHeader:   http.Header{"Content-Type": {"application/grpc"}},
+		})
+		require.NoError(t, err)
+		defer func() { _ = conn.CloseNow() }()
+
+		// A metadata frame declaring a length beyond the limit is rejected without reading it.
+		require.NoError(t, conn.Write(ctx, websocket.MessageBinary, []byte{0x80, 0, 1, 0, 0, 'a'}))
+		for {
+			_, _, err = conn.Read(ctx)
+			if err != nil {
+				break
+			}
+		}
+		assert.Equal(t, websocket.StatusCode(4000+codes.ResourceExhausted), websocket.CloseStatus(err), "unexpected error %v", err)
+	})
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+// appendingBody appends extra data to a response body, like some proxies injecting scripts do.
+type appendingBody struct {
+	io.Reader
+	io.Closer
+}
+
+func newMiddleboxHTTP1Proxy(target string, modifyResponse func(*http.Response) error) *httputil.ReverseProxy {
+	targetURL := &url.URL{Scheme: "http", Host: target}
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.ModifyResponse = modifyResponse
+	return proxy
+}
+
+// newTrailerStrippingProxy returns a handler that forwards HTTP/2 requests to the target, but drops all trailers
+// from the response.
+func newTrailerStrippingProxy(target string) http.Handler {
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		outReq := req.Clone(req.Context())
+		outReq.RequestURI = ""
+		outReq.URL.Scheme, outReq.URL.Host = "http", target
+		resp, err := transport.RoundTrip(outReq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		for k, vs := range resp.Header {
+			if k == "Grpc-Status" || k == "Grpc-Message" {
+				continue
+			}
+			w.Header()[k] = vs
+		}
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	})
+}
+
+// bufferResponse reads the entire response body, like proxies buffering responses do, such that the response is only
+// sent once the call has completed, with a content length.
+func bufferResponse(resp *http.Response) error {
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.TransferEncoding = nil
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func TestMiddleboxInterference(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	targetAddr := testCfg.TargetAddr(t, "downgrading-grpc")
+
+	cases := []struct {
+		name            string
+		middlebox       http.Handler
+		useWebSocket    bool
+		forceHTTP2      bool
+		forceDowngrade  bool
+		serverStreaming bool
+		expectedCode    codes.Code
+		expectedMessage string
+	}{
+		{
+			name: "html-interception",
+			middlebox: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				_, _ = w.Write([]byte("<html><body>Please log in</body></html>"))
+			}),
+			expectedCode:    codes.Unknown,
+			expectedMessage: "received an HTML page",
+		},
+		{
+			name: "appended-data",
+			middlebox: newMiddleboxHTTP1Proxy(targetAddr, func(resp *http.Response) error {
+				resp.Body = appendingBody{
+					Reader: io.MultiReader(resp.Body, bytes.NewReader([]byte("<script></script>"))),
+					Closer: resp.Body,
+				}
+				return nil
+			}),
+			forceDowngrade:  true,
+			expectedCode:    codes.Internal,
+			expectedMessage: "an intermediary appended",
+		},
+		{
+			name: "dropped-upgrade-headers",
+			middlebox: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				req.Header.Del("Connection")
+				req.Header.Del("Upgrade")
+				newMiddleboxHTTP1Proxy(targetAddr, nil).ServeHTTP(w, req)
+			}),
+			useWebSocket:    true,
+			expectedCode:    codes.Unavailable,
+			expectedMessage: "upgrade headers were dropped",
+		},
+		{
+			name:            "stripped-trailers",
+			middlebox:       newTrailerStrippingProxy(targetAddr),
+			forceHTTP2:      true,
+			expectedCode:    codes.Unavailable,
+			expectedMessage: "stripped the HTTP trailers",
+		},
+		{
+			name:            "buffered-server-stream",
+			middlebox:       newMiddleboxHTTP1Proxy(targetAddr, bufferResponse),
+			forceDowngrade:  true,
+			serverStreaming: true,
+			expectedCode:    codes.Unavailable,
+			expectedMessage: "an intermediary buffered the server stream",
+		},
+		{
+			// Unary responses are complete at once anyway, so buffering them is not a problem.
+			name:           "buffered-unary",
+			middlebox:      newMiddleboxHTTP1Proxy(targetAddr, bufferResponse),
+			forceDowngrade: true,
+			expectedCode:   codes.OK,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lis := listenLocal(t)
+			middleboxSrv := &http.Server{Handler: h2c.NewHandler(c.middlebox, &http2.Server{})}
+			go middleboxSrv.Serve(lis)
+			defer middleboxSrv.Shutdown(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			opts := []client.ConnectOption{
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.UseWebSocket(c.useWebSocket),
+				client.ForceDowngrade(c.forceDowngrade),
+			}
+			if c.forceHTTP2 {
+				opts = append(opts, client.ForceHTTP2())
+			}
+			cc, err := client.ConnectViaProxy(ctx, lis.Addr().String(), nil, opts...)
+			require.NoError(t, err)
+			defer func() { _ = cc.Close() }()
+
+			if c.serverStreaming {
+				err = recvAll(ctx, echo.NewEchoClient(cc))
+			} else {
+				_, err = echo.NewEchoClient(cc).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+			}
+			if c.expectedCode == codes.OK {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			st, _ := status.FromError(err)
+			assert.Equal(t, c.expectedCode, st.Code(), st.Message())
+			assert.Contains(t, st.Message(), c.expectedMessage)
+		})
+	}
+}
+
+// recvAll performs a server-streaming call, and receives all messages until the call has ended.
+func recvAll(ctx context.Context, echoClient echo.EchoClient) error {
+	stream, err := echoClient.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "hello\nworld"})
+	if err != nil {
+		return err
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+)
+
+const pathPrefix = "/api/grpc"
+
+func TestPathPrefix(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	grpcHandler := server.CreateDowngradingHandler(testCfg.grpcSrv, http.NotFoundHandler(), server.PathPrefix(pathPrefix))
+	// The mux plays the role of an ingress that only routes requests under the prefix to the gRPC server.
+	ingress := http.NewServeMux()
+	ingress.Handle(pathPrefix+"/", grpcHandler)
+
+	plaintextSrv := &http.Server{}
+	var h2Srv http2.Server
+	require.NoError(t, http2.ConfigureServer(plaintextSrv, &h2Srv))
+	plaintextSrv.Handler = h2c.NewHandler(ingress, &h2Srv)
+	lis := listenLocal(t)
+	go plaintextSrv.Serve(lis)
+	defer plaintextSrv.Close()
+
+	tlsSrv := httptest.NewUnstartedServer(ingress)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(tlsSrv.Certificate())
+	tlsConf := &tls.Config{RootCAs: rootCAs, ServerName: "example.com"}
+
+	// The gRPC handler itself also serves requests without the prefix.
+	directSrv := httptest.NewUnstartedServer(grpcHandler)
+	directSrv.EnableHTTP2 = true
+	directSrv.StartTLS()
+	defer directSrv.Close()
+	directRootCAs := x509.NewCertPool()
+	directRootCAs.AddCert(directSrv.Certificate())
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			for _, tc := range []struct {
+				name     string
+				endpoint string
+				tlsConf  *tls.Config
+			}{
+				{name: "http", endpoint: "http://" + lis.Addr().String() + pathPrefix},
+				{name: "https", endpoint: "https://" + tlsSrv.Listener.Addr().String() + pathPrefix + "/", tlsConf: tlsConf},
+				{name: "direct", endpoint: directSrv.Listener.Addr().String(), tlsConf: &tls.Config{RootCAs: directRootCAs, ServerName: "example.com"}},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+
+					opts := mode.opts
+					if tc.tlsConf == nil {
+						opts = append([]client.ConnectOption{client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials()))}, opts...)
+					}
+					conn, err := client.DialViaProxy(ctx, tc.endpoint, tc.tlsConf, opts...)
+					require.NoError(t, err)
+					defer func() { _ = conn.Close() }()
+
+					echoClient := echo.NewEchoClient(conn)
+					resp, err := echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+					require.NoError(t, err)
+					assert.Equal(t, "hello", resp.GetMessage())
+
+					stream, err := echoClient.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "hello"})
+					require.NoError(t, err)
+					_, err = stream.Recv()
+					require.NoError(t, err)
+				})
+			}
+		})
+	}
+}
+
+func TestPathPrefix_PlaintextURLWithTLSConfig(t *testing.T) {
+	_, err := client.DialViaProxy(context.Background(), "http://example.com/api/grpc", &tls.Config{})
+	assert.ErrorContains(t, err, "requires a plaintext connection")
+}
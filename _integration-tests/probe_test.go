@@ -0,0 +1,89 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// newProbedServer starts a downgrading server with the echo and health services, the latter of which the probe calls,
+// and returns its address.
+func newProbedServer(t *testing.T) string {
+	grpcSrv := grpc.NewServer()
+	echo.RegisterEchoServer(grpcSrv, echoService{})
+	healthpb.RegisterHealthServer(grpcSrv, health.NewServer())
+	t.Cleanup(grpcSrv.Stop)
+
+	srv := &http.Server{}
+	var h2Srv http2.Server
+	require.NoError(t, http2.ConfigureServer(srv, &h2Srv))
+	srv.Handler = h2c.NewHandler(server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler()), &h2Srv)
+	lis := listenLocal(t)
+	go srv.Serve(lis)
+	t.Cleanup(func() { _ = srv.Close() })
+	return lis.Addr().String()
+}
+
+func TestProbe(t *testing.T) {
+	srvAddr := newProbedServer(t)
+
+	cases := []struct {
+		name                    string
+		behindHTTP1ReverseProxy bool
+		expectNativeOK          bool
+	}{
+		{name: "direct", expectNativeOK: true},
+		{name: "behind-http1-revproxy", behindHTTP1ReverseProxy: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			targetAddr := srvAddr
+			if c.behindHTTP1ReverseProxy {
+				lis := listenLocal(t)
+				revProxySrv := newHTTP1Proxy(targetAddr)
+				go revProxySrv.Serve(lis)
+				defer revProxySrv.Shutdown(context.Background())
+
+				targetAddr = lis.Addr().String()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			report, err := client.Probe(ctx, targetAddr, nil)
+			require.NoError(t, err)
+
+			assert.Equal(t, c.expectNativeOK, report.Result(client.ProbeNativeGRPC).OK, report.String())
+			assert.True(t, report.Result(client.ProbeGRPCWeb).OK, report.String())
+			assert.True(t, report.Result(client.ProbeWebSocket).OK, report.String())
+			assert.True(t, report.Result(client.ProbeServerStreaming).OK, report.String())
+		})
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+// countingBackend is a downgrading gRPC server that counts the RPCs it handles.
+type countingBackend struct {
+	grpcSrv *grpc.Server
+	httpSrv *http.Server
+	health  *health.Server
+	addr    string
+	calls   int32
+}
+
+func newCountingBackend(t *testing.T) *countingBackend {
+	b := &countingBackend{health: health.NewServer()}
+	b.grpcSrv = grpc.NewServer(grpc.UnaryInterceptor(
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if info.FullMethod == "/grpc.examples.echo.Echo/UnaryEcho" {
+				atomic.AddInt32(&b.calls, 1)
+			}
+			return handler(ctx, req)
+		}))
+	echo.RegisterEchoServer(b.grpcSrv, echoService{})
+	healthpb.RegisterHealthServer(b.grpcSrv, b.health)
+
+	var h2Srv http2.Server
+	b.httpSrv = &http.Server{}
+	require.NoError(t, http2.ConfigureServer(b.httpSrv, &h2Srv))
+	b.httpSrv.Handler = h2c.NewHandler(server.CreateDowngradingHandler(b.grpcSrv, http.NotFoundHandler()), &h2Srv)
+
+	lis := listenLocal(t)
+	go b.httpSrv.Serve(lis)
+	b.addr = lis.Addr().String()
+	return b
+}
+
+func (b *countingBackend) Calls() int {
+	return int(atomic.LoadInt32(&b.calls))
+}
+
+func (b *countingBackend) Close() {
+	b.grpcSrv.Stop()
+	_ = b.httpSrv.Close()
+}
+
+func TestNameResolution(t *testing.T) {
+	const numCalls = 10
+
+	for _, useWebSocket := range []bool{false, true} {
+		t.Run(fmt.Sprintf("websocket=%t", useWebSocket), func(t *testing.T) {
+			t.Run("round-robin", func(t *testing.T) {
+				backends := []*countingBackend{newCountingBackend(t), newCountingBackend(t)}
+				defer backends[0].Close()
+				defer backends[1].Close()
+
+				r := manual.NewBuilderWithScheme("test")
+				r.InitialState(resolver.State{Addresses: []resolver.Address{
+					{Addr: backends[0].addr},
+					{Addr: backends[1].addr},
+				}})
+
+				cc := connectForResolution(t, "test:///echo.example.com:443", useWebSocket,
+					grpc.WithResolvers(r),
+					grpc.WithDefaultServiceConfig(`{"loadBalancingConfig": [{"round_robin": {}}]}`))
+				defer func() { _ = cc.Close() }()
+
+				unaryEchoN(t, cc, numCalls)
+				assert.Equal(t, numCalls, backends[0].Calls()+backends[1].Calls())
+				assert.NotZero(t, backends[0].Calls())
+				assert.NotZero(t, backends[1].Calls())
+			})
+
+			t.Run("health-aware", func(t *testing.T) {
+				backends := []*countingBackend{newCountingBackend(t), newCountingBackend(t)}
+				defer backends[0].Close()
+				defer backends[1].Close()
+				backends[0].health.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+
+				r := manual.NewBuilderWithScheme("test")
+				r.InitialState(resolver.State{Addresses: []resolver.Address{
+					{Addr: backends[0].addr},
+					{Addr: backends[1].addr},
+				}})
+
+				cc := connectForResolution(t, "test:///echo.example.com:443", useWebSocket,
+					grpc.WithResolvers(r),
+					grpc.WithDefaultServiceConfig(`{
+						"loadBalancingConfig": [{"round_robin": {}}],
+						"healthCheckConfig": {"serviceName": ""}
+					}`))
+				defer func() { _ = cc.Close() }()
+
+				unaryEchoN(t, cc, numCalls)
+				assert.Zero(t, backends[0].Calls())
+				assert.Equal(t, numCalls, backends[1].Calls())
+			})
+
+			t.Run("dns", func(t *testing.T) {
+				backend := newCountingBackend(t)
+				defer backend.Close()
+
+				_, port, err := net.SplitHostPort(backend.addr)
+				require.NoError(t, err)
+
+				cc := connectForResolution(t, "dns:///localhost:"+port, useWebSocket)
+				defer func() { _ = cc.Close() }()
+
+				unaryEchoN(t, cc, numCalls)
+				assert.Equal(t, numCalls, backend.Calls())
+			})
+		})
+	}
+}
+
+func connectForResolution(t *testing.T, target string, useWebSocket bool, dialOpts ...grpc.DialOption) *grpc.ClientConn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	cc, err := client.ConnectViaProxy(ctx, target, nil,
+		client.UseWebSocket(useWebSocket),
+		client.DialOpts(dialOpts...))
+	require.NoError(t, err)
+	return cc
+}
+
+func unaryEchoN(t *testing.T, cc *grpc.ClientConn, n int) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	echoClient := echo.NewEchoClient(cc)
+	for i := 0; i < n; i++ {
+		resp, err := echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"}, grpc.WaitForReady(true))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", resp.GetMessage())
+	}
+}
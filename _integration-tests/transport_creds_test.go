@@ -0,0 +1,171 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/peer"
+)
+
+// countingCreds are transport credentials that count the client handshakes they perform.
+type countingCreds struct {
+	credentials.TransportCredentials
+	handshakes *atomic.Int32
+}
+
+func (c countingCreds) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	c.handshakes.Add(1)
+	return c.TransportCredentials.ClientHandshake(ctx, authority, conn)
+}
+
+func (c countingCreds) Clone() credentials.TransportCredentials {
+	return countingCreds{
+		TransportCredentials: c.TransportCredentials.Clone(),
+		handshakes:           c.handshakes,
+	}
+}
+
+func TestTransportCredentials(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	ca := newTestCA(t)
+	spiffeID := &url.URL{Scheme: "spiffe", Host: "example.com", Path: "/backend"}
+	serverCert := ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth, spiffeID)
+	clientCert := ca.Issue(t, "client-1", x509.ExtKeyUsageClientAuth)
+
+	for _, mode := range []struct {
+		name        string
+		enableHTTP2 bool
+		opts        []client.ConnectOption
+	}{
+		{name: "grpc-web", enableHTTP2: true},
+		{name: "http2", enableHTTP2: true, opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			srv := newRotatingTLSServer(testCfg.grpcSrv, ca, serverCert, mode.enableHTTP2)
+			defer srv.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			creds := countingCreds{
+				TransportCredentials: credentials.NewTLS(&tls.Config{
+					RootCAs:      ca.CertPool(),
+					Certificates: []tls.Certificate{clientCert},
+					// credentials.NewTLS always offers "h2" in addition.
+					NextProtos: []string{"http/1.1"},
+				}),
+				handshakes: &atomic.Int32{},
+			}
+			opts := append([]client.ConnectOption{client.WithTransportCredentials(creds)}, mode.opts...)
+			// With transport credentials, the TLS config only determines the server name.
+			conn, err := client.DialViaProxy(ctx, srv.Listener.Addr().String(), &tls.Config{ServerName: "example.com"}, opts...)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			var p peer.Peer
+			_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"}, grpc.Peer(&p))
+			require.NoError(t, err)
+
+			tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+			require.True(t, ok, "unexpected auth info %T", p.AuthInfo)
+			require.NotEmpty(t, tlsInfo.State.PeerCertificates)
+			assert.True(t, serverCert.Leaf.Equal(tlsInfo.State.PeerCertificates[0]))
+			// The SPIFFE ID is only populated by the credentials, so the auth info must be the one they reported.
+			assert.Equal(t, spiffeID, tlsInfo.SPIFFEID)
+
+			assert.Equal(t, "client-1", srv.LastClientName())
+			assert.NotZero(t, creds.handshakes.Load())
+		})
+	}
+}
+
+func TestTransportCredentials_WebSocketOverNegotiatedHTTP2(t *testing.T) {
+	if runWithExtendedConnect(t) {
+		return
+	}
+
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	ca := newTestCA(t)
+	cert := ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth)
+	addr, recorder, stop := newWebSocketHTTP2Server(t, testCfg.grpcSrv, &cert, true)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// credentials.NewTLS always offers "h2", which the server negotiates.
+	creds := credentials.NewTLS(&tls.Config{RootCAs: ca.CertPool()})
+	conn, err := client.DialViaProxy(ctx, addr, &tls.Config{ServerName: "example.com"},
+		client.WithTransportCredentials(creds), client.UseWebSocket(true))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	runConcurrentCalls(t, conn)
+
+	handshakes := recorder.Handshakes()
+	assert.Len(t, handshakes, 10)
+	for _, handshake := range handshakes {
+		assert.Equal(t, "CONNECT HTTP/2.0", handshake)
+	}
+	assert.EqualValues(t, 1, recorder.conns.Load(), "the connection of the gRPC handshake should be used for all WebSockets")
+}
+
+func TestTransportCredentials_WebSocketWithoutExtendedConnect(t *testing.T) {
+	if extendedConnectEnabled() {
+		t.Skipf("HTTP/2 servers support extended CONNECT (%s)", extendedConnectGODEBUG)
+	}
+
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	ca := newTestCA(t)
+	srv := newRotatingTLSServer(testCfg.grpcSrv, ca, ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth), true)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	creds := credentials.NewTLS(&tls.Config{
+		RootCAs:      ca.CertPool(),
+		Certificates: []tls.Certificate{ca.Issue(t, "client-1", x509.ExtKeyUsageClientAuth)},
+	})
+	conn, err := client.DialViaProxy(ctx, srv.Listener.Addr().String(), &tls.Config{ServerName: "example.com"},
+		client.WithTransportCredentials(creds), client.UseWebSocket(true))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "WebSockets over HTTP/2 are not supported")
+}
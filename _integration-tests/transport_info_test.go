@@ -0,0 +1,151 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTransportInfo(t *testing.T) {
+	if runWithExtendedConnect(t) {
+		return
+	}
+
+	serverInfos := make(chan server.TransportInfo, 1)
+	recordTransport := func(ctx context.Context) {
+		info, ok := server.TransportFromContext(ctx)
+		if assert.True(t, ok, "no transport info in context") {
+			serverInfos <- *info
+		}
+	}
+	grpcSrv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			recordTransport(ctx)
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			recordTransport(ss.Context())
+			return handler(srv, ss)
+		}))
+	echo.RegisterEchoServer(grpcSrv, echoService{})
+	defer grpcSrv.Stop()
+
+	addr, _, stop := newWebSocketHTTP2Server(t, grpcSrv, nil, true)
+	defer stop()
+
+	cases := []struct {
+		name     string
+		opts     []client.ConnectOption
+		expected server.TransportInfo
+	}{
+		{
+			name:     "http2",
+			opts:     []client.ConnectOption{client.ForceHTTP2()},
+			expected: server.TransportInfo{Transport: server.TransportGRPC, Proto: "HTTP/2.0"},
+		},
+		{
+			name:     "http1-with-trailers",
+			expected: server.TransportInfo{Transport: server.TransportGRPC, Proto: "HTTP/1.1"},
+		},
+		{
+			name:     "grpc-web",
+			opts:     []client.ConnectOption{client.ForceDowngrade(true)},
+			expected: server.TransportInfo{Transport: server.TransportGRPCWeb, Proto: "HTTP/1.1", Downgraded: true},
+		},
+		{
+			name:     "websocket",
+			opts:     []client.ConnectOption{client.UseWebSocket(true)},
+			expected: server.TransportInfo{Transport: server.TransportWebSocket, Proto: "HTTP/1.1", Subprotocol: "grpc-ws.v2"},
+		},
+		{
+			name:     "websocket-over-http2",
+			opts:     []client.ConnectOption{client.UseWebSocket(true), client.UseWebSocketOverHTTP2(true)},
+			expected: server.TransportInfo{Transport: server.TransportWebSocket, Proto: "HTTP/2.0", Subprotocol: "grpc-ws.v2"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			opts := append([]client.ConnectOption{client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials()))}, c.opts...)
+			conn, err := client.DialViaProxy(ctx, addr, nil, opts...)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			echoClient := echo.NewEchoClient(conn)
+
+			// The client sees the same transport as the server.
+			expectedClientInfo := client.TransportInfo{
+				Transport:   client.Transport(c.expected.Transport),
+				Proto:       c.expected.Proto,
+				Downgraded:  c.expected.Downgraded,
+				Subprotocol: c.expected.Subprotocol,
+			}
+
+			var clientInfo client.TransportInfo
+			_, err = echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"}, client.CallTransportInfo(&clientInfo))
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, <-serverInfos)
+			assert.Equal(t, expectedClientInfo, clientInfo)
+
+			clientInfo = client.TransportInfo{}
+			stream, err := echoClient.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "hello"}, client.CallTransportInfo(&clientInfo))
+			require.NoError(t, err)
+			for {
+				if _, err := stream.Recv(); err != nil {
+					require.ErrorIs(t, err, io.EOF)
+					break
+				}
+			}
+			assert.Equal(t, c.expected, <-serverInfos)
+			assert.Equal(t, expectedClientInfo, clientInfo)
+
+			// Without the call option, the transport info does not show up in the header metadata.
+			var header metadata.MD
+			_, err = echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"}, grpc.Header(&header))
+			require.NoError(t, err)
+			<-serverInfos
+			assert.Empty(t, header.Get("grpchttp1-transport"))
+
+			header = nil
+			stream, err = echoClient.ServerStreamingEcho(ctx, &echo.EchoRequest{Message: "hello"}, grpc.Header(&header))
+			require.NoError(t, err)
+			streamHeader, err := stream.Header()
+			require.NoError(t, err)
+			assert.Empty(t, streamHeader.Get("grpchttp1-transport"))
+			for {
+				if _, err := stream.Recv(); err != nil {
+					require.ErrorIs(t, err, io.EOF)
+					break
+				}
+			}
+			<-serverInfos
+			assert.NotNil(t, header)
+			assert.Empty(t, header.Get("grpchttp1-transport"))
+		})
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+)
+
+// listenUnix listens on a Unix domain socket in a new temporary directory. The directory is not created via
+// t.TempDir, as the length of socket paths is limited.
+func listenUnix(t *testing.T) (net.Listener, string) {
+	dir, err := os.MkdirTemp("", "grpc-http1")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "server.sock")
+	lis, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	return lis, path
+}
+
+func TestUnixSocket(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	lis, path := listenUnix(t)
+	go testCfg.httpSrv.Serve(lis)
+
+	tlsSrv := httptest.NewUnstartedServer(server.CreateDowngradingHandler(testCfg.grpcSrv, http.NotFoundHandler()))
+	tlsSrv.Listener, _ = listenUnix(t)
+	tlsSrv.EnableHTTP2 = true
+	tlsSrv.StartTLS()
+	defer tlsSrv.Close()
+	tlsPath := tlsSrv.Listener.Addr().String()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(tlsSrv.Certificate())
+	tlsConf := &tls.Config{RootCAs: rootCAs, ServerName: "example.com"}
+
+	modes := []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	}
+	endpoints := []struct {
+		name     string
+		endpoint string
+		tls      bool
+	}{
+		{name: "unix-path", endpoint: "unix:" + path},
+		{name: "unix-uri", endpoint: "unix://" + path},
+		{name: "unix-uri-tls", endpoint: "unix://" + tlsPath, tls: true},
+	}
+
+	for _, mode := range modes {
+		for _, ep := range endpoints {
+			t.Run(mode.name+"/"+ep.name, func(t *testing.T) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+
+				var (
+					conn *client.ProxyConn
+					err  error
+				)
+				if ep.tls {
+					conn, err = client.DialViaProxy(ctx, ep.endpoint, tlsConf, mode.opts...)
+				} else {
+					opts := append([]client.ConnectOption{client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials()))}, mode.opts...)
+					conn, err = client.DialViaProxy(ctx, ep.endpoint, nil, opts...)
+				}
+				require.NoError(t, err)
+				defer func() { _ = conn.Close() }()
+
+				resp, err := echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+				require.NoError(t, err)
+				assert.Equal(t, "hello", resp.GetMessage())
+			})
+		}
+	}
+}
+
+func TestContextDialer(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	lis, path := listenUnix(t)
+	go testCfg.httpSrv.Serve(lis)
+
+	const endpoint = "backend.invalid:1234"
+
+	for _, mode := range []struct {
+		name string
+		opts []client.ConnectOption
+	}{
+		{name: "grpc-web"},
+		{name: "http2", opts: []client.ConnectOption{client.ForceHTTP2()}},
+		{name: "websocket", opts: []client.ConnectOption{client.UseWebSocket(true)}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var (
+				mutex sync.Mutex
+				addrs []string
+			)
+			dial := func(ctx context.Context, addr string) (net.Conn, error) {
+				mutex.Lock()
+				addrs = append(addrs, addr)
+				mutex.Unlock()
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			}
+
+			opts := append([]client.ConnectOption{
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.WithContextDialer(dial),
+			}, mode.opts...)
+			conn, err := client.DialViaProxy(ctx, endpoint, nil, opts...)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			resp, err := echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+			require.NoError(t, err)
+			assert.Equal(t, "hello", resp.GetMessage())
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			require.NotEmpty(t, addrs)
+			for _, addr := range addrs {
+				assert.Equal(t, endpoint, addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+// cancelFrame creates a cancel frame of version 2 of gRPC-websocket.
+func cancelFrame(code codes.Code, msg string) []byte {
+	payload := binary.BigEndian.AppendUint32([]byte{1}, uint32(code))
+	payload = append(payload, msg...)
+	frame := binary.BigEndian.AppendUint32([]byte{1 << 6}, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func TestWebSocketCallCancellation(t *testing.T) {
+	if runWithExtendedConnect(t) {
+		return
+	}
+
+	// Unary calls with the "BLOCK" message block until canceled, and report the cause of the cancellation.
+	causes := make(chan error, 1)
+	grpcSrv := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if echoReq, ok := req.(*echo.EchoRequest); ok && echoReq.GetMessage() == "BLOCK" {
+			<-ctx.Done()
+			causes <- context.Cause(ctx)
+			return nil, ctx.Err()
+		}
+		return handler(ctx, req)
+	}))
+	echo.RegisterEchoServer(grpcSrv, echoService{})
+	defer grpcSrv.Stop()
+
+	for _, overHTTP2 := range []bool{false, true} {
+		name := "http1"
+		if overHTTP2 {
+			name = "http2"
+		}
+		t.Run(name, func(t *testing.T) {
+			addr, recorder, stop := newWebSocketHTTP2Server(t, grpcSrv, nil, true)
+			defer stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := client.DialViaProxy(ctx, addr, nil,
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.UseWebSocket(true),
+				client.UseWebSocketOverHTTP2(overHTTP2))
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+			echoClient := echo.NewEchoClient(conn)
+
+			resp, err := echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+			require.NoError(t, err)
+			assert.Equal(t, "hello", resp.GetMessage())
+
+			callCtx, cancelCall := context.WithCancel(ctx)
+			time.AfterFunc(200*time.Millisecond, cancelCall)
+			_, err = echoClient.UnaryEcho(callCtx, &echo.EchoRequest{Message: "BLOCK"})
+			assert.Equal(t, codes.Canceled, status.Code(err))
+
+			select {
+			case cause := <-causes:
+				st, _ := status.FromError(cause)
+				assert.Equal(t, codes.Canceled, st.Code())
+				assert.Equal(t, "call canceled by client", st.Message())
+			case <-time.After(5 * time.Second):
+				t.Fatal("server did not observe the cancellation of the call")
+			}
+
+			expectedHandshake := "GET HTTP/1.1"
+			if overHTTP2 {
+				expectedHandshake = "CONNECT HTTP/2.0"
+			}
+			assert.Equal(t, []string{expectedHandshake, expectedHandshake}, recorder.Handshakes())
+		})
+	}
+}
+
+func TestWebSocketClientCancelFrame(t *testing.T) {
+	type result struct {
+		lastMsg   []byte
+		closeCode websocket.StatusCode
+	}
+	results := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{Subprotocols: []string{"grpc-ws.v2"}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer func() { _ = conn.CloseNow() }()
+		var res result
+		for {
+			_, msg, err := conn.Read(req.Context())
+			if err != nil {
+				res.closeCode = websocket.CloseStatus(err)
+				break
+			}
+			res.lastMsg = msg
+		}
+		results <- res
+	})}
+	lis := listenLocal(t)
+	go srv.Serve(lis)
+	defer srv.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := client.DialViaProxy(ctx, lis.Addr().String(), nil,
+		client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		client.UseWebSocket(true))
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	callCtx, cancelCall := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancelCall()
+	_, err = echo.NewEchoClient(conn).UnaryEcho(callCtx, &echo.EchoRequest{Message: "hello"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	select {
+	case res := <-results:
+		assert.Equal(t, cancelFrame(codes.DeadlineExceeded, "deadline exceeded"), res.lastMsg)
+		assert.Equal(t, websocket.StatusCode(4000+codes.DeadlineExceeded), res.closeCode)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not observe the cancellation of the call")
+	}
+}
+
+func TestWebSocketAbortByServer(t *testing.T) {
+	cases := []struct {
+		name            string
+		subprotocol     string
+		abort           func(ctx context.Context, conn *websocket.Conn)
+		expectedCode    codes.Code
+		expectedMessage string
+	}{
+		{
+			name:        "cancel-frame",
+			subprotocol: "grpc-ws.v2",
+			abort: func(ctx context.Context, conn *websocket.Conn) {
+				_ = conn.Write(ctx, websocket.MessageBinary, cancelFrame(codes.ResourceExhausted, "quota exceeded"))
+				_ = conn.Close(websocket.StatusCode(4000+codes.ResourceExhausted), "quota exceeded")
+			},
+			expectedCode:    codes.ResourceExhausted,
+			expectedMessage: "call aborted by server: quota exceeded",
+		},
+		{
+			name:        "status-close-code",
+			subprotocol: "grpc-ws.v2",
+			abort: func(_ context.Context, conn *websocket.Conn) {
+				_ = conn.Close(websocket.StatusCode(4000+codes.PermissionDenied), "denied")
+			},
+			expectedCode:    codes.PermissionDenied,
+			expectedMessage: "server closed the WebSocket connection: denied",
+		},
+		{
+			name:        "message-too-big",
+			subprotocol: "grpc-ws.v2",
+			abort: func(_ context.Context, conn *websocket.Conn) {
+				_ = conn.Close(websocket.StatusMessageTooBig, "")
+			},
+			expectedCode:    codes.ResourceExhausted,
+			expectedMessage: "server closed the WebSocket connection: WebSocket connection closed with status StatusMessageTooBig",
+		},
+		{
+			name:        "going-away",
+			subprotocol: "grpc-ws.v2",
+			abort: func(_ context.Context, conn *websocket.Conn) {
+				_ = conn.Close(websocket.StatusGoingAway, "shutting down")
+			},
+			expectedCode:    codes.Unavailable,
+			expectedMessage: "server closed the WebSocket connection: shutting down",
+		},
+		{
+			// Servers that only speak the original version of gRPC-websocket do not convey status codes.
+			name:        "version-1",
+			subprotocol: "grpc-ws",
+			abort: func(_ context.Context, conn *websocket.Conn) {
+				_ = conn.Close(websocket.StatusCode(4000+codes.PermissionDenied), "denied")
+			},
+			expectedCode:    codes.Unavailable,
+			expectedMessage: `reason = "denied"`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{Subprotocols: []string{c.subprotocol}})
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer func() { _ = conn.CloseNow() }()
+				c.abort(req.Context(), conn)
+			})}
+			lis := listenLocal(t)
+			go srv.Serve(lis)
+			defer srv.Shutdown(context.Background())
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := client.DialViaProxy(ctx, lis.Addr().String(), nil,
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.UseWebSocket(true))
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			_, err = echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+			st, _ := status.FromError(err)
+			assert.Equal(t, c.expectedCode, st.Code(), st.Message())
+			assert.Contains(t, st.Message(), c.expectedMessage)
+		})
+	}
+}
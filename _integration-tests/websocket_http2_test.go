@@ -0,0 +1,252 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.stackrox.io/grpc-http1/client"
+	"golang.stackrox.io/grpc-http1/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+)
+
+// extendedConnectGODEBUG enables extended CONNECT in Go's HTTP/2 servers. It is only read from the environment at
+// program start.
+const extendedConnectGODEBUG = "http2xconnect=1"
+
+// extendedConnectEnabled checks whether the HTTP/2 servers of this process support extended CONNECT.
+func extendedConnectEnabled() bool {
+	return strings.Contains(os.Getenv("GODEBUG"), extendedConnectGODEBUG)
+}
+
+// runWithExtendedConnect runs the calling test in a subprocess in which the HTTP/2 servers support extended CONNECT,
+// unless this process already is such a process. It returns whether the test has been run in a subprocess, in which
+// case the caller must return.
+func runWithExtendedConnect(t *testing.T) bool {
+	if extendedConnectEnabled() {
+		return false
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v", "-test.count=1")
+	cmd.Env = append(os.Environ(), "GODEBUG="+strings.TrimPrefix(os.Getenv("GODEBUG")+","+extendedConnectGODEBUG, ","))
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, "running test with %s:\n%s", extendedConnectGODEBUG, out)
+	require.Contains(t, string(out), "--- PASS: "+t.Name(), "test did not run with %s:\n%s", extendedConnectGODEBUG, out)
+	return true
+}
+
+// handshakeRecorder records the method and protocol of every WebSocket handshake, and counts the connections of the
+// server it is installed in.
+type handshakeRecorder struct {
+	handler http.Handler
+
+	conns      atomic.Int32
+	mutex      sync.Mutex
+	handshakes []string
+}
+
+func (r *handshakeRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Sec-Websocket-Protocol") != "" {
+		r.mutex.Lock()
+		r.handshakes = append(r.handshakes, req.Method+" "+req.Proto)
+		r.mutex.Unlock()
+	}
+	r.handler.ServeHTTP(w, req)
+}
+
+func (r *handshakeRecorder) connState(_ net.Conn, state http.ConnState) {
+	if state == http.StateNew {
+		r.conns.Add(1)
+	}
+}
+
+func (r *handshakeRecorder) Handshakes() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.handshakes
+}
+
+// newWebSocketHTTP2Server starts a downgrading server, which uses TLS if the given certificate is non-nil, and
+// otherwise HTTP/2 with prior knowledge.
+func newWebSocketHTTP2Server(t *testing.T, grpcSrv *grpc.Server, cert *tls.Certificate, enableHTTP2 bool) (string, *handshakeRecorder, func()) {
+	recorder := &handshakeRecorder{handler: server.CreateDowngradingHandler(grpcSrv, http.NotFoundHandler())}
+	if cert != nil {
+		srv := httptest.NewUnstartedServer(recorder)
+		srv.Config.ConnState = recorder.connState
+		srv.EnableHTTP2 = enableHTTP2
+		srv.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+		srv.StartTLS()
+		return srv.Listener.Addr().String(), recorder, srv.Close
+	}
+
+	srv := &http.Server{
+		Handler:   h2c.NewHandler(recorder, &http2.Server{}),
+		ConnState: recorder.connState,
+	}
+	lis := listenLocal(t)
+	go srv.Serve(lis)
+	return lis.Addr().String(), recorder, func() { _ = srv.Shutdown(context.Background()) }
+}
+
+// runConcurrentCalls performs unary and client-streaming calls concurrently.
+func runConcurrentCalls(t *testing.T, conn grpc.ClientConnInterface) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	echoClient := echo.NewEchoClient(conn)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			resp, err := echoClient.UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+			if assert.NoError(t, err) {
+				assert.Equal(t, "hello", resp.GetMessage())
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			stream, err := echoClient.ClientStreamingEcho(ctx)
+			if !assert.NoError(t, err) {
+				return
+			}
+			for _, msg := range []string{"one", "two"} {
+				assert.NoError(t, stream.Send(&echo.EchoRequest{Message: msg}))
+			}
+			resp, err := stream.CloseAndRecv()
+			if assert.NoError(t, err) {
+				assert.Equal(t, "one\ntwo", resp.GetMessage())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestWebSocketOverHTTP2(t *testing.T) {
+	if runWithExtendedConnect(t) {
+		return
+	}
+
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	ca := newTestCA(t)
+	cert := ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth)
+
+	cases := []struct {
+		name string
+		cert *tls.Certificate
+		tls  *tls.Config
+	}{
+		{name: "h2c"},
+		{name: "tls", cert: &cert, tls: &tls.Config{RootCAs: ca.CertPool(), ServerName: "example.com"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			addr, recorder, stop := newWebSocketHTTP2Server(t, testCfg.grpcSrv, c.cert, true)
+			defer stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := client.DialViaProxy(ctx, addr, c.tls,
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.UseWebSocket(true),
+				client.UseWebSocketOverHTTP2(true))
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			runConcurrentCalls(t, conn)
+
+			handshakes := recorder.Handshakes()
+			assert.Len(t, handshakes, 10)
+			for _, handshake := range handshakes {
+				assert.Equal(t, "CONNECT HTTP/2.0", handshake)
+			}
+			assert.EqualValues(t, 1, recorder.conns.Load(), "all WebSockets should share a single connection")
+		})
+	}
+}
+
+func TestWebSocketOverHTTP2_Fallback(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	ca := newTestCA(t)
+	cert := ca.Issue(t, "example.com", x509.ExtKeyUsageServerAuth)
+
+	cases := []struct {
+		name        string
+		cert        *tls.Certificate
+		tls         *tls.Config
+		enableHTTP2 bool
+		skip        bool
+	}{
+		{
+			name: "http2-not-negotiated",
+			cert: &cert,
+			tls:  &tls.Config{RootCAs: ca.CertPool(), ServerName: "example.com"},
+		},
+		{
+			name:        "extended-connect-not-enabled",
+			enableHTTP2: true,
+			skip:        extendedConnectEnabled(),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if c.skip {
+				t.Skipf("HTTP/2 servers support extended CONNECT (%s)", extendedConnectGODEBUG)
+			}
+			addr, recorder, stop := newWebSocketHTTP2Server(t, testCfg.grpcSrv, c.cert, c.enableHTTP2)
+			defer stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, err := client.DialViaProxy(ctx, addr, c.tls,
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.UseWebSocket(true),
+				client.UseWebSocketOverHTTP2(true))
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			runConcurrentCalls(t, conn)
+
+			handshakes := recorder.Handshakes()
+			assert.Len(t, handshakes, 10)
+			for _, handshake := range handshakes {
+				assert.Equal(t, "GET HTTP/1.1", handshake)
+			}
+		})
+	}
+}
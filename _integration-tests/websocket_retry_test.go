@@ -0,0 +1,152 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package integrationtests
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/client"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/examples/features/proto/echo"
+	"google.golang.org/grpc/status"
+)
+
+// flakyLoadBalancer answers the first failures WebSocket handshakes with the given status, like a load balancer
+// without healthy backends during a deployment, and forwards all other requests to the target.
+type flakyLoadBalancer struct {
+	target     http.Handler
+	failures   int32
+	status     int
+	handshakes atomic.Int32
+}
+
+func (b *flakyLoadBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if n := b.handshakes.Add(1); n <= b.failures {
+		http.Error(w, http.StatusText(b.status), b.status)
+		return
+	}
+	b.target.ServeHTTP(w, req)
+}
+
+func TestWebSocketRetry(t *testing.T) {
+	testCfg := newTestConfig(t, false)
+	defer testCfg.TearDown()
+
+	targetAddr := testCfg.TargetAddr(t, "downgrading-grpc")
+
+	cases := []struct {
+		name               string
+		failures           int32
+		status             int
+		retryOpt           client.ConnectOption
+		timeout            time.Duration
+		expectedCode       codes.Code
+		expectedHandshakes int32
+	}{
+		{
+			name:               "no-retry",
+			failures:           1,
+			status:             http.StatusServiceUnavailable,
+			expectedCode:       codes.Unavailable,
+			expectedHandshakes: 1,
+		},
+		{
+			name:               "retry-succeeds",
+			failures:           2,
+			status:             http.StatusBadGateway,
+			retryOpt:           client.WithWebSocketRetry(3, 10*time.Millisecond, 0),
+			expectedCode:       codes.OK,
+			expectedHandshakes: 3,
+		},
+		{
+			name:               "retries-exhausted",
+			failures:           100,
+			status:             http.StatusServiceUnavailable,
+			retryOpt:           client.WithWebSocketRetry(3, 10*time.Millisecond, 0),
+			expectedCode:       codes.Unavailable,
+			expectedHandshakes: 3,
+		},
+		{
+			name:               "not-retryable",
+			failures:           1,
+			status:             http.StatusForbidden,
+			retryOpt:           client.WithWebSocketRetry(3, 10*time.Millisecond, 0),
+			expectedCode:       codes.PermissionDenied,
+			expectedHandshakes: 1,
+		},
+		{
+			name:               "capped-by-deadline",
+			failures:           100,
+			status:             http.StatusServiceUnavailable,
+			retryOpt:           client.WithWebSocketRetry(10, 2*time.Second, 0),
+			timeout:            time.Second,
+			expectedCode:       codes.Unavailable,
+			expectedHandshakes: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lb := &flakyLoadBalancer{
+				target:   newMiddleboxHTTP1Proxy(targetAddr, nil),
+				failures: c.failures,
+				status:   c.status,
+			}
+			lis := listenLocal(t)
+			lbSrv := &http.Server{Handler: lb}
+			go lbSrv.Serve(lis)
+			defer lbSrv.Shutdown(context.Background())
+
+			opts := []client.ConnectOption{
+				client.DialOpts(grpc.WithTransportCredentials(insecure.NewCredentials())),
+				client.UseWebSocket(true),
+			}
+			if c.retryOpt != nil {
+				opts = append(opts, c.retryOpt)
+			}
+			dialCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := client.DialViaProxy(dialCtx, lis.Addr().String(), nil, opts...)
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			timeout := c.timeout
+			if timeout == 0 {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			start := time.Now()
+			resp, err := echo.NewEchoClient(conn).UnaryEcho(ctx, &echo.EchoRequest{Message: "hello"})
+			assert.Equal(t, c.expectedCode, status.Code(err), "unexpected error: %v", err)
+			if c.expectedCode == codes.OK {
+				assert.Equal(t, "hello", resp.GetMessage())
+			}
+			assert.Equal(t, c.expectedHandshakes, lb.handshakes.Load())
+			if c.timeout != 0 {
+				assert.Less(t, time.Since(start), c.timeout, "the call should fail without waiting for the next attempt")
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/capabilities"
+	"golang.stackrox.io/grpc-http1/internal/size"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	maxCapabilitiesSize = 64 * size.KB
+)
+
+var (
+	// ErrNoCapabilities indicates that a server did not announce its capabilities, e.g., because it does not use this
+	// library, or an older version of it.
+	ErrNoCapabilities = errors.New("server did not announce its capabilities")
+	// ErrIncompatibleServer indicates that the capabilities announced by a server do not allow making calls with the
+	// configured connect options.
+	ErrIncompatibleServer = errors.New("incompatible server")
+)
+
+// ServerCapabilities describes what a server supports, as announced by the server.
+type ServerCapabilities struct {
+	// ProtocolVersion is the version of the announcement.
+	ProtocolVersion int
+	// Version is the version of this library used by the server, if known. Servers only disclose it in the well-known
+	// document, see server.ServeCapabilities.
+	Version string
+	// Transports are the ways in which the server accepts calls. Transports unknown to the client are omitted.
+	Transports []Transport
+	// WebSocketSubprotocols are the WebSocket subprotocols the server accepts, in the order of preference.
+	WebSocketSubprotocols []string
+}
+
+func newServerCapabilities(caps *capabilities.Capabilities) *ServerCapabilities {
+	c := &ServerCapabilities{
+		ProtocolVersion:       caps.ProtocolVersion,
+		Version:               caps.Version,
+		WebSocketSubprotocols: caps.WebSocketSubprotocols,
+	}
+	for _, transport := range caps.Transports {
+		if t := parseTransport(transport); t != 0 {
+			c.Transports = append(c.Transports, t)
+		}
+	}
+	return c
+}
+
+// capabilitiesFromHeader returns the capabilities announced in the given response header, or nil if there are none.
+func capabilitiesFromHeader(header http.Header) *ServerCapabilities {
+	value := header.Get(capabilities.HeaderKey)
+	if value == "" {
+		return nil
+	}
+	caps, err := capabilities.ParseHeader(value)
+	if err != nil {
+		return nil
+	}
+	return newServerCapabilities(caps)
+}
+
+// SupportsTransport checks whether the server accepts calls via the given transport.
+func (c *ServerCapabilities) SupportsTransport(transport Transport) bool {
+	return slices.Contains(c.Transports, transport)
+}
+
+// checkCompatibility returns an error wrapping ErrIncompatibleServer if the server does not accept calls made with
+// the given connect options.
+func (c *ServerCapabilities) checkCompatibility(connectOpts *connectOptions) error {
+	switch {
+	case connectOpts.useWebSocket:
+		return c.checkWebSocketCompatibility()
+	case connectOpts.forceDowngrade:
+		return c.checkTransport(TransportGRPCWeb)
+	case connectOpts.forceHTTP2:
+		return c.checkTransport(TransportGRPC)
+	}
+	if err := c.checkTransport(TransportGRPCWeb); err != nil {
+		return c.checkTransport(TransportGRPC)
+	}
+	return nil
+}
+
+func (c *ServerCapabilities) checkWebSocketCompatibility() error {
+	if err := c.checkTransport(TransportWebSocket); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(subprotocols, func(subprotocol string) bool {
+		return slices.Contains(c.WebSocketSubprotocols, subprotocol)
+	}) {
+		return errors.Wrapf(ErrIncompatibleServer, "server accepts none of the WebSocket subprotocols %v, but only %v",
+			subprotocols, c.WebSocketSubprotocols)
+	}
+	return nil
+}
+
+func (c *ServerCapabilities) checkTransport(transport Transport) error {
+	if !c.SupportsTransport(transport) {
+		return errors.Wrapf(ErrIncompatibleServer, "server does not accept calls via %s, but only via %v", transport, c.Transports)
+	}
+	return nil
+}
+
+// checkWebSocketResponse returns an error naming the reason if the response to a failed WebSocket handshake
+// announces that the server does not accept calls via WebSockets of this client.
+func checkWebSocketResponse(resp *http.Response) error {
+	if resp == nil {
+		return nil
+	}
+	caps := capabilitiesFromHeader(resp.Header)
+	if caps == nil {
+		return nil
+	}
+	if err := caps.checkWebSocketCompatibility(); err != nil {
+		return newTransportError(codes.Unimplemented, "%v", err)
+	}
+	return nil
+}
+
+// FetchServerCapabilities fetches the capabilities of the server at the given endpoint, which is specified like for
+// ConnectViaProxy, but must not be a gRPC target URI. The capabilities are taken from the well-known endpoint of the
+// server (see server.ServeCapabilities) or, if the server does not serve it, from the capabilities header of the
+// response. If the server does not announce its capabilities, the returned error wraps ErrNoCapabilities.
+func FetchServerCapabilities(ctx context.Context, endpoint string, tlsClientConf *tls.Config, opts ...ConnectOption) (*ServerCapabilities, error) {
+	var connectOpts connectOptions
+	for _, opt := range opts {
+		opt.apply(&connectOpts)
+	}
+	ep, tlsClientConf, err := connectOpts.parseEndpoint(endpoint, tlsClientConf)
+	if err != nil {
+		return nil, err
+	}
+	if ep.resolve {
+		return nil, errors.Errorf("fetching the capabilities of gRPC target URI %q is not supported; use a resolved address instead", endpoint)
+	}
+	authority, host := connectOpts.authorityAndHost(ep.authority, tlsClientConf)
+	return fetchServerCapabilities(ctx, ep.addr, host, connectOpts.withServerName(tlsClientConf, hostOf(authority)), &connectOpts)
+}
+
+func fetchServerCapabilities(ctx context.Context, addr, host string, tlsClientConf *tls.Config, connectOpts *connectOptions) (*ServerCapabilities, error) {
+	transport, err := createTransport(tlsClientConf, connectOpts.forceHTTP2, connectOpts, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating transport")
+	}
+	defer transport.CloseIdleConnections()
+
+	scheme := "https"
+	if tlsClientConf == nil {
+		scheme = "http"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+addr+connectOpts.pathPrefix+capabilities.WellKnownPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+	req.Header.Set("Accept", "application/json")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching server capabilities")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); resp.StatusCode == http.StatusOK && mediaType == "application/json" {
+		var caps capabilities.Capabilities
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxCapabilitiesSize)).Decode(&caps); err != nil {
+			return nil, errors.Wrap(err, "decoding server capabilities")
+		}
+		if caps.ProtocolVersion < 1 {
+			return nil, errors.Errorf("invalid protocol version %d in server capabilities", caps.ProtocolVersion)
+		}
+		return newServerCapabilities(&caps), nil
+	}
+	if caps := capabilitiesFromHeader(resp.Header); caps != nil {
+		return caps, nil
+	}
+	return nil, errors.Wrapf(ErrNoCapabilities, "HTTP %s response", resp.Status)
+}
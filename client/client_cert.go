@@ -0,0 +1,64 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clientCertFiles loads a client certificate from files, and reloads it whenever one of the files changes.
+type clientCertFiles struct {
+	certFile, keyFile string
+
+	mutex             sync.Mutex
+	cert              *tls.Certificate
+	certMod, keyMod   time.Time
+	certSize, keySize int64
+}
+
+// GetClientCertificate implements `tls.Config.GetClientCertificate`.
+func (f *clientCertFiles) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certStat, err := os.Stat(f.certFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading client certificate")
+	}
+	keyStat, err := os.Stat(f.keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading client key")
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.cert != nil &&
+		certStat.ModTime().Equal(f.certMod) && certStat.Size() == f.certSize &&
+		keyStat.ModTime().Equal(f.keyMod) && keyStat.Size() == f.keySize {
+		return f.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading client certificate")
+	}
+	f.cert = &cert
+	f.certMod, f.certSize = certStat.ModTime(), certStat.Size()
+	f.keyMod, f.keySize = keyStat.ModTime(), keyStat.Size()
+	return f.cert, nil
+}
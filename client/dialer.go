@@ -0,0 +1,332 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// unixSocketAuthority is the authority of requests to Unix domain sockets, like in gRPC.
+	unixSocketAuthority = "localhost"
+)
+
+// contextDialFunc establishes a connection to the given address.
+type contextDialFunc func(ctx context.Context, addr string) (net.Conn, error)
+
+// proxyFunc returns the URL of the forward proxy to use for the given request, or nil if the request should not be
+// sent via a forward proxy. It has the same semantics as `http.Transport.Proxy`.
+type proxyFunc func(*http.Request) (*url.URL, error)
+
+// dialer establishes TCP connections to servers, tunneling them through a forward proxy via CONNECT where
+// configured. It is shared by all transports, such that all of them connect to the server in the same way, regardless
+// of whether TLS is used.
+type dialer struct {
+	// scheme determines which forward proxy is used, if any.
+	scheme    string
+	proxy     proxyFunc
+	netDialer net.Dialer
+	// contextDialer, if set, is used for establishing connections instead of dialing TCP.
+	contextDialer contextDialFunc
+	// creds, if set, are used for TLS handshakes instead of the TLS config.
+	creds credentials.TransportCredentials
+}
+
+func newDialer(tlsClientConf *tls.Config, connectOpts *connectOptions) *dialer {
+	scheme := "https"
+	if tlsClientConf == nil {
+		scheme = "http"
+	}
+	return &dialer{
+		scheme:        scheme,
+		proxy:         connectOpts.forwardProxyFunc(),
+		contextDialer: connectOpts.contextDialer,
+		creds:         connectOpts.transportCreds,
+	}
+}
+
+// DialContext connects to the given address, via a forward proxy if configured. It has the signature of
+// `net.Dialer.DialContext`, but only supports TCP (or whatever the custom dialer establishes).
+func (d *dialer) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	var proxyURL *url.URL
+	if d.proxy != nil {
+		var err error
+		proxyURL, err = d.proxy(&http.Request{URL: &url.URL{Scheme: d.scheme, Host: addr}})
+		if err != nil {
+			return nil, errors.Wrap(err, "determining forward proxy")
+		}
+	}
+	if proxyURL == nil {
+		return d.dialDirect(ctx, addr)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return d.dialViaHTTPProxy(ctx, proxyURL, addr)
+	case "socks5", "socks5h":
+		return d.dialViaSOCKSProxy(ctx, proxyURL, addr)
+	}
+	return nil, errors.Errorf("unsupported forward proxy scheme %q", proxyURL.Scheme)
+}
+
+// dialDirect connects to the given address without a forward proxy.
+func (d *dialer) dialDirect(ctx context.Context, addr string) (net.Conn, error) {
+	if d.contextDialer != nil {
+		return d.contextDialer(ctx, addr)
+	}
+	return d.netDialer.DialContext(ctx, "tcp", addr)
+}
+
+// DialTLSContext connects to the given address and performs a TLS handshake with the given config, or with the
+// transport credentials of the dialer, if any. In the latter case, the config only determines the server name.
+func (d *dialer) DialTLSContext(ctx context.Context, addr string, tlsConf *tls.Config) (tlsConn, error) {
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	serverName := tlsConf.ServerName
+	if serverName == "" {
+		serverName = hostOf(addr)
+	}
+
+	if d.creds != nil {
+		return handshakeWithCreds(ctx, conn, d.creds, serverName)
+	}
+
+	if tlsConf.ServerName == "" {
+		tlsConf = tlsConf.Clone()
+		tlsConf.ServerName = serverName
+	}
+	tc := tls.Client(conn, tlsConf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tc, nil
+}
+
+// handshakeWithCreds performs the client handshake of the given transport credentials on conn.
+func handshakeWithCreds(ctx context.Context, conn net.Conn, creds credentials.TransportCredentials, serverName string) (tlsConn, error) {
+	secureConn, authInfo, err := creds.ClientHandshake(ctx, serverName, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	tlsInfo, ok := authInfo.(credentials.TLSInfo)
+	if !ok {
+		_ = secureConn.Close()
+		return nil, errors.Errorf("transport credentials of type %q reported auth info of type %T instead of TLS info",
+			creds.Info().SecurityProtocol, authInfo)
+	}
+	return &credsConn{Conn: secureConn, authInfo: tlsInfo}, nil
+}
+
+func (d *dialer) dialViaHTTPProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := canonicalProxyAddr(proxyURL)
+	conn, err := d.dialDirect(ctx, proxyAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "connecting to forward proxy %s", proxyAddr)
+	}
+	if proxyURL.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, errors.Wrapf(err, "performing TLS handshake with forward proxy %s", proxyAddr)
+		}
+		conn = tlsConn
+	}
+
+	// Abort the CONNECT exchange if the context expires.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	tunnelConn, err := establishTunnel(conn, proxyURL, addr)
+	if !stop() {
+		err = errors.Wrap(ctx.Err(), "establishing tunnel through forward proxy")
+	} else if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tunnelConn, nil
+}
+
+// establishTunnel sends a CONNECT request for the given address to the forward proxy on the other end of conn.
+func establishTunnel(conn net.Conn, proxyURL *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth := proxyAuthorization(proxyURL); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, errors.Wrap(err, "sending CONNECT request to forward proxy")
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading CONNECT response from forward proxy")
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return nil, newTransportError(codes.Unavailable,
+			"forward proxy %s requires authentication for connecting to %s; specify credentials in the proxy URL",
+			proxyURL.Redacted(), addr)
+	case resp.StatusCode != http.StatusOK:
+		return nil, newTransportError(codes.Unavailable,
+			"forward proxy %s refused to connect to %s: %s", proxyURL.Redacted(), addr, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		// The server already sent data, which is now in the buffer.
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+func (d *dialer) dialViaSOCKSProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	socksDialer, err := proxy.FromURL(proxyURL, directDialer{d: d})
+	if err != nil {
+		return nil, errors.Wrap(err, "creating SOCKS dialer")
+	}
+	if contextDialer, ok := socksDialer.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, "tcp", addr)
+	}
+	// The dial cannot be aborted without context support, so the connection is discarded if the context has expired.
+	conn, err := socksDialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// proxyAuthorization returns the value of the Proxy-Authorization header for the credentials in the given proxy
+// URL, if any.
+func proxyAuthorization(proxyURL *url.URL) string {
+	if proxyURL.User == nil {
+		return ""
+	}
+	password, _ := proxyURL.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username()+":"+password))
+}
+
+// canonicalProxyAddr returns the host:port address of the forward proxy, adding the default port if necessary.
+func canonicalProxyAddr(proxyURL *url.URL) string {
+	if proxyURL.Port() != "" {
+		return proxyURL.Host
+	}
+	port := "80"
+	if proxyURL.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
+
+// bufferedConn is a connection from which some data has already been read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(buf []byte) (int, error) {
+	return c.r.Read(buf)
+}
+
+// tlsConn is a connection secured by TLS. It is implemented by `*tls.Conn`, as well as by connections secured by
+// transport credentials.
+type tlsConn interface {
+	net.Conn
+	ConnectionState() tls.ConnectionState
+}
+
+// credsConn is a connection secured by transport credentials.
+type credsConn struct {
+	net.Conn
+	authInfo credentials.TLSInfo
+}
+
+func (c *credsConn) ConnectionState() tls.ConnectionState {
+	return c.authInfo.State
+}
+
+// authInfoOf returns the gRPC auth info for the given connection. For connections secured by transport credentials,
+// this is the auth info reported by the credentials.
+func authInfoOf(conn tlsConn) credentials.AuthInfo {
+	if cc, ok := conn.(*credsConn); ok {
+		return cc.authInfo
+	}
+	return credentials.TLSInfo{
+		State: conn.ConnectionState(),
+		CommonAuthInfo: credentials.CommonAuthInfo{
+			SecurityLevel: credentials.PrivacyAndIntegrity,
+		},
+	}
+}
+
+// directDialer adapts the direct connections of a dialer to `proxy.ContextDialer`.
+type directDialer struct {
+	d *dialer
+}
+
+func (dd directDialer) Dial(network, addr string) (net.Conn, error) {
+	return dd.DialContext(context.Background(), network, addr)
+}
+
+func (dd directDialer) DialContext(ctx context.Context, _, addr string) (net.Conn, error) {
+	return dd.d.dialDirect(ctx, addr)
+}
+
+// unixSocketAddr checks whether the endpoint refers to a Unix domain socket using the gRPC naming syntax, i.e.,
+// `unix:path`, `unix:///absolute_path` or `unix-abstract:name`, and returns the address of the socket.
+func unixSocketAddr(endpoint string) (string, bool) {
+	if name, ok := strings.CutPrefix(endpoint, "unix-abstract:"); ok {
+		// Go denotes abstract sockets by a leading "@".
+		return "@" + name, true
+	}
+	path, ok := strings.CutPrefix(endpoint, "unix:")
+	if !ok {
+		return "", false
+	}
+	if rest, ok := strings.CutPrefix(path, "//"); ok {
+		// gRPC only allows an empty authority, so the remainder is an absolute path.
+		path = rest
+	}
+	return path, path != ""
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveSOCKS5 serves a minimal SOCKS5 proxy without authentication on lis, which connects all CONNECT requests to
+// target and records the requested addresses in requested.
+func serveSOCKS5(lis net.Listener, target string, requested chan<- string) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer func() { _ = conn.Close() }()
+
+			// Greeting: version, number of methods, methods. Only "no authentication" is accepted.
+			greeting := make([]byte, 2)
+			if _, err := io.ReadFull(conn, greeting); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+				return
+			}
+			if _, err := conn.Write([]byte{5, 0}); err != nil {
+				return
+			}
+
+			// Request: version, command, reserved, address type, address, port. Only domain names are expected.
+			req := make([]byte, 5)
+			if _, err := io.ReadFull(conn, req); err != nil || req[3] != 3 {
+				return
+			}
+			hostPort := make([]byte, int(req[4])+2)
+			if _, err := io.ReadFull(conn, hostPort); err != nil {
+				return
+			}
+			port := int(hostPort[len(hostPort)-2])<<8 | int(hostPort[len(hostPort)-1])
+			requested <- net.JoinHostPort(string(hostPort[:len(hostPort)-2]), strconv.Itoa(port))
+
+			targetConn, err := net.Dial("tcp", target)
+			if err != nil {
+				_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+				return
+			}
+			defer func() { _ = targetConn.Close() }()
+			if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(targetConn, conn) }()
+			_, _ = io.Copy(conn, targetConn)
+		}()
+	}
+}
+
+func TestDialViaSOCKSProxy(t *testing.T) {
+	targetLis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = targetLis.Close() }()
+	go func() {
+		conn, err := targetLis.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = conn.Write([]byte("hello"))
+	}()
+
+	proxyLis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = proxyLis.Close() }()
+	requested := make(chan string, 1)
+	go serveSOCKS5(proxyLis, targetLis.Addr().String(), requested)
+
+	proxyURL := &url.URL{Scheme: "socks5h", Host: proxyLis.Addr().String()}
+	d := &dialer{
+		scheme: "http",
+		proxy: func(*http.Request) (*url.URL, error) {
+			return proxyURL, nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", "backend.invalid:443")
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	assert.Equal(t, "backend.invalid:443", <-requested)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
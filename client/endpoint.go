@@ -0,0 +1,92 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// endpoint is the parsed form of an endpoint passed to ConnectViaProxy or Probe.
+type endpoint struct {
+	// addr is the address to connect to or, if resolve is set, the gRPC target URI to resolve.
+	addr string
+	// authority is the authority derived from the endpoint.
+	authority string
+	// resolve indicates that the endpoint is a gRPC target URI, which is resolved via gRPC name resolution.
+	resolve bool
+}
+
+// parseEndpoint parses the given endpoint, which is a `host:port` address, a Unix domain socket, an HTTP(S) base URL,
+// or a gRPC target URI, and configures the options accordingly. It returns the parsed endpoint and the TLS config to
+// use.
+func (o *connectOptions) parseEndpoint(rawEndpoint string, tlsClientConf *tls.Config) (endpoint, *tls.Config, error) {
+	if sockAddr, ok := unixSocketAddr(rawEndpoint); ok {
+		addr := o.useUnixSocket(sockAddr)
+		return endpoint{addr: addr, authority: addr}, o.tlsConfig(tlsClientConf), nil
+	}
+
+	if baseURL, ok := parseBaseURL(rawEndpoint); ok {
+		return o.useBaseURL(baseURL, tlsClientConf)
+	}
+
+	if authority, ok := resolverTargetAuthority(rawEndpoint); ok {
+		return endpoint{addr: rawEndpoint, authority: authority, resolve: true}, o.tlsConfig(tlsClientConf), nil
+	}
+
+	return endpoint{addr: rawEndpoint, authority: rawEndpoint}, o.tlsConfig(tlsClientConf), nil
+}
+
+// parseBaseURL checks whether the endpoint is an HTTP(S) base URL, such as `https://example.com/api/grpc`.
+func parseBaseURL(rawEndpoint string) (*url.URL, bool) {
+	if !strings.HasPrefix(rawEndpoint, "http://") && !strings.HasPrefix(rawEndpoint, "https://") {
+		return nil, false
+	}
+	u, err := url.Parse(rawEndpoint)
+	if err != nil {
+		return nil, false
+	}
+	return u, true
+}
+
+// useBaseURL configures the options for connecting to the given base URL. The scheme determines whether TLS is used,
+// and the path is prepended to the paths of all requests.
+func (o *connectOptions) useBaseURL(baseURL *url.URL, tlsClientConf *tls.Config) (endpoint, *tls.Config, error) {
+	if baseURL.Host == "" || baseURL.User != nil || baseURL.RawQuery != "" || baseURL.Fragment != "" {
+		return endpoint{}, nil, errors.Errorf("invalid endpoint URL %q: only scheme, host and path may be given", baseURL.Redacted())
+	}
+
+	tlsClientConf = o.tlsConfig(tlsClientConf)
+	port := "443"
+	if baseURL.Scheme == "http" {
+		if tlsClientConf != nil {
+			return endpoint{}, nil, errors.Errorf("endpoint URL %q requires a plaintext connection, but TLS is configured", baseURL.Redacted())
+		}
+		port = "80"
+	} else if tlsClientConf == nil {
+		tlsClientConf = &tls.Config{}
+	}
+
+	addr := baseURL.Host
+	if baseURL.Port() == "" {
+		addr = net.JoinHostPort(baseURL.Hostname(), port)
+	}
+	o.pathPrefix = strings.TrimSuffix(baseURL.Path, "/")
+	return endpoint{addr: addr, authority: baseURL.Host}, tlsClientConf, nil
+}
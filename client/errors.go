@@ -0,0 +1,195 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"golang.stackrox.io/grpc-http1/internal/httputils"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// ErrorDomain is the domain of the ErrorInfo details attached to the statuses of failed calls by the client proxy.
+	ErrorDomain = "grpc-http1.stackrox.io"
+
+	// HTTPErrorReason is the reason of the ErrorInfo detail attached to the status of a call that failed because of an
+	// HTTP error response, e.g., from a load balancer. The metadata of the ErrorInfo contains the HTTP status code under
+	// the HTTPStatusMetadataKey, and the response headers of interest (such as `retry-after`, `server` or `via`) under
+	// their lower-case names. If the response had a body, its beginning is attached as a DebugInfo detail, and if it
+	// had a Retry-After header, the delay is also attached as a RetryInfo detail.
+	HTTPErrorReason = "HTTP_ERROR_RESPONSE"
+
+	// HTTPStatusMetadataKey is the key of the HTTP status code in the metadata of an ErrorInfo detail with the
+	// HTTPErrorReason.
+	HTTPStatusMetadataKey = "httpStatus"
+)
+
+// transportError is an error in the transport between the client proxy and the server that should be reported to
+// the gRPC client with a specific status code. Transport errors that are not of this type are reported as
+// `Unavailable`.
+type transportError struct {
+	code    codes.Code
+	msg     string
+	details []protoadapt.MessageV1
+}
+
+func newTransportError(code codes.Code, format string, args ...interface{}) error {
+	return &transportError{
+		code: code,
+		msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *transportError) Error() string {
+	return e.msg
+}
+
+// GRPCStatus returns the gRPC status for this error.
+func (e *transportError) GRPCStatus() *status.Status {
+	st := status.New(e.code, e.msg)
+	if len(e.details) == 0 {
+		return st
+	}
+	stWithDetails, err := st.WithDetails(e.details...)
+	if err != nil {
+		glog.Warningf("Failed to attach details to status of transport error: %v", err)
+		return st
+	}
+	return stWithDetails
+}
+
+// transportErrorStatus returns the gRPC status to report for the given transport error.
+func transportErrorStatus(err error) *status.Status {
+	st, ok := status.FromError(err)
+	if !ok {
+		st = status.New(codes.Unavailable, "")
+	}
+	p := st.Proto()
+	p.Message = errors.Wrap(err, "transport").Error()
+	return status.FromProto(p)
+}
+
+// setStatusHeaders sets the headers conveying the gRPC status for the given transport error, prefixing their keys
+// with the given prefix.
+func setStatusHeaders(header http.Header, keyPrefix string, err error) {
+	st := transportErrorStatus(err)
+	header.Set(keyPrefix+"Grpc-Status", fmt.Sprintf("%d", st.Code()))
+	header.Set(keyPrefix+"Grpc-Message", grpcproto.EncodeGrpcMessage(st.Message()))
+	if len(st.Proto().GetDetails()) == 0 {
+		return
+	}
+	details, err := proto.Marshal(st.Proto())
+	if err != nil {
+		glog.Warningf("Failed to marshal status details of transport error: %v", err)
+		return
+	}
+	header.Set(keyPrefix+"Grpc-Status-Details-Bin", base64.RawStdEncoding.EncodeToString(details))
+}
+
+// codeForHTTPStatus returns the gRPC status code for an HTTP error status, as specified in
+// https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md.
+func codeForHTTPStatus(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest:
+		return codes.Internal
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.Unimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return codes.Unavailable
+	}
+	return codes.Unknown
+}
+
+// extractResponseError returns a transport error for the given response if it is an HTTP error response. The status
+// code of the error is taken from the Grpc-Status header, if any, and is derived from the HTTP status otherwise. The
+// details of the response are attached to the status as described for HTTPErrorReason.
+func extractResponseError(resp *http.Response) error {
+	var respErr *httputils.ResponseError
+	if err := httputils.ExtractResponseError(resp); !errors.As(err, &respErr) {
+		return err
+	}
+
+	errInfo := &errdetails.ErrorInfo{
+		Reason: HTTPErrorReason,
+		Domain: ErrorDomain,
+		Metadata: map[string]string{
+			HTTPStatusMetadataKey: strconv.Itoa(respErr.StatusCode),
+		},
+	}
+	for key, values := range respErr.Header {
+		errInfo.Metadata[strings.ToLower(key)] = strings.ToValidUTF8(strings.Join(values, ", "), "\uFFFD")
+	}
+	details := []protoadapt.MessageV1{errInfo}
+	if len(respErr.Body) > 0 {
+		details = append(details, &errdetails.DebugInfo{
+			Detail: strings.ToValidUTF8(string(respErr.Body), "\uFFFD"),
+		})
+	}
+	if delay, ok := retryAfter(respErr.Header.Get("Retry-After")); ok {
+		details = append(details, &errdetails.RetryInfo{
+			RetryDelay: durationpb.New(delay),
+		})
+	}
+
+	code := codeForHTTPStatus(respErr.StatusCode)
+	if st, err := grpcStatusFromHeaders(respErr.Header, nil); err == nil {
+		// The server conveyed why it rejected the request, e.g., because of too many concurrent calls.
+		code = st.Code()
+	}
+	return &transportError{
+		code:    code,
+		msg:     respErr.Error(),
+		details: details,
+	}
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a number of seconds or an HTTP date.
+func retryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := time.Until(date); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"io"
+	"net/http"
+
+	"golang.stackrox.io/grpc-http1/internal/headerpolicy"
+)
+
+// HeaderPolicy controls which HTTP response headers and trailers are passed on to the gRPC client as metadata, and
+// under which names. See WithResponseHeaderPolicy for where it applies. The fields are documented on
+// headerpolicy.Config, which is also exported as server.HeaderPolicy.
+type HeaderPolicy = headerpolicy.Config
+
+// trailerPolicyBody is a response body that applies a header policy to the trailers of the response once the body has
+// been read completely, which is when trailers become available.
+type trailerPolicyBody struct {
+	io.ReadCloser
+	resp   *http.Response
+	policy *headerpolicy.Policy
+	// announced are the trailers announced before the body was read.
+	announced []string
+	applied   bool
+}
+
+func newTrailerPolicyBody(resp *http.Response, policy *headerpolicy.Policy) *trailerPolicyBody {
+	b := &trailerPolicyBody{ReadCloser: resp.Body, resp: resp, policy: policy}
+	for key := range resp.Trailer {
+		b.announced = append(b.announced, key)
+	}
+	return b
+}
+
+func (b *trailerPolicyBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if err == io.EOF && !b.applied {
+		b.applied = true
+		b.policy.Apply(b.resp.Trailer, "")
+		// The reverse proxy passes on announced trailers as-is only if their number is unchanged, and otherwise sends
+		// all trailers as unannounced ones. Keep the keys of dropped announced trailers, such that renamed trailers
+		// are never mistaken for announced ones.
+		for _, key := range b.announced {
+			if _, ok := b.resp.Trailer[key]; !ok {
+				b.resp.Trailer[key] = nil
+			}
+		}
+	}
+	return n, err
+}
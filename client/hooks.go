@@ -0,0 +1,112 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/pkg/errors"
+)
+
+// requestHook is called for every outgoing HTTP request, and may modify it.
+type requestHook func(*http.Request) error
+
+// responseHook is called for every HTTP response, before it is processed by the client proxy.
+type responseHook func(*http.Response) error
+
+// hookingTransport is a transport that adds static headers and cookies to, and calls hooks for, every request it
+// sends.
+type hookingTransport struct {
+	closeableTransport
+
+	headers       http.Header
+	jar           http.CookieJar
+	requestHooks  []requestHook
+	responseHooks []responseHook
+}
+
+// withHooks wraps the given transport such that the configured headers, cookie jar and hooks are applied to all
+// requests it sends. If there is nothing to apply, the transport is returned as-is.
+func withHooks(transport closeableTransport, connectOpts *connectOptions) closeableTransport {
+	if len(connectOpts.headers) == 0 && connectOpts.cookieJar == nil &&
+		len(connectOpts.requestHooks) == 0 && len(connectOpts.responseHooks) == 0 {
+		return transport
+	}
+	return &hookingTransport{
+		closeableTransport: transport,
+		headers:            connectOpts.headers,
+		jar:                connectOpts.cookieJar,
+		requestHooks:       connectOpts.requestHooks,
+		responseHooks:      connectOpts.responseHooks,
+	}
+}
+
+func (t *hookingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request.
+	req = req.Clone(req.Context())
+	for key, values := range t.headers {
+		req.Header[key] = slices.Clone(values)
+	}
+	var cookieURL *url.URL
+	if t.jar != nil {
+		cookieURL = cookieURLOf(req)
+		for _, cookie := range t.jar.Cookies(cookieURL) {
+			req.AddCookie(cookie)
+		}
+	}
+	for _, hook := range t.requestHooks {
+		if err := hook(req); err != nil {
+			closeRequestBody(req)
+			return nil, errors.Wrap(err, "request hook")
+		}
+	}
+
+	resp, err := t.closeableTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if t.jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			t.jar.SetCookies(cookieURL, cookies)
+		}
+	}
+	for _, hook := range t.responseHooks {
+		if err := hook(resp); err != nil {
+			if resp.Body != nil {
+				_ = resp.Body.Close()
+			}
+			return nil, errors.Wrap(err, "response hook")
+		}
+	}
+	return resp, nil
+}
+
+// cookieURLOf returns the URL that determines the cookies for the given request. Cookies are scoped to the Host
+// header, which may differ from the address that is dialed.
+func cookieURLOf(req *http.Request) *url.URL {
+	u := *req.URL
+	if req.Host != "" {
+		u.Host = req.Host
+	}
+	return &u
+}
+
+func closeRequestBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
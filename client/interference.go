@@ -0,0 +1,222 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/coder/websocket"
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"golang.stackrox.io/grpc-http1/internal/grpcweb"
+	"golang.stackrox.io/grpc-http1/internal/grpcwebsocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// This file contains the logic for detecting failures that are most likely caused by a middlebox (proxy, load
+// balancer, firewall, ...) between the client and the server, and for turning them into gRPC statuses that name the
+// likely problem.
+
+const (
+	suggestWebSocket = "consider connecting with UseWebSocket(true)"
+	suggestDowngrade = "consider connecting with UseWebSocket(false) to use gRPC-Web downgrades instead"
+
+	// serverStreamingHeaderKey is the request header in which the gRPC client tells the client proxy that a call is
+	// server-streaming. The client proxy removes it before forwarding the call.
+	serverStreamingHeaderKey = "Grpchttp1-Server-Streaming"
+)
+
+type serverStreamingKey struct{}
+
+// serverStreamingInterceptor marks server-streaming calls, such that the client proxy can tell whether their responses
+// have been buffered.
+func serverStreamingInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if desc.ServerStreams {
+		ctx = metadata.AppendToOutgoingContext(ctx, serverStreamingHeaderKey, "true")
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
+
+// withServerStreamingMark returns a handler that removes the mark of server-streaming calls from requests and records
+// it in their context instead, before passing them on to the given handler.
+func withServerStreamingMark(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(serverStreamingHeaderKey) != "" {
+			req.Header.Del(serverStreamingHeaderKey)
+			req = req.WithContext(context.WithValue(req.Context(), serverStreamingKey{}, true))
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func isServerStreaming(req *http.Request) bool {
+	serverStreaming, _ := req.Context().Value(serverStreamingKey{}).(bool)
+	return serverStreaming
+}
+
+// mediaType returns the media type of the given content type, without any parameters or "+" suffix.
+func mediaType(contentType string) string {
+	mt, _, _ := strings.Cut(contentType, ";")
+	mt, _, _ = strings.Cut(strings.TrimSpace(mt), "+")
+	return strings.ToLower(mt)
+}
+
+// checkGRPCResponse returns an error if a non-error HTTP response is not a gRPC response at all.
+func checkGRPCResponse(resp *http.Response) error {
+	contentType := resp.Header.Get("Content-Type")
+	switch mt := mediaType(contentType); mt {
+	case "application/grpc", "application/grpc-web":
+		return nil
+	case "text/html":
+		return newTransportError(codes.Unknown,
+			"received an HTML page (HTTP %s) instead of a gRPC response; a proxy, firewall or captive portal between client and server is likely intercepting the request",
+			resp.Status)
+	default:
+		msg := fmt.Sprintf("received an HTTP %s response with content-type %q instead of a gRPC response; an intermediary is likely answering in place of the gRPC server", resp.Status, contentType)
+		if location := resp.Header.Get("Location"); location != "" {
+			msg += fmt.Sprintf(" (redirecting to %s)", location)
+		}
+		return newTransportError(codes.Unknown, "%s", msg)
+	}
+}
+
+// isBufferedServerStream checks whether the response to a server-streaming call looks like it was buffered by an
+// intermediary until the call completed. gRPC servers never set a content length, as they stream the response.
+func isBufferedServerStream(resp *http.Response) bool {
+	return resp.ContentLength > 0 && resp.Request != nil && isServerStreaming(resp.Request)
+}
+
+// statusCheckingBody is a response body that makes sure the gRPC client always receives a status. Errors reading
+// the body, as well as responses ending without a status, are turned into a status sent in the trailers. If the
+// response of a server-streaming call has been buffered, a successful status is replaced by one naming the problem.
+type statusCheckingBody struct {
+	io.ReadCloser
+	resp     *http.Response
+	buffered bool
+}
+
+func (b *statusCheckingBody) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	if err == nil {
+		return n, nil
+	}
+	switch {
+	case err != io.EOF:
+		err = classifyResponseReadError(err)
+	case b.buffered && (!hasGRPCStatus(b.resp) || grpcStatusOK(b.resp)):
+		err = newTransportError(codes.Unavailable,
+			"an intermediary buffered the server stream until it completed (content length of %d bytes), which delays all messages; %s",
+			b.resp.ContentLength, suggestWebSocket)
+	case hasGRPCStatus(b.resp):
+		return n, err
+	default:
+		err = newTransportError(codes.Unavailable,
+			"response ended without a gRPC status; an intermediary likely stripped the HTTP trailers, %s", suggestWebSocket)
+	}
+
+	setStatusTrailers(b.resp, err)
+	return n, io.EOF
+}
+
+func hasGRPCStatus(resp *http.Response) bool {
+	return len(resp.Header["Grpc-Status"]) > 0 || len(resp.Trailer["Grpc-Status"]) > 0
+}
+
+func grpcStatusOK(resp *http.Response) bool {
+	if st := resp.Trailer.Get("Grpc-Status"); st != "" {
+		return st == "0"
+	}
+	return resp.Header.Get("Grpc-Status") == "0"
+}
+
+func setStatusTrailers(resp *http.Response, err error) {
+	if resp.Trailer == nil {
+		resp.Trailer = make(http.Header)
+	}
+	setStatusHeaders(resp.Trailer, "", err)
+}
+
+func classifyResponseReadError(err error) error {
+	var extraDataErr grpcweb.ExtraDataError
+	switch {
+	case errors.As(err, &extraDataErr):
+		return newTransportError(codes.Internal,
+			"an intermediary appended at least %d bytes after the end of the gRPC-Web response", int64(extraDataErr))
+	case errors.Is(err, grpcproto.ErrMetadataLimitExceeded):
+		return newTransportError(codes.ResourceExhausted, "receiving gRPC-Web trailers: %v", err)
+	case errors.Is(err, grpcweb.ErrMissingTrailers):
+		return newTransportError(codes.Unavailable,
+			"gRPC-Web response ended without trailers; an intermediary may have truncated the response, e.g., because of a timeout or size limit")
+	}
+	return errors.Wrap(err, "reading response body")
+}
+
+// classifyWebSocketDialError turns a failed WebSocket handshake into an error naming the likely problem.
+func classifyWebSocketDialError(err error, resp *http.Response) error {
+	if resp == nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusSwitchingProtocols:
+		return newTransportError(codes.Unimplemented,
+			"server accepted the WebSocket upgrade, but not the %s subprotocol; the server is likely not using a gRPC-WebSocket capable handler, %s (%v)",
+			grpcwebsocket.SubprotocolName, suggestDowngrade, err)
+	case resp.StatusCode == http.StatusBadRequest && announcesWebSocketSupport(resp):
+		// The server accepts our WebSockets, but rejected the handshake as a bad request, which it only does if the
+		// upgrade headers are missing.
+		return newTransportError(codes.Unavailable,
+			"the WebSocket upgrade headers were dropped on the way to the server, so a proxy or load balancer does not support WebSockets; %s (%v)",
+			suggestDowngrade, err)
+	case resp.StatusCode < 300:
+		return newTransportError(codes.Unavailable,
+			"received an HTTP %s response instead of a WebSocket upgrade; an intermediary does not support WebSockets, %s (%v)",
+			resp.Status, suggestDowngrade, err)
+	}
+	return err
+}
+
+// announcesWebSocketSupport checks whether the capabilities header of the given response announces that the server
+// accepts calls via WebSockets of this client.
+func announcesWebSocketSupport(resp *http.Response) bool {
+	caps := capabilitiesFromHeader(resp.Header)
+	return caps != nil && caps.checkWebSocketCompatibility() == nil
+}
+
+// classifyWebSocketReadError turns an error reading from the WebSocket connection into an error naming the likely
+// problem.
+func classifyWebSocketReadError(err error) error {
+	if websocket.CloseStatus(err) == websocket.StatusAbnormalClosure || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return newTransportError(codes.Unavailable,
+			"WebSocket connection was closed without a closing handshake; an intermediary may have terminated it, e.g., because of an idle or connection timeout (%v)",
+			err)
+	}
+	return err
+}
+
+func errWebSocketMessageType(mt websocket.MessageType) error {
+	return newTransportError(codes.Internal,
+		"incorrect message type; expected MessageBinary but got %v, an intermediary may be modifying WebSocket traffic", mt)
+}
+
+func errMalformedWebSocketFrame(err error) error {
+	return newTransportError(codes.Internal,
+		"malformed gRPC frame received via WebSocket, an intermediary may be modifying WebSocket traffic: %v", err)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.stackrox.io/grpc-http1/internal/capabilities"
+	"golang.stackrox.io/grpc-http1/internal/grpcwebsocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyWebSocketDialError(t *testing.T) {
+	capsHeader := (&capabilities.Capabilities{
+		ProtocolVersion:       capabilities.ProtocolVersion,
+		Transports:            []string{TransportGRPC.String(), TransportGRPCWeb.String(), TransportWebSocket.String()},
+		WebSocketSubprotocols: []string{grpcwebsocket.SubprotocolNameV2},
+	}).Header()
+	dialErr := errors.New("failed to WebSocket dial")
+
+	cases := []struct {
+		name            string
+		resp            *http.Response
+		expectedCode    codes.Code
+		expectedMessage string
+	}{
+		{
+			// The classification must not depend on the wording of the server's error message.
+			name: "bad-request-from-websocket-server",
+			resp: &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Status:     "400 Bad Request",
+				Header:     http.Header{capabilities.HeaderKey: {capsHeader}},
+			},
+			expectedCode:    codes.Unavailable,
+			expectedMessage: "upgrade headers were dropped",
+		},
+		{
+			name: "bad-request-without-capabilities",
+			resp: &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Status:     "400 Bad Request",
+				Header:     http.Header{},
+			},
+			expectedCode: codes.Unknown,
+		},
+		{
+			name: "ok-instead-of-upgrade",
+			resp: &http.Response{
+				StatusCode: http.StatusOK,
+				Status:     "200 OK",
+				Header:     http.Header{capabilities.HeaderKey: {capsHeader}},
+			},
+			expectedCode:    codes.Unavailable,
+			expectedMessage: "instead of a WebSocket upgrade",
+		},
+		{
+			name: "upgrade-without-subprotocol",
+			resp: &http.Response{
+				StatusCode: http.StatusSwitchingProtocols,
+				Status:     "101 Switching Protocols",
+				Header:     http.Header{},
+			},
+			expectedCode:    codes.Unimplemented,
+			expectedMessage: "not the " + grpcwebsocket.SubprotocolName + " subprotocol",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			st := status.Convert(classifyWebSocketDialError(dialErr, c.resp))
+			assert.Equal(t, c.expectedCode, st.Code(), st.Message())
+			assert.Contains(t, st.Message(), c.expectedMessage)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	defaultKeepaliveTimeout = 20 * time.Second
+)
+
+// keepaliveParams configures liveness checks of the network path between the client proxy and the server.
+// The zero value disables liveness checks.
+type keepaliveParams struct {
+	// time is the duration without any activity after which the connection is checked.
+	time time.Duration
+	// timeout is the duration after which a check is considered failed.
+	timeout time.Duration
+}
+
+func (p keepaliveParams) enabled() bool {
+	return p.time > 0
+}
+
+// configureHTTP2Transport makes the transport send HTTP/2 PINGs on idle connections.
+func (p keepaliveParams) configureHTTP2Transport(transport *http2.Transport) {
+	if !p.enabled() {
+		return
+	}
+	transport.ReadIdleTimeout = p.time
+	transport.PingTimeout = p.timeout
+}
+
+// wrapHTTP1Body wraps the response body such that a read fails if no data is received for a period of time.
+func (p keepaliveParams) wrapHTTP1Body(body io.ReadCloser) io.ReadCloser {
+	if !p.enabled() {
+		return body
+	}
+	return &idleTimeoutBody{
+		ReadCloser: body,
+		timeout:    p.time + p.timeout,
+	}
+}
+
+// keepWebSocketAlive periodically pings the server until the context is done. If a ping is not answered in time,
+// the given failure function is called and the function returns.
+func (p keepaliveParams) keepWebSocketAlive(ctx context.Context, conn *websocket.Conn, onFailure func(error)) {
+	if !p.enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(p.time)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, p.timeout)
+		err := conn.Ping(pingCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			onFailure(newTransportError(codes.Unavailable, "WebSocket keepalive ping was not answered within %v: %v", p.timeout, err))
+			return
+		}
+	}
+}
+
+// idleTimeoutBody is a response body for which reads fail if no data is received within the timeout.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+
+	timedOut atomic.Bool
+}
+
+func (b *idleTimeoutBody) Read(buf []byte) (int, error) {
+	// Only measure the time spent waiting for data, not the time the consumer takes to process it.
+	timer := time.AfterFunc(b.timeout, func() {
+		b.timedOut.Store(true)
+		_ = b.ReadCloser.Close()
+	})
+	n, err := b.ReadCloser.Read(buf)
+	if !timer.Stop() && b.timedOut.Load() {
+		return n, newTransportError(codes.Unavailable, "no data received from the server for %v, the connection is presumed broken", b.timeout)
+	}
+	return n, err
+}
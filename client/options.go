@@ -14,7 +14,21 @@
 
 package client
 
-import "google.golang.org/grpc"
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"golang.stackrox.io/grpc-http1/internal/headerpolicy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
 
 type connectOptions struct {
 	dialOpts       []grpc.DialOption
@@ -23,6 +37,112 @@ type connectOptions struct {
 	forceDowngrade bool
 	useWebSocket   bool
 	contentType    string
+	grpcWebHeaders *grpcWebHeadersOption
+	keepalive      keepaliveParams
+	webSocketRetry webSocketRetryParams
+
+	webSocketOverHTTP2 bool
+
+	forwardProxy    proxyFunc
+	forwardProxySet bool
+
+	clientCertFiles *clientCertFiles
+
+	transportCreds credentials.TransportCredentials
+
+	contextDialer contextDialFunc
+
+	authority  string
+	host       string
+	serverName string
+	pathPrefix string
+
+	headers       http.Header
+	cookieJar     http.CookieJar
+	requestHooks  []requestHook
+	responseHooks []responseHook
+
+	verifyCapabilities bool
+
+	responseHeaderPolicy *headerpolicy.Policy
+
+	metadataLimits grpcproto.MetadataLimits
+}
+
+// forwardProxyFunc returns the function selecting the forward proxy for a request. Unless configured otherwise, the
+// forward proxy is taken from the environment, unless a custom dialer is used.
+func (o *connectOptions) forwardProxyFunc() proxyFunc {
+	if !o.forwardProxySet {
+		if o.contextDialer != nil {
+			return nil
+		}
+		return http.ProxyFromEnvironment
+	}
+	return o.forwardProxy
+}
+
+// authorityAndHost returns the gRPC authority and the Host header to use, given the authority derived from the
+// endpoint. Like in gRPC, the authority defaults to the configured TLS server name, if any.
+func (o *connectOptions) authorityAndHost(endpointAuthority string, tlsClientConf *tls.Config) (authority, host string) {
+	authority = o.authority
+	if authority == "" && tlsClientConf != nil {
+		authority = o.serverName
+		if authority == "" {
+			authority = tlsClientConf.ServerName
+		}
+		if authority == "" && o.transportCreds != nil {
+			authority = o.transportCreds.Info().ServerName
+		}
+	}
+	if authority == "" {
+		authority = endpointAuthority
+	}
+	host = authority
+	if o.host != "" {
+		host = o.host
+	}
+	return authority, host
+}
+
+// withServerName returns the TLS config with the server name to use, which is the configured one or, if there is
+// none, the given default.
+func (o *connectOptions) withServerName(tlsClientConf *tls.Config, defaultServerName string) *tls.Config {
+	if tlsClientConf == nil {
+		return nil
+	}
+	serverName := o.serverName
+	if serverName == "" {
+		serverName = tlsClientConf.ServerName
+	}
+	if serverName == "" {
+		serverName = defaultServerName
+	}
+	if serverName == tlsClientConf.ServerName {
+		return tlsClientConf
+	}
+	tlsClientConf = tlsClientConf.Clone()
+	tlsClientConf.ServerName = serverName
+	return tlsClientConf
+}
+
+// useUnixSocket configures the options for connecting to the Unix domain socket with the given address, and returns
+// the endpoint to use for requests. Forward proxies are never used for Unix domain sockets.
+func (o *connectOptions) useUnixSocket(sockAddr string) string {
+	var netDialer net.Dialer
+	o.contextDialer = func(ctx context.Context, _ string) (net.Conn, error) {
+		return netDialer.DialContext(ctx, "unix", sockAddr)
+	}
+	o.forwardProxy, o.forwardProxySet = nil, true
+	return unixSocketAuthority
+}
+
+// tlsConfig returns the TLS config to use for connecting to the server, given the one passed by the user. If transport
+// credentials are configured, TLS is always used, and the config only determines the server name.
+func (o *connectOptions) tlsConfig(tlsClientConf *tls.Config) *tls.Config {
+	if o.transportCreds != nil && tlsClientConf == nil {
+		return &tls.Config{}
+	}
+	return tlsClientConf
 }
 
 // ConnectOption is an option that can be passed to the `ConnectViaProxy` method.
@@ -59,6 +179,18 @@ func UseWebSocket(use bool) ConnectOption {
 	return useWebSocketOption(use)
 }
 
+// UseWebSocketOverHTTP2 returns a connection option that instructs the client to bootstrap WebSockets via HTTP/2
+// extended CONNECT requests (RFC 8441) instead of HTTP/1.1 upgrades, such that the WebSockets of all calls are streams
+// of a single HTTP/2 connection rather than connections of their own. If TLS is used, HTTP/2 is negotiated via ALPN;
+// otherwise, HTTP/2 is spoken with prior knowledge. Whether the server supports extended CONNECT is determined from
+// the SETTINGS_ENABLE_CONNECT_PROTOCOL setting it sends. If it does not, or if it does not negotiate HTTP/2, the
+// client falls back to HTTP/1.1 upgrades.
+//
+// This option has no effect unless `UseWebSocket(true)` is set.
+func UseWebSocketOverHTTP2(use bool) ConnectOption {
+	return useWebSocketOverHTTP2Option(use)
+}
+
 // ForceDowngrade returns a connection option that instructs the
 // client to always force gRPC-Web downgrade for gRPC requests.
 // Client- or Bidi-streaming requests will not work.
@@ -73,6 +205,190 @@ func WithContentType(contentType string) ConnectOption {
 	return contentTypeOption(contentType)
 }
 
+// WithGRPCWebHeaders returns a connection option that instructs the client to mark gRPC-Web requests the way browser
+// clients do, by sending the `X-Grpc-Web: 1` header, and the given user agent in the `X-User-Agent` header. If the
+// user agent is empty, the user agent of the gRPC client is used. Some third-party gRPC-Web servers and proxies rely on
+// these headers, e.g., for CORS handling or for gathering statistics.
+//
+// This option has no effect if websockets are being used.
+func WithGRPCWebHeaders(userAgent string) ConnectOption {
+	return &grpcWebHeadersOption{userAgent: userAgent}
+}
+
+// WithKeepalive returns a connection option that instructs the client to check the liveness of the network path to
+// the server whenever a connection has been idle for the given idle time, and to consider the connection broken if
+// the check does not succeed within the given timeout (20 seconds if zero). Calls on a broken connection fail with
+// status `Unavailable`.
+//
+// Note that gRPC's own keepalive (`grpc.WithKeepaliveParams`) only checks the in-memory connection to the local
+// proxy. This option instead sends HTTP/2 PINGs on HTTP/2 connections, and WebSocket pings on WebSocket connections.
+// HTTP/1 connections (e.g., for gRPC-Web downgrades) have no way of checking liveness; for these, reading a response
+// fails if no data is received for the sum of idle time and timeout. Hence, this option should not be used with
+// server-streaming calls that are legitimately silent for longer than that via gRPC-Web over HTTP/1.
+func WithKeepalive(idleTime, timeout time.Duration) ConnectOption {
+	if timeout <= 0 {
+		timeout = defaultKeepaliveTimeout
+	}
+	return keepaliveOption{time: idleTime, timeout: timeout}
+}
+
+// WithWebSocketRetry returns a connection option that instructs the client to retry failed WebSocket handshakes up to
+// the given number of attempts in total, if the failure is likely transient, e.g., because the connection was reset or
+// a load balancer responded with status 502, 503 or 504 during a deployment. Retries only happen before any data of the
+// call is sent. Between attempts, the client waits for an exponentially increasing, jittered backoff, starting at the
+// given initial backoff (100 milliseconds if zero) and capped by the given maximum backoff (5 seconds if zero). The
+// client does not retry if waiting for the next attempt would exceed the deadline of the call.
+//
+// This option only has an effect if WebSockets are used.
+func WithWebSocketRetry(maxAttempts int, initialBackoff, maxBackoff time.Duration) ConnectOption {
+	if initialBackoff <= 0 {
+		initialBackoff = defaultWebSocketRetryInitialBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = defaultWebSocketRetryMaxBackoff
+	}
+	return webSocketRetryOption{
+		maxAttempts:    maxAttempts,
+		initialBackoff: initialBackoff,
+		maxBackoff:     max(initialBackoff, maxBackoff),
+	}
+}
+
+// WithForwardProxy returns a connection option that instructs the client to connect to the server via the forward
+// proxy returned by the given function, which has the same semantics as `http.Transport.Proxy`. Use `http.ProxyURL`
+// for always using the same forward proxy, and pass nil for never using one.
+//
+// By default, the forward proxy is taken from the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables (see
+// `http.ProxyFromEnvironment`). The forward proxy is used by all transports, as well as for obtaining the TLS
+// connection state of the server. Like gRPC itself, the client tunnels all connections through forward proxies with
+// an "http" or "https" scheme via CONNECT requests, even for plaintext connections to the server. Credentials in the
+// proxy URL are sent via basic authentication. "socks5" forward proxies are supported as well.
+func WithForwardProxy(proxy func(*http.Request) (*url.URL, error)) ConnectOption {
+	return forwardProxyOption(proxy)
+}
+
+// WithClientCertificateFiles returns a connection option that instructs the client to present the client certificate
+// in the given PEM files to the server. The files are read whenever a connection to the server is established, and
+// reloaded if they have changed, such that rotated certificates are used without creating a new connection.
+// Alternatively, set `GetClientCertificate` in the TLS config.
+//
+// This option overrides any client certificates in the TLS config, and is ignored for plaintext connections.
+func WithClientCertificateFiles(certFile, keyFile string) ConnectOption {
+	return clientCertFilesOption{certFile: certFile, keyFile: keyFile}
+}
+
+// WithTransportCredentials returns a connection option that instructs the client to secure connections to the server
+// with the given gRPC transport credentials, such as SPIFFE-based or custom mTLS credentials, instead of the TLS
+// config. The credentials must establish TLS connections, and report `credentials.TLSInfo` as auth info (as the
+// credentials created by `credentials.NewTLS` do). The auth info the credentials report is passed on to gRPC.
+//
+// Connections are secured even if no TLS config is given. If one is given, it only determines the server name passed
+// to the credentials, which otherwise is the host of the endpoint. Note that the credentials determine the ALPN
+// protocols offered to the server (`credentials.NewTLS` always offers "h2"). When using WebSockets and the server
+// negotiates HTTP/2, WebSockets are bootstrapped via extended CONNECT requests on that connection, as with
+// `UseWebSocketOverHTTP2(true)`, which fails unless the server supports them.
+func WithTransportCredentials(creds credentials.TransportCredentials) ConnectOption {
+	return transportCredsOption{creds: creds}
+}
+
+// WithContextDialer returns a connection option that instructs the client to establish all connections to the server
+// via the given function, e.g., for connecting through a vsock or an SSH tunnel. The function is called with the
+// address of the server (i.e., the endpoint, or a resolved address when using a gRPC target URI), and the connection
+// it returns is used as if it were a TCP connection to that address.
+//
+// Like in gRPC, the forward proxy from the environment is not used with a custom dialer. If a forward proxy is
+// configured explicitly via WithForwardProxy, the function is used for connecting to the forward proxy instead.
+//
+// To connect to a Unix domain socket, it is sufficient to pass an endpoint of the form `unix:path`,
+// `unix:///absolute_path` or `unix-abstract:name` instead.
+func WithContextDialer(dial func(ctx context.Context, addr string) (net.Conn, error)) ConnectOption {
+	return contextDialerOption(dial)
+}
+
+// WithHeaders returns a connection option that instructs the client to send the given headers with every HTTP
+// request to the server, including WebSocket upgrade requests. The headers replace any headers of the same name that
+// would otherwise be sent, e.g., from gRPC metadata. Use this for static credentials expected by load balancers, or
+// for setting the `Origin` header of WebSocket upgrades. If passed multiple times, all headers are sent.
+func WithHeaders(headers http.Header) ConnectOption {
+	return headersOption(headers.Clone())
+}
+
+// WithAuthority returns a connection option that sets the authority of the gRPC connection, which by default is the
+// endpoint (or the endpoint part of a gRPC target URI). The authority is what gRPC reports to interceptors and
+// per-RPC credentials, and determines the Host header and the TLS server name unless these are set explicitly.
+// Use this to connect to an address, such as an IP address or an internal load balancer, that differs from the
+// virtual host of the server.
+//
+// Passing `grpc.WithAuthority` via DialOpts instead only affects gRPC, but neither the Host header nor the TLS
+// server name.
+func WithAuthority(authority string) ConnectOption {
+	return authorityOption(authority)
+}
+
+// WithHost returns a connection option that sets the Host header of all HTTP requests, including WebSocket upgrade
+// requests, to the given value instead of the authority.
+func WithHost(host string) ConnectOption {
+	return hostOption(host)
+}
+
+// WithServerName returns a connection option that sets the name sent via SNI, and against which the certificate of
+// the server is verified. It takes precedence over the server name in the TLS config. By default, it is the host part
+// of the authority. This option is ignored for plaintext connections.
+func WithServerName(serverName string) ConnectOption {
+	return serverNameOption(serverName)
+}
+
+// WithCookieJar returns a connection option that instructs the client to store cookies set by the server, or by load
+// balancers in front of it, in the given jar, and to send them with every subsequent HTTP request, including
+// WebSocket upgrade requests. This enables cookie-based session affinity ("sticky sessions"), e.g., via the `AWSALB`
+// cookie. If jar is nil, an in-memory jar is used for each connection.
+func WithCookieJar(jar http.CookieJar) ConnectOption {
+	return cookieJarOption{jar: jar}
+}
+
+// WithRequestHook returns a connection option that instructs the client to call the given function for every HTTP
+// request to the server, including WebSocket upgrade requests, right before sending it. The function may modify the
+// request, e.g., to sign it or to add credentials obtained dynamically. Note that the body of gRPC requests is
+// streamed, and must not be consumed by the function. If the function returns an error, the gRPC call fails with the
+// status of the error if it has one (see `status.FromError`), and with status Unavailable otherwise.
+//
+// Hooks are called in the order they are passed, after the headers passed via WithHeaders have been added.
+func WithRequestHook(hook func(*http.Request) error) ConnectOption {
+	return requestHookOption(hook)
+}
+
+// WithResponseHook returns a connection option that instructs the client to call the given function for every HTTP
+// response received from the server, before the client processes it. This allows inspecting the raw response, e.g.,
+// for capturing cookies set by load balancers or `Server-Timing` headers. The function must not consume the body of
+// the response. If it returns an error, the gRPC call fails as described for WithRequestHook.
+func WithResponseHook(hook func(*http.Response) error) ConnectOption {
+	return responseHookOption(hook)
+}
+
+// WithResponseHeaderPolicy returns a connection option that instructs the client to apply the given policy when
+// translating the headers and trailers of HTTP responses, or those received in-band over WebSockets, into gRPC
+// metadata. Without a policy, all headers are passed on, including those added by load balancers.
+func WithResponseHeaderPolicy(policy HeaderPolicy) ConnectOption {
+	return responseHeaderPolicyOption{policy: policy.Compile()}
+}
+
+// WithMetadataLimits returns a connection option that limits the size of response header and trailer frames that
+// the client parses, i.e., the trailers of gRPC-Web responses and the metadata received over WebSockets, as well as
+// the number of values in them. Calls receiving larger frames fail with status ResourceExhausted. Non-positive values
+// keep the defaults of 16KB and 100 values.
+func WithMetadataLimits(maxSize, maxCount int) ConnectOption {
+	return metadataLimitsOption{MaxSize: maxSize, MaxCount: maxCount}
+}
+
+// VerifyServerCapabilities returns a connection option that instructs DialViaProxy to fetch the capabilities of the
+// server (see FetchServerCapabilities) and to fail with an error wrapping ErrIncompatibleServer if the server does not
+// accept calls made with the other connection options, e.g., because it does not accept WebSocket connections, or
+// none of the WebSocket subprotocols of the client. Servers that do not announce their capabilities are assumed to be
+// compatible. This option is not supported for gRPC target URIs.
+func VerifyServerCapabilities() ConnectOption {
+	return verifyCapabilitiesOption{}
+}
+
 type dialOptsOption []grpc.DialOption
 
 func (o dialOptsOption) apply(opts *connectOptions) {
@@ -97,6 +413,12 @@ func (o useWebSocketOption) apply(opts *connectOptions) {
 	opts.useWebSocket = bool(o)
 }
 
+type useWebSocketOverHTTP2Option bool
+
+func (o useWebSocketOverHTTP2Option) apply(opts *connectOptions) {
+	opts.webSocketOverHTTP2 = bool(o)
+}
+
 type forceDowngradeOption bool
 
 func (o forceDowngradeOption) apply(opts *connectOptions) {
@@ -108,3 +430,125 @@ type contentTypeOption string
 func (o contentTypeOption) apply(opts *connectOptions) {
 	opts.contentType = string(o)
 }
+
+type grpcWebHeadersOption struct {
+	userAgent string
+}
+
+func (o *grpcWebHeadersOption) apply(opts *connectOptions) {
+	opts.grpcWebHeaders = o
+}
+
+type forwardProxyOption proxyFunc
+
+func (o forwardProxyOption) apply(opts *connectOptions) {
+	opts.forwardProxy = proxyFunc(o)
+	opts.forwardProxySet = true
+}
+
+type clientCertFilesOption struct {
+	certFile, keyFile string
+}
+
+func (o clientCertFilesOption) apply(opts *connectOptions) {
+	opts.clientCertFiles = &clientCertFiles{certFile: o.certFile, keyFile: o.keyFile}
+}
+
+type keepaliveOption keepaliveParams
+
+func (o keepaliveOption) apply(opts *connectOptions) {
+	opts.keepalive = keepaliveParams(o)
+}
+
+type webSocketRetryOption webSocketRetryParams
+
+func (o webSocketRetryOption) apply(opts *connectOptions) {
+	opts.webSocketRetry = webSocketRetryParams(o)
+}
+
+type transportCredsOption struct {
+	creds credentials.TransportCredentials
+}
+
+func (o transportCredsOption) apply(opts *connectOptions) {
+	opts.transportCreds = o.creds
+}
+
+type contextDialerOption contextDialFunc
+
+func (o contextDialerOption) apply(opts *connectOptions) {
+	opts.contextDialer = contextDialFunc(o)
+}
+
+type headersOption http.Header
+
+func (o headersOption) apply(opts *connectOptions) {
+	if opts.headers == nil {
+		opts.headers = make(http.Header)
+	}
+	for key, values := range o {
+		opts.headers[key] = append(opts.headers[key], values...)
+	}
+}
+
+type requestHookOption requestHook
+
+func (o requestHookOption) apply(opts *connectOptions) {
+	opts.requestHooks = append(opts.requestHooks, requestHook(o))
+}
+
+type responseHookOption responseHook
+
+func (o responseHookOption) apply(opts *connectOptions) {
+	opts.responseHooks = append(opts.responseHooks, responseHook(o))
+}
+
+type cookieJarOption struct {
+	jar http.CookieJar
+}
+
+func (o cookieJarOption) apply(opts *connectOptions) {
+	opts.cookieJar = o.jar
+	if opts.cookieJar == nil {
+		// Options are applied for every connection, so every connection gets its own jar. cookiejar.New never fails.
+		opts.cookieJar, _ = cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	}
+}
+
+type authorityOption string
+
+func (o authorityOption) apply(opts *connectOptions) {
+	opts.authority = string(o)
+}
+
+type hostOption string
+
+func (o hostOption) apply(opts *connectOptions) {
+	opts.host = string(o)
+}
+
+type serverNameOption string
+
+func (o serverNameOption) apply(opts *connectOptions) {
+	opts.serverName = string(o)
+}
+
+type verifyCapabilitiesOption struct{}
+
+func (verifyCapabilitiesOption) apply(opts *connectOptions) {
+	opts.verifyCapabilities = true
+}
+
+type responseHeaderPolicyOption struct {
+	policy *headerpolicy.Policy
+}
+
+func (o responseHeaderPolicyOption) apply(opts *connectOptions) {
+	opts.responseHeaderPolicy = o.policy
+}
+
+type metadataLimitsOption grpcproto.MetadataLimits
+
+func (o metadataLimitsOption) apply(opts *connectOptions) {
+	opts.metadataLimits = grpcproto.MetadataLimits(o)
+}
@@ -0,0 +1,452 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"golang.stackrox.io/grpc-http1/internal/grpcweb"
+	"golang.stackrox.io/grpc-http1/internal/grpcwebsocket"
+	"golang.stackrox.io/grpc-http1/internal/httputils"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// The probe calls the standard health service. It does not matter whether the server actually implements it:
+	// an `Unimplemented` status is just as good a proof that gRPC traffic made it through to the server.
+	probeUnaryMethod     = "/grpc.health.v1.Health/Check"
+	probeStreamingMethod = "/grpc.health.v1.Health/Watch"
+
+	probeStreamTimeout = 5 * time.Second
+)
+
+// ProbeTransport identifies a way of talking to a gRPC server that is tested by `Probe`.
+type ProbeTransport string
+
+const (
+	// ProbeNativeGRPC tests plain gRPC over HTTP/2, including response trailers.
+	ProbeNativeGRPC ProbeTransport = "native-grpc"
+	// ProbeGRPCWeb tests a unary call with a gRPC-Web downgraded response.
+	ProbeGRPCWeb ProbeTransport = "grpc-web"
+	// ProbeWebSocket tests a unary call via the gRPC-WebSocket protocol.
+	ProbeWebSocket ProbeTransport = "grpc-ws"
+	// ProbeServerStreaming tests whether a gRPC-Web downgraded server stream is delivered without buffering.
+	ProbeServerStreaming ProbeTransport = "grpc-web-streaming"
+)
+
+// ProbeResult is the outcome of testing a single transport.
+type ProbeResult struct {
+	Transport ProbeTransport
+	// OK indicates whether the transport can be used to talk to the server.
+	OK bool
+	// Latency is the time until the response headers (or, for streaming, the first message) were received.
+	Latency time.Duration
+
+	// HTTPProto, HTTPStatus and ContentType describe the HTTP response, if one was received.
+	HTTPProto   string
+	HTTPStatus  int
+	ContentType string
+	// ResponseError is the error extracted from an HTTP error response, which is typically generated by a
+	// load balancer or proxy between the client and the server.
+	ResponseError error
+	// GRPCStatus is the gRPC status returned by the server, if any.
+	GRPCStatus *status.Status
+	// TrailersStripped indicates that a gRPC response was received, but its trailers were lost on the way.
+	TrailersStripped bool
+
+	// Err is the reason for the transport not working, if it doesn't.
+	Err error
+}
+
+// ProbeReport summarizes what the network path to a gRPC server supports.
+type ProbeReport struct {
+	Endpoint string
+	Results  []*ProbeResult
+}
+
+// Result returns the result for the given transport, or nil if the transport was not tested.
+func (r *ProbeReport) Result(transport ProbeTransport) *ProbeResult {
+	for _, res := range r.Results {
+		if res.Transport == transport {
+			return res
+		}
+	}
+	return nil
+}
+
+// String returns a human-readable description of the report.
+func (r *ProbeReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Connectivity report for %s\n", r.Endpoint)
+	for _, res := range r.Results {
+		outcome := "FAILED"
+		if res.OK {
+			outcome = "OK"
+		}
+		fmt.Fprintf(&sb, "  %-20s %s (latency %v)\n", res.Transport, outcome, res.Latency.Round(time.Millisecond))
+		if res.HTTPStatus != 0 {
+			fmt.Fprintf(&sb, "    HTTP response:     %s %d, content-type %q\n", res.HTTPProto, res.HTTPStatus, res.ContentType)
+		}
+		if res.ResponseError != nil {
+			fmt.Fprintf(&sb, "    response error:    %v\n", res.ResponseError)
+		}
+		if res.GRPCStatus != nil {
+			fmt.Fprintf(&sb, "    gRPC status:       %v: %s\n", res.GRPCStatus.Code(), res.GRPCStatus.Message())
+		}
+		if res.TrailersStripped {
+			fmt.Fprintf(&sb, "    trailers were stripped from the response\n")
+		}
+		if res.Err != nil {
+			fmt.Fprintf(&sb, "    error:             %v\n", res.Err)
+		}
+	}
+	return sb.String()
+}
+
+// Probe tests which ways of talking gRPC work on the network path to the given endpoint: native gRPC over HTTP/2,
+// gRPC-Web downgrades, gRPC-WebSocket and unbuffered server streaming. The probe uses the standard gRPC health service,
+// but does not require the server to implement it.
+//
+// The returned error only indicates problems setting up the probe; failures of the individual transports are
+// recorded in the report.
+func Probe(ctx context.Context, endpoint string, tlsClientConf *tls.Config, opts ...ConnectOption) (*ProbeReport, error) {
+	var connectOpts connectOptions
+	for _, opt := range opts {
+		opt.apply(&connectOpts)
+	}
+	ep, tlsClientConf, err := connectOpts.parseEndpoint(endpoint, tlsClientConf)
+	if err != nil {
+		return nil, err
+	}
+	if ep.resolve {
+		return nil, errors.Errorf("probing gRPC target URI %q is not supported; probe a resolved address instead", endpoint)
+	}
+	authority, host := connectOpts.authorityAndHost(ep.authority, tlsClientConf)
+	tlsClientConf = connectOpts.withServerName(tlsClientConf, hostOf(authority))
+
+	scheme := "https"
+	if tlsClientConf == nil {
+		scheme = "http"
+	}
+
+	// Without TLS, there is no ALPN, so native gRPC can only be attempted with prior knowledge.
+	nativeTransport, err := createTransport(tlsClientConf, connectOpts.forceHTTP2 || tlsClientConf == nil, &connectOpts, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating transport")
+	}
+	webTransport, err := createTransport(tlsClientConf, connectOpts.forceHTTP2, &connectOpts, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating transport")
+	}
+
+	p := &prober{
+		baseURL:      scheme + "://" + ep.addr + connectOpts.pathPrefix,
+		host:         host,
+		nativeClient: &http.Client{Transport: nativeTransport},
+		webClient:    &http.Client{Transport: webTransport},
+		wsClient:     createWebSocketHTTPClient(tlsClientConf, &connectOpts, nil),
+	}
+	defer p.closeIdleConnections()
+
+	return &ProbeReport{
+		Endpoint: endpoint,
+		Results: []*ProbeResult{
+			p.probeNative(ctx),
+			p.probeGRPCWeb(ctx),
+			p.probeWebSocket(ctx),
+			p.probeServerStreaming(ctx),
+		},
+	}, nil
+}
+
+type prober struct {
+	baseURL string
+	host    string
+
+	nativeClient, webClient, wsClient *http.Client
+}
+
+func (p *prober) closeIdleConnections() {
+	p.nativeClient.CloseIdleConnections()
+	p.webClient.CloseIdleConnections()
+	p.wsClient.CloseIdleConnections()
+}
+
+func (p *prober) newRequest(ctx context.Context, method string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+method, bytes.NewReader(grpcproto.MakeMessageHeader(0, 0)))
+	if err != nil {
+		return nil, err
+	}
+	req.Host = p.host
+	req.Header.Set("Content-Type", "application/grpc")
+	return req, nil
+}
+
+func (p *prober) newGRPCWebRequest(ctx context.Context, method string) (*http.Request, error) {
+	req, err := p.newRequest(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/grpc-web")
+	req.Header.Set(grpcweb.GRPCWebOnlyHeader, "true")
+	return req, nil
+}
+
+// recordResponse stores information about the HTTP response in the result, and returns whether the response is
+// a non-error response with the given content type.
+func recordResponse(res *ProbeResult, resp *http.Response, expectedContentType string) bool {
+	res.HTTPProto = resp.Proto
+	res.HTTPStatus = resp.StatusCode
+	res.ContentType = resp.Header.Get("Content-Type")
+	if respErr := httputils.ExtractResponseError(resp); respErr != nil {
+		res.ResponseError = respErr
+		res.Err = errors.New("received an HTTP error response")
+		return false
+	}
+	if contentType, _, _ := strings.Cut(res.ContentType, "+"); contentType != expectedContentType {
+		res.Err = errors.Errorf("expected a response with content-type %s", expectedContentType)
+		return false
+	}
+	return true
+}
+
+func (p *prober) probeNative(ctx context.Context) *ProbeResult {
+	res := &ProbeResult{Transport: ProbeNativeGRPC}
+	req, err := p.newRequest(ctx, probeUnaryMethod)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	req.Header.Set("TE", "trailers")
+
+	start := time.Now()
+	resp, err := p.nativeClient.Do(req)
+	res.Latency = time.Since(start)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	evaluateNativeResponse(res, resp)
+	return res
+}
+
+// evaluateNativeResponse records in the result whether the given response to a native gRPC call is a valid gRPC
+// response, and if not, why.
+func evaluateNativeResponse(res *ProbeResult, resp *http.Response) {
+	if !recordResponse(res, resp, "application/grpc") {
+		return
+	}
+	if resp.ProtoMajor != 2 {
+		res.Err = errors.Errorf("response was received via %s instead of HTTP/2", resp.Proto)
+		return
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		res.Err = errors.Wrap(err, "reading response body")
+		return
+	}
+
+	res.GRPCStatus, err = grpcStatusFromHeaders(resp.Header, resp.Trailer)
+	if err != nil {
+		res.Err = err
+		res.TrailersStripped = len(body) > 0 || len(resp.Trailer) == 0
+		return
+	}
+	res.OK = true
+}
+
+func (p *prober) probeGRPCWeb(ctx context.Context) *ProbeResult {
+	res := &ProbeResult{Transport: ProbeGRPCWeb}
+	req, err := p.newGRPCWebRequest(ctx, probeUnaryMethod)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	start := time.Now()
+	resp, err := p.webClient.Do(req)
+	res.Latency = time.Since(start)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	evaluateGRPCWebResponse(res, resp)
+	return res
+}
+
+// evaluateGRPCWebResponse records in the result whether the given response to a gRPC-Web call is a valid gRPC-Web
+// response, and if not, why.
+func evaluateGRPCWebResponse(res *ProbeResult, resp *http.Response) {
+	if !recordResponse(res, resp, "application/grpc-web") {
+		return
+	}
+
+	var trailers http.Header
+	if _, err := io.ReadAll(grpcweb.NewResponseReader(resp.Body, &trailers, nil, grpcproto.MetadataLimits{})); err != nil {
+		res.Err = errors.Wrap(err, "reading gRPC-Web response body")
+		return
+	}
+	st, err := grpcStatusFromHeaders(resp.Header, trailers)
+	if err != nil {
+		res.Err = err
+		return
+	}
+	res.GRPCStatus = st
+	res.OK = true
+}
+
+func (p *prober) probeWebSocket(ctx context.Context) *ProbeResult {
+	res := &ProbeResult{Transport: ProbeWebSocket}
+
+	hdr := make(http.Header)
+	hdr.Set("Content-Type", "application/grpc")
+
+	start := time.Now()
+	conn, resp, err := websocket.Dial(ctx, p.baseURL+probeUnaryMethod, &websocket.DialOptions{
+		HTTPHeader:      hdr,
+		HTTPClient:      p.wsClient,
+		Host:            p.host,
+		Subprotocols:    subprotocols,
+		CompressionMode: websocket.CompressionDisabled,
+	})
+	res.Latency = time.Since(start)
+	if resp != nil {
+		res.HTTPProto = resp.Proto
+		res.HTTPStatus = resp.StatusCode
+		res.ContentType = resp.Header.Get("Content-Type")
+		if resp.Body != nil {
+			res.ResponseError = httputils.ExtractResponseError(resp)
+			_ = resp.Body.Close()
+		}
+	}
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	defer func() { _ = conn.Close(websocket.StatusNormalClosure, "") }()
+
+	if err := conn.Write(ctx, websocket.MessageBinary, grpcproto.MakeMessageHeader(0, 0)); err != nil {
+		res.Err = errors.Wrap(err, "writing request message")
+		return res
+	}
+	if err := conn.Write(ctx, websocket.MessageBinary, grpcproto.EndStreamHeader); err != nil {
+		res.Err = errors.Wrap(err, "writing end of stream")
+		return res
+	}
+
+	mt, msg, err := conn.Read(ctx)
+	if err != nil {
+		res.Err = errors.Wrap(err, "reading response header")
+		return res
+	}
+	if mt != websocket.MessageBinary || grpcproto.ValidateGRPCFrame(msg) != nil || !grpcproto.IsMetadataFrame(msg) {
+		res.Err = errors.Errorf("did not receive a valid %s response header", grpcwebsocket.SubprotocolName)
+		return res
+	}
+	res.OK = true
+	return res
+}
+
+func (p *prober) probeServerStreaming(ctx context.Context) *ProbeResult {
+	res := &ProbeResult{Transport: ProbeServerStreaming}
+
+	// The health watch stream sends the current status right away, but never ends. If the first message doesn't
+	// make it to the client in time, something on the way is waiting for the response to be complete.
+	ctx, cancel := context.WithTimeout(ctx, probeStreamTimeout)
+	defer cancel()
+
+	req, err := p.newGRPCWebRequest(ctx, probeStreamingMethod)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	start := time.Now()
+	resp, err := p.webClient.Do(req)
+	if err != nil {
+		res.Latency = time.Since(start)
+		res.Err = err
+		if ctx.Err() != nil {
+			res.Err = errors.Errorf("no response headers received within %v; an intermediary may be buffering streamed responses", probeStreamTimeout)
+		}
+		return res
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if !recordResponse(res, resp, "application/grpc-web") {
+		res.Latency = time.Since(start)
+		return res
+	}
+	if st, err := grpcStatusFromHeaders(resp.Header, nil); err == nil {
+		// Trailers-only response, most likely because the health service is not implemented.
+		res.Latency = time.Since(start)
+		res.GRPCStatus = st
+		res.Err = errors.New("server did not open a stream; streaming could not be verified")
+		return res
+	}
+
+	var trailers http.Header
+	var msgHeader [grpcproto.MessageHeaderLength]byte
+	_, err = io.ReadFull(grpcweb.NewResponseReader(resp.Body, &trailers, nil, grpcproto.MetadataLimits{}), msgHeader[:])
+	res.Latency = time.Since(start)
+	if err != nil {
+		if st, stErr := grpcStatusFromHeaders(resp.Header, trailers); stErr == nil {
+			res.GRPCStatus = st
+			res.Err = errors.New("stream ended without any messages; streaming could not be verified")
+		} else if ctx.Err() != nil {
+			res.Err = errors.Errorf("no streamed message received within %v; an intermediary may be buffering streamed responses", probeStreamTimeout)
+		} else {
+			res.Err = errors.Wrap(err, "reading streamed message")
+		}
+		return res
+	}
+	res.OK = true
+	return res
+}
+
+// grpcStatusFromHeaders extracts the gRPC status from the trailers, or from the headers in case of a Trailers-Only
+// response.
+func grpcStatusFromHeaders(hdr, trailers http.Header) (*status.Status, error) {
+	src := trailers
+	if src.Get("Grpc-Status") == "" {
+		src = hdr
+	}
+	statusStr := src.Get("Grpc-Status")
+	if statusStr == "" {
+		return nil, errors.New("no gRPC status in response")
+	}
+	code, err := strconv.ParseUint(statusStr, 10, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid gRPC status %q", statusStr)
+	}
+	return status.New(codes.Code(code), grpcproto.DecodeGrpcMessage(src.Get("Grpc-Message"))), nil
+}
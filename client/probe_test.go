@@ -0,0 +1,251 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func newProbeResponse(proto string, statusCode int, header http.Header, body []byte, trailer http.Header) *http.Response {
+	major, minor, _ := http.ParseHTTPVersion(proto)
+	return &http.Response{
+		Proto:      proto,
+		ProtoMajor: major,
+		ProtoMinor: minor,
+		StatusCode: statusCode,
+		Status:     http.StatusText(statusCode),
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Trailer:    trailer,
+	}
+}
+
+func grpcWebTrailerFrame(trailers string) []byte {
+	frame := []byte{0x80, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(trailers)))
+	return append(frame, trailers...)
+}
+
+func TestEvaluateNativeResponse(t *testing.T) {
+	grpcHeader := http.Header{"Content-Type": {"application/grpc"}}
+	message := []byte{0, 0, 0, 0, 2, 8, 1}
+
+	cases := []struct {
+		name             string
+		resp             *http.Response
+		ok               bool
+		code             codes.Code
+		trailersStripped bool
+		responseError    bool
+	}{
+		{
+			name: "status-in-trailers",
+			resp: newProbeResponse("HTTP/2.0", http.StatusOK, grpcHeader, message, http.Header{"Grpc-Status": {"0"}}),
+			ok:   true,
+			code: codes.OK,
+		},
+		{
+			name: "trailers-only",
+			resp: newProbeResponse("HTTP/2.0", http.StatusOK, http.Header{
+				"Content-Type": {"application/grpc"},
+				"Grpc-Status":  {"12"},
+			}, nil, nil),
+			ok:   true,
+			code: codes.Unimplemented,
+		},
+		{
+			name:             "trailers-stripped-after-message",
+			resp:             newProbeResponse("HTTP/2.0", http.StatusOK, grpcHeader, message, nil),
+			trailersStripped: true,
+		},
+		{
+			name:             "no-trailers-at-all",
+			resp:             newProbeResponse("HTTP/2.0", http.StatusOK, grpcHeader, nil, nil),
+			trailersStripped: true,
+		},
+		{
+			// Trailers made it through, but none of them carries a status, so they were not stripped.
+			name: "trailers-without-status",
+			resp: newProbeResponse("HTTP/2.0", http.StatusOK, grpcHeader, nil, http.Header{"X-Other": {"value"}}),
+		},
+		{
+			name: "http1-response",
+			resp: newProbeResponse("HTTP/1.1", http.StatusOK, grpcHeader, message, http.Header{"Grpc-Status": {"0"}}),
+		},
+		{
+			name: "wrong-content-type",
+			resp: newProbeResponse("HTTP/2.0", http.StatusOK, http.Header{"Content-Type": {"text/html"}}, []byte("<html></html>"), nil),
+		},
+		{
+			name: "http-error",
+			resp: newProbeResponse("HTTP/2.0", http.StatusBadGateway, http.Header{"Content-Type": {"text/plain"}},
+				[]byte("upstream connect error"), nil),
+			responseError: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := &ProbeResult{Transport: ProbeNativeGRPC}
+			evaluateNativeResponse(res, c.resp)
+
+			assert.Equal(t, c.ok, res.OK, "error: %v", res.Err)
+			assert.Equal(t, c.ok, res.Err == nil)
+			assert.Equal(t, c.trailersStripped, res.TrailersStripped)
+			assert.Equal(t, c.responseError, res.ResponseError != nil)
+			assert.Equal(t, c.resp.StatusCode, res.HTTPStatus)
+			assert.Equal(t, c.resp.Proto, res.HTTPProto)
+			if c.ok {
+				assert.Equal(t, c.code, res.GRPCStatus.Code())
+			}
+		})
+	}
+}
+
+func TestEvaluateGRPCWebResponse(t *testing.T) {
+	grpcWebHeader := http.Header{"Content-Type": {"application/grpc-web+proto"}}
+
+	cases := []struct {
+		name    string
+		resp    *http.Response
+		ok      bool
+		code    codes.Code
+		message string
+	}{
+		{
+			name: "status-in-trailer-frame",
+			resp: newProbeResponse("HTTP/1.1", http.StatusOK, grpcWebHeader,
+				grpcWebTrailerFrame("grpc-status: 0\r\n"), nil),
+			ok:   true,
+			code: codes.OK,
+		},
+		{
+			name: "trailers-only",
+			resp: newProbeResponse("HTTP/1.1", http.StatusOK, http.Header{
+				"Content-Type": {"application/grpc-web"},
+				"Grpc-Status":  {"12"},
+				"Grpc-Message": {"unknown%20service"},
+			}, nil, nil),
+			ok:      true,
+			code:    codes.Unimplemented,
+			message: "unknown service",
+		},
+		{
+			name: "no-status",
+			resp: newProbeResponse("HTTP/1.1", http.StatusOK, grpcWebHeader, nil, nil),
+		},
+		{
+			name: "not-downgraded",
+			resp: newProbeResponse("HTTP/1.1", http.StatusOK, http.Header{"Content-Type": {"application/grpc"}},
+				nil, http.Header{"Grpc-Status": {"0"}}),
+		},
+		{
+			name: "truncated-trailer-frame",
+			resp: newProbeResponse("HTTP/1.1", http.StatusOK, grpcWebHeader,
+				grpcWebTrailerFrame("grpc-status: 0\r\n")[:10], nil),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			res := &ProbeResult{Transport: ProbeGRPCWeb}
+			evaluateGRPCWebResponse(res, c.resp)
+
+			assert.Equal(t, c.ok, res.OK, "error: %v", res.Err)
+			assert.Equal(t, c.ok, res.Err == nil)
+			if c.ok {
+				assert.Equal(t, c.code, res.GRPCStatus.Code())
+				assert.Equal(t, c.message, res.GRPCStatus.Message())
+			}
+		})
+	}
+}
+
+func TestGRPCStatusFromHeaders(t *testing.T) {
+	cases := []struct {
+		name     string
+		hdr      http.Header
+		trailers http.Header
+		valid    bool
+		code     codes.Code
+		message  string
+	}{
+		{
+			name:     "trailers-take-precedence",
+			hdr:      http.Header{"Grpc-Status": {"12"}},
+			trailers: http.Header{"Grpc-Status": {"5"}, "Grpc-Message": {"not%20found"}},
+			valid:    true,
+			code:     codes.NotFound,
+			message:  "not found",
+		},
+		{
+			name:    "headers-of-trailers-only-response",
+			hdr:     http.Header{"Grpc-Status": {"14"}, "Grpc-Message": {"unavailable"}},
+			valid:   true,
+			code:    codes.Unavailable,
+			message: "unavailable",
+		},
+		{
+			name: "missing",
+			hdr:  http.Header{"Content-Type": {"application/grpc"}},
+		},
+		{
+			name: "invalid",
+			hdr:  http.Header{"Grpc-Status": {"OK"}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			st, err := grpcStatusFromHeaders(c.hdr, c.trailers)
+			if !c.valid {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.code, st.Code())
+			assert.Equal(t, c.message, st.Message())
+		})
+	}
+}
+
+func TestProbeReport(t *testing.T) {
+	report := &ProbeReport{
+		Endpoint: "example.com:443",
+		Results: []*ProbeResult{
+			{Transport: ProbeNativeGRPC, HTTPProto: "HTTP/2.0", HTTPStatus: http.StatusOK, ContentType: "application/grpc",
+				TrailersStripped: true, Err: errors.New("no gRPC status in response")},
+			{Transport: ProbeGRPCWeb, OK: true},
+		},
+	}
+
+	assert.Same(t, report.Results[1], report.Result(ProbeGRPCWeb))
+	assert.Nil(t, report.Result(ProbeWebSocket))
+
+	str := report.String()
+	assert.Contains(t, str, "Connectivity report for example.com:443")
+	assert.Contains(t, str, "native-grpc          FAILED")
+	assert.Contains(t, str, "trailers were stripped from the response")
+	assert.Contains(t, str, "no gRPC status in response")
+	assert.Contains(t, str, "grpc-web             OK")
+}
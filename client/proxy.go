@@ -17,52 +17,78 @@ package client
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"slices"
 	"strings"
 
-	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/h2c"
-	"golang.stackrox.io/grpc-http1/internal/grpcproto"
 	"golang.stackrox.io/grpc-http1/internal/grpcweb"
-	"golang.stackrox.io/grpc-http1/internal/httputils"
-	"golang.stackrox.io/grpc-http1/internal/pipeconn"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	// Registers the client-side health checking function, such that health-aware load balancing can be enabled
+	// via the service config.
+	_ "google.golang.org/grpc/health"
 )
 
-func modifyResponse(resp *http.Response) error {
+const (
+	// pipeTarget is the gRPC target for plain endpoints. The dialer ignores it, so it only determines the authority
+	// of requests to the client proxy.
+	pipeTarget = "pipe"
+)
+
+func modifyResponse(resp *http.Response, connectOpts *connectOptions) error {
 	// Check if the response is an error response right away, and attempt to display a more useful
 	// message than gRPC does by default. We still delegate to the default gRPC behavior for 200 responses
 	// which are otherwise invalid.
-	if err := httputils.ExtractResponseError(resp); err != nil {
+	if err := extractResponseError(resp); err != nil {
 		return errors.Wrap(err, "receiving gRPC response from remote endpoint")
 	}
 
-	if resp.ContentLength == 0 {
+	// A successful response that isn't a gRPC response at all was most likely produced by an intermediary.
+	if err := checkGRPCResponse(resp); err != nil {
+		return err
+	}
+	connectOpts.responseHeaderPolicy.Apply(resp.Header, "")
+
+	// Trailers-only responses carry the status in the headers. Some third-party gRPC-Web servers (e.g., Envoy) send
+	// these with an empty chunked body instead of a zero content length.
+	if resp.ContentLength == 0 || resp.Header.Get("Grpc-Status") != "" {
 		// Make sure headers do not get flushed, as otherwise the gRPC client will complain about missing trailers.
 		resp.Header.Set(dontFlushHeadersHeaderKey, "true")
 	}
+	if resp.ProtoMajor < 2 && resp.Body != nil {
+		// Unlike HTTP/2 connections, HTTP/1 connections have no way of checking liveness other than receiving data.
+		resp.Body = connectOpts.keepalive.wrapHTTP1Body(resp.Body)
+	}
+
 	contentType, contentSubType, _ := strings.Cut(resp.Header.Get("Content-Type"), "+")
-	if contentType != "application/grpc-web" {
-		// No modification necessary if we aren't handling a gRPC web response.
-		return nil
+	transportInfo := &TransportInfo{Transport: TransportGRPC, Proto: resp.Proto}
+	if contentType == "application/grpc-web" {
+		transportInfo.Transport, transportInfo.Downgraded = TransportGRPCWeb, true
 	}
+	setTransportInfoHeader(resp.Header, transportInfo)
+	if contentType == "application/grpc-web" {
+		respCT := "application/grpc"
+		if contentSubType != "" {
+			respCT += "+" + contentSubType
+		}
+		resp.Header.Set("Content-Type", respCT)
 
-	respCT := "application/grpc"
-	if contentSubType != "" {
-		respCT += "+" + contentSubType
+		if resp.Body != nil {
+			resp.Body = grpcweb.NewResponseReader(resp.Body, &resp.Trailer, nil, connectOpts.metadataLimits)
+		}
 	}
-	resp.Header.Set("Content-Type", respCT)
 
+	if resp.Body != nil && connectOpts.responseHeaderPolicy != nil {
+		resp.Body = newTrailerPolicyBody(resp, connectOpts.responseHeaderPolicy)
+	}
 	if resp.Body != nil {
-		resp.Body = grpcweb.NewResponseReader(resp.Body, &resp.Trailer, nil)
+		resp.Body = &statusCheckingBody{ReadCloser: resp.Body, resp: resp, buffered: isBufferedServerStream(resp)}
 	}
 	return nil
 }
@@ -72,18 +98,21 @@ func writeError(w http.ResponseWriter, err error) {
 	w.Header().Set("Content-Type", "application/grpc")
 	w.Header().Add("Trailer", "Grpc-Status")
 	w.Header().Add("Trailer", "Grpc-Message")
+	w.Header().Add("Trailer", "Grpc-Status-Details-Bin")
 	w.WriteHeader(http.StatusOK)
 
-	w.Header().Set("Grpc-Status", fmt.Sprintf("%d", codes.Unavailable))
-	errMsg := errors.Wrap(err, "transport").Error()
-	w.Header().Set("Grpc-Message", grpcproto.EncodeGrpcMessage(errMsg))
+	setStatusHeaders(w.Header(), "", err)
 }
 
-func createReverseProxy(endpoint string, transport http.RoundTripper, insecure, forceDowngrade bool, contentType string) *httputil.ReverseProxy {
+// createReverseProxy creates a reverse proxy forwarding requests to the given endpoint. If host is non-empty, it is
+// used as the Host header; otherwise, the Host header is the authority chosen by gRPC.
+func createReverseProxy(endpoint, host string, transport http.RoundTripper, insecure bool, connectOpts *connectOptions) *httputil.ReverseProxy {
 	scheme := "https"
 	if insecure {
 		scheme = "http"
 	}
+	forceDowngrade, contentType, pathPrefix := connectOpts.forceDowngrade, connectOpts.contentType, connectOpts.pathPrefix
+	grpcWebHeaders := connectOpts.grpcWebHeaders
 	return &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
 			if forceDowngrade {
@@ -102,12 +131,28 @@ func createReverseProxy(endpoint string, transport http.RoundTripper, insecure,
 				// because an HTTP client will send both old and new header values.
 				req.Header.Set("Content-Type", contentType)
 			}
+			if grpcWebHeaders != nil {
+				userAgent := grpcWebHeaders.userAgent
+				if userAgent == "" {
+					userAgent = req.Header.Get("User-Agent")
+				}
+				req.Header.Set("X-Grpc-Web", "1")
+				req.Header.Set("X-User-Agent", userAgent)
+			}
 
 			req.URL.Scheme = scheme
 			req.URL.Host = endpoint
+			if pathPrefix != "" {
+				req.URL.Path, req.URL.RawPath = pathPrefix+req.URL.Path, ""
+			}
+			if host != "" {
+				req.Host = host
+			}
+		},
+		Transport: transport,
+		ModifyResponse: func(resp *http.Response) error {
+			return modifyResponse(resp, connectOpts)
 		},
-		Transport:      transport,
-		ModifyResponse: modifyResponse,
 		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
 			writeError(w, err)
 		},
@@ -116,47 +161,89 @@ func createReverseProxy(endpoint string, transport http.RoundTripper, insecure,
 	}
 }
 
-func createTransport(tlsClientConf *tls.Config, forceHTTP2 bool, extraH2ALPNs []string) (http.RoundTripper, error) {
-	if forceHTTP2 {
-		transport := &http2.Transport{
-			AllowHTTP:       true,
-			TLSClientConfig: tlsClientConf,
+// nextProtos returns the ALPN protocols to offer to the server, based on the ones in the given TLS config.
+func nextProtos(tlsClientConf *tls.Config, forceHTTP2, useWebSocket bool) []string {
+	if useWebSocket {
+		return []string{"http/1.1"}
+	}
+	protos := slices.Clone(tlsClientConf.NextProtos)
+	if !slices.Contains(protos, "h2") {
+		protos = append([]string{"h2"}, protos...)
+	}
+	if !forceHTTP2 && !slices.Contains(protos, "http/1.1") {
+		protos = append(protos, "http/1.1")
+	}
+	return protos
+}
+
+// newTLSDialFunc returns a function establishing TLS connections with the given config, which must already offer the
+// correct ALPN protocols.
+func newTLSDialFunc(tlsConf *tls.Config, connectOpts *connectOptions) tlsDialFunc {
+	d := newDialer(tlsConf, connectOpts)
+	return func(ctx context.Context, addr string) (tlsConn, error) {
+		return d.DialTLSContext(ctx, addr, tlsConf)
+	}
+}
+
+// createTransport creates a transport for forwarding gRPC requests. If TLS is used, the transport establishes TLS
+// connections via dialTLS, or via a dialer for the given connect options if dialTLS is nil.
+func createTransport(tlsClientConf *tls.Config, forceHTTP2 bool, connectOpts *connectOptions, dialTLS tlsDialFunc) (closeableTransport, error) {
+	var dialTLSContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	if tlsClientConf != nil {
+		if dialTLS == nil {
+			tlsConf := tlsClientConf.Clone()
+			tlsConf.NextProtos = nextProtos(tlsClientConf, forceHTTP2, false)
+			dialTLS = newTLSDialFunc(tlsConf, connectOpts)
 		}
-		if tlsClientConf == nil {
-			transport.DialTLSContext = func(_ context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
-				return net.Dial(network, addr)
+		dialTLSContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, err := dialTLS(ctx, addr)
+			if err != nil {
+				return nil, err
 			}
+			return conn, nil
 		}
-		return transport, nil
 	}
+	dialContext := newDialer(tlsClientConf, connectOpts).DialContext
 
-	transport := &http.Transport{
-		ForceAttemptHTTP2: true,
-		Proxy:             http.ProxyFromEnvironment,
+	if forceHTTP2 {
+		transport := &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				if dialTLSContext == nil {
+					return dialContext(ctx, network, addr)
+				}
+				return dialTLSContext(ctx, network, addr)
+			},
+		}
+		connectOpts.keepalive.configureHTTP2Transport(transport)
+		return withHooks(transport, connectOpts), nil
 	}
 
-	if tlsClientConf != nil {
-		transport.TLSClientConfig = tlsClientConf.Clone()
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialContext:       dialContext,
+		DialTLSContext:    dialTLSContext,
 	}
-	if err := http2.ConfigureTransport(transport); err != nil {
+	h2Transport, err := http2.ConfigureTransports(transport)
+	if err != nil {
 		return nil, errors.Wrap(err, "configuring transport for HTTP/2 use")
 	}
+	connectOpts.keepalive.configureHTTP2Transport(h2Transport)
 
 	// Make sure the transport for any extra HTTP/2-like ALPN string behaves like for HTTP/2.
-	for _, extraALPN := range extraH2ALPNs {
+	for _, extraALPN := range connectOpts.extraH2ALPNs {
 		transport.TLSNextProto[extraALPN] = transport.TLSNextProto["h2"]
 	}
 
-	return transport, nil
+	return withHooks(transport, connectOpts), nil
 }
 
-func createClientProxy(endpoint string, tlsClientConf *tls.Config, forceHTTP2, forceDowngrade bool, extraH2ALPNs []string, contentType string) (*http.Server, pipeconn.DialContextFunc, error) {
-	transport, err := createTransport(tlsClientConf, forceHTTP2, extraH2ALPNs)
+func createClientProxyHandler(endpoint, host string, tlsClientConf *tls.Config, connectOpts *connectOptions, dialTLS tlsDialFunc) (http.Handler, idleConnCloser, error) {
+	transport, err := createTransport(tlsClientConf, connectOpts.forceHTTP2, connectOpts, dialTLS)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "creating transport")
 	}
-	proxy := createReverseProxy(endpoint, transport, tlsClientConf == nil, forceDowngrade, contentType)
-	return makeProxyServer(proxy)
+	return createReverseProxy(endpoint, host, transport, tlsClientConf == nil, connectOpts), transport, nil
 }
 
 // ConnectViaProxy establishes a gRPC client connection via an HTTP/2 proxy that handles endpoints behind HTTP/1.x proxies.
@@ -166,78 +253,159 @@ func createClientProxy(endpoint string, tlsClientConf *tls.Config, forceHTTP2, f
 // Using WebSocket will allow for both streaming and non-streaming gRPC requests, but is not adaptive.
 // Using gRPC-Web "downgrades" will only allow for non-streaming gRPC requests, but will only downgrade if necessary.
 // This method supports server-streaming requests, but only if there isn't a proxy in the middle that buffers chunked responses.
+//
+// The endpoint is either a plain `host:port` address, or a gRPC target URI such as `dns:///host:port`. In the latter
+// case, the target is resolved via gRPC name resolution (including any resolvers passed via DialOpts), and every
+// resolved address is connected to via its own proxy. This allows gRPC load balancing policies and service configs,
+// including client-side health checking, to work across all backends. The authority of the target is used as the
+// Host header and, unless set in the TLS config, as the TLS server name. Endpoints referring to Unix domain sockets
+// (`unix:path`, `unix:///absolute_path` or `unix-abstract:name`) are connected to directly, using "localhost" as the
+// authority, like in gRPC. Finally, the endpoint may be an HTTP(S) base URL such as `https://host/api/grpc`, which is
+// useful if the server is mounted under a path prefix (see server.PathPrefix). The path of the URL is then prepended to
+// the paths of all gRPC-Web and WebSocket requests, and the scheme determines whether TLS is used.
+//
+// The resources of the client proxy are released in the background once the returned connection has been closed.
+// Use DialViaProxy to release them synchronously.
 func ConnectViaProxy(ctx context.Context, endpoint string, tlsClientConf *tls.Config, opts ...ConnectOption) (*grpc.ClientConn, error) {
+	conn, err := DialViaProxy(ctx, endpoint, tlsClientConf, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go closeOnConnShutdown(conn)
+	return conn.ClientConn, nil
+}
+
+// DialViaProxy is like ConnectViaProxy, but returns a ProxyConn that owns all resources of the client proxy. These
+// resources are only released by closing the ProxyConn.
+func DialViaProxy(ctx context.Context, endpoint string, tlsClientConf *tls.Config, opts ...ConnectOption) (*ProxyConn, error) {
 	var connectOpts connectOptions
 	for _, opt := range opts {
 		opt.apply(&connectOpts)
 	}
+	ep, tlsClientConf, err := connectOpts.parseEndpoint(endpoint, tlsClientConf)
+	if err != nil {
+		return nil, err
+	}
 
-	var proxy *http.Server
-	var dialCtx pipeconn.DialContextFunc
-	var err error
-
-	if connectOpts.useWebSocket {
-		proxy, dialCtx, err = createClientWSProxy(endpoint, tlsClientConf)
-	} else {
-		proxy, dialCtx, err = createClientProxy(endpoint, tlsClientConf, connectOpts.forceHTTP2, connectOpts.forceDowngrade, connectOpts.extraH2ALPNs, connectOpts.contentType)
+	if tlsClientConf != nil && connectOpts.clientCertFiles != nil {
+		tlsClientConf = tlsClientConf.Clone()
+		tlsClientConf.Certificates = nil
+		tlsClientConf.GetClientCertificate = connectOpts.clientCertFiles.GetClientCertificate
 	}
 
-	if err != nil {
-		return nil, errors.Wrap(err, "creating client proxy")
+	authority, host := connectOpts.authorityAndHost(ep.authority, tlsClientConf)
+	// In particular when gRPC name resolution is used, the proxies connect to IP addresses, so the certificate must
+	// be verified against the host name of the authority by default.
+	tlsClientConf = connectOpts.withServerName(tlsClientConf, hostOf(authority))
+
+	if connectOpts.verifyCapabilities {
+		if ep.resolve {
+			return nil, errors.Errorf("verifying the capabilities of gRPC target URI %q is not supported", endpoint)
+		}
+		caps, err := fetchServerCapabilities(ctx, ep.addr, host, tlsClientConf, &connectOpts)
+		if err != nil && !errors.Is(err, ErrNoCapabilities) {
+			return nil, err
+		}
+		if caps != nil {
+			if err := caps.checkCompatibility(&connectOpts); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return dialGRPCServer(ctx, proxy, makeDialOpts(endpoint, dialCtx, tlsClientConf, connectOpts))
+	pool := newProxyPool(func(addr string) *proxyServer {
+		return createProxy(addr, host, tlsClientConf, &connectOpts)
+	})
+	// gRPC target URIs are resolved via gRPC name resolution, with a proxy for every resolved address, whereas all
+	// other endpoints are connected to directly.
+	if ep.resolve {
+		return dialGRPCServer(ctx, ep.addr, pool, makeDialOpts(pool.dial, authority, tlsClientConf, connectOpts))
+	}
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return pool.dial(ctx, ep.addr)
+	}
+	return dialGRPCServer(ctx, pipeTarget, pool, makeDialOpts(dialer, authority, tlsClientConf, connectOpts))
 }
 
-func makeProxyServer(handler http.Handler) (*http.Server, pipeconn.DialContextFunc, error) {
-	lis, dialCtx := pipeconn.NewPipeListener()
-
-	var http2Srv http2.Server
-	srv := &http.Server{
-		Addr:    lis.Addr().String(),
-		Handler: h2c.NewHandler(nonBufferingHandler(handler), &http2Srv),
+// resolverTargetAuthority checks whether the endpoint is a gRPC target URI (`scheme://[authority]/endpoint`) and, if
+// so, returns the endpoint part of it, which is what gRPC uses as the default authority.
+func resolverTargetAuthority(endpoint string) (string, bool) {
+	if !strings.Contains(endpoint, "://") {
+		return "", false
 	}
-	if err := http2.ConfigureServer(srv, &http2Srv); err != nil {
-		return nil, nil, errors.Wrap(err, "configuring HTTP/2 server")
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" {
+		return "", false
 	}
+	path := u.Path
+	if path == "" {
+		path = u.Opaque
+	}
+	return strings.TrimPrefix(path, "/"), true
+}
 
-	go func() {
-		if err := srv.Serve(lis); err != nil && err != http.ErrServerClosed {
-			glog.Warningf("Unexpected error returned from serving gRPC proxy server: %v", err)
-		}
-	}()
+func hostOf(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
 
-	return srv, dialCtx, nil
+// createProxy creates a client proxy forwarding requests to the given address, using the given Host header.
+func createProxy(addr, host string, tlsClientConf *tls.Config, connectOpts *connectOptions) *proxyServer {
+	var tlsConf *tls.Config
+	if tlsClientConf != nil {
+		tlsConf = tlsClientConf.Clone()
+		// WebSockets over HTTP/2 share the HTTP/2 connection, and HTTP/1.1 upgrades use connections of their own.
+		useHTTP1WebSocket := connectOpts.useWebSocket && !connectOpts.webSocketOverHTTP2
+		tlsConf.NextProtos = nextProtos(tlsClientConf, connectOpts.forceHTTP2 && !connectOpts.useWebSocket, useHTTP1WebSocket)
+	}
+	return newProxyServer(addr, tlsConf, newDialer(tlsClientConf, connectOpts), func(dialTLS tlsDialFunc) (http.Handler, idleConnCloser, error) {
+		createHandler := createClientProxyHandler
+		if connectOpts.useWebSocket {
+			createHandler = createClientWSProxyHandler
+		}
+		handler, transport, err := createHandler(addr, host, tlsClientConf, connectOpts, dialTLS)
+		if err != nil {
+			return nil, nil, err
+		}
+		return withServerStreamingMark(handler), transport, nil
+	})
 }
 
-func makeDialOpts(endpoint string, dialCtx pipeconn.DialContextFunc, tlsClientConf *tls.Config, connectOpts connectOptions) []grpc.DialOption {
-	dialOpts := make([]grpc.DialOption, 0, len(connectOpts.dialOpts)+2)
-	dialOpts = append(dialOpts, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
-		return dialCtx(ctx)
-	}))
+func makeDialOpts(dialer func(context.Context, string) (net.Conn, error), authority string, tlsClientConf *tls.Config, connectOpts connectOptions) []grpc.DialOption {
+	dialOpts := make([]grpc.DialOption, 0, len(connectOpts.dialOpts)+5)
+	dialOpts = append(dialOpts, grpc.WithContextDialer(dialer), grpc.WithAuthority(authority),
+		grpc.WithChainUnaryInterceptor(transportInfoUnaryInterceptor),
+		grpc.WithChainStreamInterceptor(transportInfoStreamInterceptor, serverStreamingInterceptor))
 	if tlsClientConf != nil {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(newCredsFromSideChannel(endpoint, credentials.NewTLS(tlsClientConf))))
+		creds := connectOpts.transportCreds
+		if creds == nil {
+			creds = credentials.NewTLS(tlsClientConf)
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(newProxyCreds(creds)))
 	}
 	dialOpts = append(dialOpts, connectOpts.dialOpts...)
 
 	return dialOpts
 }
 
-func dialGRPCServer(ctx context.Context, proxy *http.Server, dialOpts []grpc.DialOption) (*grpc.ClientConn, error) {
-	cc, err := grpc.DialContext(ctx, proxy.Addr, dialOpts...)
+func dialGRPCServer(ctx context.Context, target string, pool *proxyPool, dialOpts []grpc.DialOption) (*ProxyConn, error) {
+	cc, err := grpc.DialContext(ctx, target, dialOpts...)
 	if err != nil {
-		_ = proxy.Close()
+		pool.Close()
 		return nil, err
 	}
-	go closeServerOnConnShutdown(proxy, cc)
-	return cc, nil
+	return &ProxyConn{
+		ClientConn: cc,
+		pool:       pool,
+	}, nil
 }
 
-func closeServerOnConnShutdown(srv *http.Server, cc *grpc.ClientConn) {
-	for state := cc.GetState(); state != connectivity.Shutdown; state = cc.GetState() {
-		cc.WaitForStateChange(context.Background(), state)
-	}
-	if err := srv.Close(); err != nil {
-		glog.Warningf("Error closing gRPC proxy server: %v", err)
+func closeOnConnShutdown(conn *ProxyConn) {
+	for state := conn.GetState(); state != connectivity.Shutdown; state = conn.GetState() {
+		conn.WaitForStateChange(context.Background(), state)
 	}
+	conn.pool.Close()
 }
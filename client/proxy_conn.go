@@ -0,0 +1,48 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"sync"
+
+	"google.golang.org/grpc"
+)
+
+// ProxyConn is a gRPC client connection via a client-side proxy, as returned by DialViaProxy. It embeds the
+// `*grpc.ClientConn`, and can hence be used wherever a gRPC client connection is expected.
+//
+// Unlike for connections returned by ConnectViaProxy, the proxy does not watch the state of the gRPC connection.
+// Instead, Close must be called to release the resources of the proxy, such as its goroutines and the idle
+// connections of its HTTP transports.
+type ProxyConn struct {
+	*grpc.ClientConn
+
+	pool *proxyPool
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Close closes the gRPC client connection and shuts down the proxy. It returns once all goroutines of the proxy have
+// returned, and all of its connections to the server have been closed. Calls that are still in flight fail with
+// status `Canceled`.
+func (c *ProxyConn) Close() error {
+	c.closeOnce.Do(func() {
+		// Closing the gRPC connection first closes all connections to the proxy, which aborts in-flight requests.
+		c.closeErr = c.ClientConn.Close()
+		c.pool.Close()
+	})
+	return c.closeErr
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/credentials"
+)
+
+// proxyCreds implements gRPC transport credentials for connections to the client proxy. They do not modify the
+// connection passed to `ClientHandshake`, but have the session serving it establish a TLS connection to the server,
+// and report the `AuthInfo` of that connection. The session subsequently uses the connection for forwarding
+// requests.
+type proxyCreds struct {
+	credentials.TransportCredentials
+}
+
+// newProxyCreds returns credentials for connections to the client proxy. The given credentials only determine the
+// protocol info reported to gRPC; the TLS connections themselves are established by the sessions' dialer.
+func newProxyCreds(creds credentials.TransportCredentials) credentials.TransportCredentials {
+	return &proxyCreds{
+		TransportCredentials: creds,
+	}
+}
+
+func (c *proxyCreds) ClientHandshake(ctx context.Context, _ string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, ok := rawConn.(*sessionConn)
+	if !ok {
+		return nil, nil, errors.Errorf("unexpected connection of type %T to client proxy", rawConn)
+	}
+	authInfo, err := conn.session.handshake(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawConn, authInfo, nil
+}
+
+// Info returns the protocol info of the underlying credentials. The server name is omitted, as the authority of the
+// gRPC connection is determined by the client proxy (see `WithAuthority`).
+func (c *proxyCreds) Info() credentials.ProtocolInfo {
+	info := c.TransportCredentials.Info()
+	// ServerName is deprecated, but still honored by gRPC.
+	info.ServerName = ""
+	return info
+}
+
+func (c *proxyCreds) Clone() credentials.TransportCredentials {
+	return &proxyCreds{
+		TransportCredentials: c.TransportCredentials.Clone(),
+	}
+}
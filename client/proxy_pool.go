@@ -0,0 +1,217 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/pipeconn"
+)
+
+var (
+	errPoolClosed = errors.New("client proxy has been shut down")
+	// errProxyRetired indicates that a client proxy has been removed from its pool because it had no sessions left.
+	errProxyRetired = errors.New("client proxy has been retired")
+)
+
+// idleConnCloser is implemented by HTTP transports and clients that keep connections open.
+type idleConnCloser interface {
+	CloseIdleConnections()
+}
+
+// closeableTransport is an HTTP transport that allows closing its idle connections.
+type closeableTransport interface {
+	http.RoundTripper
+	idleConnCloser
+}
+
+// proxyServer is a client proxy forwarding requests to a single backend address. Every connection to it is served by
+// a separate session.
+type proxyServer struct {
+	addr       string
+	tlsConf    *tls.Config
+	dialer     *dialer
+	newHandler handlerFactory
+	// onIdle is called once the last session has ended, after which the proxy is retired and cannot be dialed anymore.
+	onIdle func()
+
+	mutex    sync.Mutex
+	sessions map[*session]net.Conn
+	closed   bool
+	retired  bool
+	wg       sync.WaitGroup
+}
+
+func newProxyServer(addr string, tlsConf *tls.Config, d *dialer, newHandler handlerFactory) *proxyServer {
+	return &proxyServer{
+		addr:       addr,
+		tlsConf:    tlsConf,
+		dialer:     d,
+		newHandler: newHandler,
+		sessions:   make(map[*session]net.Conn),
+	}
+}
+
+// dial creates a new session and returns a connection to it. The returned connection is a `*sessionConn`.
+func (p *proxyServer) dial(ctx context.Context) (net.Conn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, errPoolClosed
+	}
+	if p.retired {
+		return nil, errProxyRetired
+	}
+
+	s, err := newSession(p.addr, p.tlsConf, p.dialer, p.newHandler)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating client proxy for %s", p.addr)
+	}
+	lis, dialCtx := pipeconn.NewPipeListener()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		s.serve(lis)
+
+		p.mutex.Lock()
+		delete(p.sessions, s)
+		idle := len(p.sessions) == 0 && !p.closed
+		if idle {
+			p.retired = true
+		}
+		p.mutex.Unlock()
+
+		if idle && p.onIdle != nil {
+			p.onIdle()
+		}
+	}()
+
+	conn, err := dialCtx(ctx)
+	if err != nil {
+		_ = lis.Close()
+		return nil, err
+	}
+	p.sessions[s] = conn
+	return &sessionConn{Conn: conn, session: s}, nil
+}
+
+func (p *proxyServer) isRetired() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.retired
+}
+
+// Close closes all connections to the proxy, and waits for all sessions to finish.
+func (p *proxyServer) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	for _, conn := range p.sessions {
+		_ = conn.Close()
+	}
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+}
+
+// proxyFactory creates a client proxy forwarding requests to the given backend address.
+type proxyFactory func(addr string) *proxyServer
+
+// proxyPool manages one client proxy per backend address. When gRPC name resolution is used, every resolved address
+// gets its own proxy, such that gRPC load balancing works across the real backends. Proxies are removed from the pool
+// once their last session has ended, such that the pool does not grow with every address ever resolved.
+type proxyPool struct {
+	newProxy proxyFactory
+
+	mutex   sync.Mutex
+	proxies map[string]*proxyServer
+	closed  bool
+
+	closeOnce sync.Once
+}
+
+func newProxyPool(newProxy proxyFactory) *proxyPool {
+	return &proxyPool{
+		newProxy: newProxy,
+		proxies:  make(map[string]*proxyServer),
+	}
+}
+
+func (p *proxyPool) get(addr string) (*proxyServer, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, errPoolClosed
+	}
+	if proxy := p.proxies[addr]; proxy != nil && !proxy.isRetired() {
+		return proxy, nil
+	}
+
+	proxy := p.newProxy(addr)
+	proxy.onIdle = func() {
+		p.remove(addr, proxy)
+	}
+	p.proxies[addr] = proxy
+	return proxy, nil
+}
+
+// remove removes the given proxy for the given backend address from the pool, unless it has been replaced already.
+func (p *proxyPool) remove(addr string, proxy *proxyServer) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.proxies[addr] == proxy {
+		delete(p.proxies, addr)
+	}
+}
+
+// dial establishes a connection to the client proxy for the given backend address, creating the proxy if necessary.
+// The returned connection is a `*sessionConn`.
+func (p *proxyPool) dial(ctx context.Context, addr string) (net.Conn, error) {
+	for {
+		proxy, err := p.get(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := proxy.dial(ctx)
+		if err == errProxyRetired {
+			// The last session of the proxy ended after it was looked up, hence the next lookup replaces it.
+			continue
+		}
+		return conn, err
+	}
+}
+
+// Close shuts down all client proxies in the pool, and waits for their goroutines to return. It is safe to call
+// Close multiple times, and concurrently.
+func (p *proxyPool) Close() {
+	p.closeOnce.Do(func() {
+		p.mutex.Lock()
+		p.closed = true
+		proxies := p.proxies
+		p.proxies = nil
+		p.mutex.Unlock()
+
+		for _, proxy := range proxies {
+			proxy.Close()
+		}
+	})
+}
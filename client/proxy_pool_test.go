@@ -0,0 +1,86 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type noopIdleConnCloser struct{}
+
+func (noopIdleConnCloser) CloseIdleConnections() {}
+
+func newTestProxyPool() (*proxyPool, *int) {
+	created := 0
+	return newProxyPool(func(addr string) *proxyServer {
+		created++
+		return newProxyServer(addr, nil, nil, func(tlsDialFunc) (http.Handler, idleConnCloser, error) {
+			return http.NotFoundHandler(), noopIdleConnCloser{}, nil
+		})
+	}), &created
+}
+
+func (p *proxyPool) numProxies() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.proxies)
+}
+
+func TestProxyPoolRemovesIdleProxies(t *testing.T) {
+	pool, created := newTestProxyPool()
+	defer pool.Close()
+	ctx := context.Background()
+
+	// Sessions for the same address share a proxy, which is kept as long as any of them is open.
+	conn1, err := pool.dial(ctx, "10.0.0.1:443")
+	require.NoError(t, err)
+	conn2, err := pool.dial(ctx, "10.0.0.1:443")
+	require.NoError(t, err)
+	conn3, err := pool.dial(ctx, "10.0.0.2:443")
+	require.NoError(t, err)
+	assert.Equal(t, 2, *created)
+	assert.Equal(t, 2, pool.numProxies())
+
+	require.NoError(t, conn1.Close())
+	require.NoError(t, conn3.Close())
+	assert.Eventually(t, func() bool { return pool.numProxies() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, conn2.Close())
+	assert.Eventually(t, func() bool { return pool.numProxies() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// Addresses that are dialed again get a new proxy.
+	conn, err := pool.dial(ctx, "10.0.0.1:443")
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	assert.Equal(t, 3, *created)
+	assert.Equal(t, 1, pool.numProxies())
+}
+
+func TestProxyPoolClosed(t *testing.T) {
+	pool, _ := newTestProxyPool()
+	conn, err := pool.dial(context.Background(), "10.0.0.1:443")
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	pool.Close()
+	_, err = pool.dial(context.Background(), "10.0.0.1:443")
+	assert.ErrorIs(t, err, errPoolClosed)
+}
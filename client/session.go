@@ -0,0 +1,237 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/pipeconn"
+	"google.golang.org/grpc/credentials"
+)
+
+// tlsDialFunc establishes a TLS connection to the given address.
+type tlsDialFunc func(ctx context.Context, addr string) (tlsConn, error)
+
+// handlerFactory creates the handler of a session, which forwards requests using connections established via the
+// given function, along with the transport the handler uses.
+type handlerFactory func(dialTLS tlsDialFunc) (http.Handler, idleConnCloser, error)
+
+// session is the part of a client proxy that serves a single gRPC transport connection. Every session has its own
+// HTTP transport. This way, the TLS connection state reported to gRPC for a transport connection (see `proxyCreds`)
+// is the one of the connection(s) actually used to forward its streams.
+type session struct {
+	addr    string
+	tlsConf *tls.Config
+	dialer  *dialer
+
+	handler   http.Handler
+	transport idleConnCloser
+	handlers  sync.WaitGroup
+
+	srv       *http.Server
+	drainOnce sync.Once
+
+	mutex sync.Mutex
+	// handshakeConn is the connection established for the TLS handshake requested by gRPC. It is used by the first
+	// connection attempt of the transport.
+	handshakeConn tlsConn
+	peerCert      *x509.Certificate
+}
+
+func newSession(addr string, tlsConf *tls.Config, d *dialer, newHandler handlerFactory) (*session, error) {
+	s := &session{
+		addr:    addr,
+		tlsConf: tlsConf,
+		dialer:  d,
+	}
+	handler, transport, err := newHandler(s.dialTLS)
+	if err != nil {
+		return nil, err
+	}
+	s.handler, s.transport = handler, transport
+	return s, nil
+}
+
+// serve serves the gRPC transport connection accepted from the given listener. It returns once the connection has
+// been closed, all requests have been handled, and all connections to the server have been closed.
+func (s *session) serve(lis net.Listener) {
+	defer s.cleanup()
+
+	conn, err := lis.Accept()
+	_ = lis.Close()
+	if err != nil {
+		if err != pipeconn.ErrClosed {
+			glog.Warningf("Unexpected error accepting connection to gRPC proxy: %v", err)
+		}
+		return
+	}
+
+	// gRPC always uses HTTP/2 with prior knowledge. The connection is served by a regular HTTP server (as opposed to
+	// `http2.Server.ServeConn`), such that shutting down the server gracefully sends a GOAWAY frame to gRPC.
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	connLis := newConnListener(conn)
+	connClosed := make(chan struct{})
+	s.srv = &http.Server{
+		Handler:   s.track(nonBufferingHandler(s.handler)),
+		Protocols: &protocols,
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed {
+				close(connClosed)
+				_ = connLis.Close()
+			}
+		},
+	}
+	if err := s.srv.Serve(connLis); err != nil && err != http.ErrServerClosed && err != net.ErrClosed {
+		glog.Warningf("Unexpected error returned from serving gRPC proxy connection: %v", err)
+	}
+	<-connClosed
+}
+
+// track wraps the given handler such that cleanup waits for all its invocations to return.
+func (s *session) track(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.handlers.Add(1)
+		defer s.handlers.Done()
+		handler.ServeHTTP(w, req)
+	})
+}
+
+func (s *session) cleanup() {
+	s.handlers.Wait()
+	s.transport.CloseIdleConnections()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.handshakeConn != nil {
+		_ = s.handshakeConn.Close()
+		s.handshakeConn = nil
+	}
+}
+
+// drain asks gRPC to stop using this session for new streams. gRPC will establish a new transport connection, and
+// hence a new session, while the streams in flight are completed.
+func (s *session) drain() {
+	s.drainOnce.Do(func() {
+		// Shutting down the server sends a GOAWAY frame to the gRPC client. drain is only called from handlers, so
+		// tracking the shutdown as a handler is safe, and makes cleanup wait for it.
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			_ = s.srv.Shutdown(context.Background())
+		}()
+	})
+}
+
+// handshake establishes a TLS connection to the server on behalf of gRPC, and returns its auth info. The connection
+// is subsequently used for forwarding requests.
+func (s *session) handshake(ctx context.Context) (credentials.AuthInfo, error) {
+	if s.tlsConf == nil {
+		return nil, errors.New("TLS handshake requested for a plaintext connection")
+	}
+	conn, err := s.dialer.DialTLSContext(ctx, s.addr, s.tlsConf)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.handshakeConn != nil {
+		_ = s.handshakeConn.Close()
+	}
+	s.handshakeConn = conn
+	s.peerCert = leafCertificate(conn.ConnectionState())
+
+	return authInfoOf(conn), nil
+}
+
+// dialTLS establishes a TLS connection for the transport of the session. If the server presents a different
+// certificate than during the handshake requested by gRPC, e.g., because the certificate was rotated, or because a
+// load balancer forwarded the connection to a different backend, the session is drained such that the auth info
+// gRPC reports is refreshed.
+func (s *session) dialTLS(ctx context.Context, addr string) (tlsConn, error) {
+	s.mutex.Lock()
+	conn, peerCert := s.handshakeConn, s.peerCert
+	s.handshakeConn = nil
+	s.mutex.Unlock()
+
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := s.dialer.DialTLSContext(ctx, addr, s.tlsConf)
+	if err != nil {
+		return nil, err
+	}
+	if cert := leafCertificate(conn.ConnectionState()); peerCert != nil && (cert == nil || !cert.Equal(peerCert)) {
+		glog.V(1).Infof("Server %s presented a different certificate than during the gRPC handshake; reconnecting to refresh the auth info", addr)
+		s.drain()
+	}
+	return conn, nil
+}
+
+func leafCertificate(state tls.ConnectionState) *x509.Certificate {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// sessionConn is a gRPC transport connection to a session of a client proxy.
+type sessionConn struct {
+	net.Conn
+	session *session
+}
+
+// connListener is a listener that returns a single connection. Once that connection has been accepted, Accept blocks
+// until the listener is closed.
+type connListener struct {
+	conn      net.Conn
+	accepted  bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if !l.accepted {
+		l.accepted = true
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// transportInfoHeaderKey is the response header in which the client proxy tells the gRPC client how a call was
+	// transported, e.g., `websocket; proto="HTTP/1.1"; subprotocol=grpc-ws.v2`.
+	transportInfoHeaderKey = "Grpchttp1-Transport"
+)
+
+// Transport is the way the client proxy transported a gRPC call to the server.
+type Transport int
+
+const (
+	// TransportGRPC is a regular gRPC call, which usually is an HTTP/2 request.
+	TransportGRPC Transport = iota + 1
+	// TransportGRPCWeb is a call whose response was downgraded to gRPC-Web by the server.
+	TransportGRPCWeb
+	// TransportWebSocket is a call via a WebSocket.
+	TransportWebSocket
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportGRPC:
+		return "grpc"
+	case TransportGRPCWeb:
+		return "grpc-web"
+	case TransportWebSocket:
+		return "websocket"
+	}
+	return fmt.Sprintf("Transport(%d)", int(t))
+}
+
+func parseTransport(s string) Transport {
+	for t := TransportGRPC; t <= TransportWebSocket; t++ {
+		if t.String() == s {
+			return t
+		}
+	}
+	return 0
+}
+
+// TransportInfo describes how the client proxy transported a gRPC call to the server.
+type TransportInfo struct {
+	Transport Transport
+	// Proto is the protocol of the HTTP response of the server, e.g., "HTTP/1.1". For calls via WebSockets, it is the
+	// protocol of the WebSocket handshake, i.e., "HTTP/2.0" for extended CONNECT requests.
+	Proto string
+	// Downgraded indicates that the server sent the response in the gRPC-Web format.
+	Downgraded bool
+	// Subprotocol is the negotiated WebSocket subprotocol of calls via WebSockets, e.g., "grpc-ws.v2".
+	Subprotocol string
+}
+
+// CallTransportInfo returns a call option that stores how the call was transported to the server in info, once the
+// response headers have been received. Like for grpc.Peer, info is only populated for calls that reached the server.
+// For calls with this option, it is also conveyed as "grpchttp1-transport" header metadata, which is hidden from all
+// other calls.
+//
+// The call option only has an effect on connections created via ConnectViaProxy or DialViaProxy.
+func CallTransportInfo(info *TransportInfo) grpc.CallOption {
+	return transportInfoCallOption{info: info}
+}
+
+type transportInfoCallOption struct {
+	grpc.EmptyCallOption
+	info *TransportInfo
+}
+
+func setTransportInfoHeader(header http.Header, info *TransportInfo) {
+	params := map[string]string{"proto": info.Proto}
+	if info.Subprotocol != "" {
+		params["subprotocol"] = info.Subprotocol
+	}
+	header.Set(transportInfoHeaderKey, mime.FormatMediaType(info.Transport.String(), params))
+}
+
+// transportInfoFromHeader returns the transport info in the given response header metadata of a call, if any.
+func transportInfoFromHeader(md metadata.MD) (*TransportInfo, bool) {
+	values := md.Get(transportInfoHeaderKey)
+	if len(values) == 0 {
+		return nil, false
+	}
+	transport, params, err := mime.ParseMediaType(values[0])
+	if err != nil {
+		return nil, false
+	}
+	info := &TransportInfo{
+		Transport:   parseTransport(transport),
+		Proto:       params["proto"],
+		Subprotocol: params["subprotocol"],
+	}
+	info.Downgraded = info.Transport == TransportGRPCWeb
+	return info, true
+}
+
+// transportInfoTargets returns the transport infos to populate for a call with the given options.
+func transportInfoTargets(opts []grpc.CallOption) []*TransportInfo {
+	var targets []*TransportInfo
+	for _, opt := range opts {
+		if o, ok := opt.(transportInfoCallOption); ok && o.info != nil {
+			targets = append(targets, o.info)
+		}
+	}
+	return targets
+}
+
+// stripTransportInfo removes the transport info from the header metadata stored via grpc.Header call options, such that
+// it is only visible to calls with the CallTransportInfo option.
+func stripTransportInfo(opts []grpc.CallOption) {
+	for _, opt := range opts {
+		if o, ok := opt.(grpc.HeaderCallOption); ok && o.HeaderAddr != nil {
+			o.HeaderAddr.Delete(transportInfoHeaderKey)
+		}
+	}
+}
+
+func storeTransportInfo(md metadata.MD, targets []*TransportInfo) {
+	info, ok := transportInfoFromHeader(md)
+	if !ok {
+		return
+	}
+	for _, target := range targets {
+		*target = *info
+	}
+}
+
+// transportInfoUnaryInterceptor populates the transport infos of unary calls with the CallTransportInfo option, and
+// hides them from other unary calls.
+func transportInfoUnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	targets := transportInfoTargets(opts)
+	if len(targets) == 0 {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		stripTransportInfo(opts)
+		return err
+	}
+	var md metadata.MD
+	err := invoker(ctx, method, req, reply, cc, append(opts, grpc.Header(&md))...)
+	storeTransportInfo(md, targets)
+	return err
+}
+
+// transportInfoStreamInterceptor populates the transport infos of streaming calls with the CallTransportInfo option,
+// once the response headers have been obtained via Header or the first call to RecvMsg has returned. For other
+// streaming calls, the transport info is hidden from the header metadata.
+func transportInfoStreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	targets := transportInfoTargets(opts)
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		stripTransportInfo(opts)
+		return stream, err
+	}
+	if len(targets) == 0 {
+		return &strippedTransportInfoStream{ClientStream: stream, opts: opts}, nil
+	}
+	return &transportInfoStream{ClientStream: stream, targets: targets}, nil
+}
+
+type transportInfoStream struct {
+	grpc.ClientStream
+	targets []*TransportInfo
+	stored  atomic.Bool
+}
+
+func (s *transportInfoStream) Header() (metadata.MD, error) {
+	md, err := s.ClientStream.Header()
+	if err == nil && s.stored.CompareAndSwap(false, true) {
+		storeTransportInfo(md, s.targets)
+	}
+	return md, err
+}
+
+func (s *transportInfoStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	// Once RecvMsg has returned, the headers have either been received or will never be, hence Header does not block.
+	if !s.stored.Load() {
+		_, _ = s.Header()
+	}
+	return err
+}
+
+// strippedTransportInfoStream hides the transport info from the header metadata of a streaming call. The header
+// metadata stored via grpc.Header call options is set once the call has ended, i.e., once a method returns an error.
+type strippedTransportInfoStream struct {
+	grpc.ClientStream
+	opts []grpc.CallOption
+}
+
+func (s *strippedTransportInfoStream) Header() (metadata.MD, error) {
+	md, err := s.ClientStream.Header()
+	md.Delete(transportInfoHeaderKey)
+	if err != nil || md == nil {
+		stripTransportInfo(s.opts)
+	}
+	return md, err
+}
+
+func (s *strippedTransportInfoStream) SendMsg(m interface{}) error {
+	err := s.ClientStream.SendMsg(m)
+	if err != nil {
+		stripTransportInfo(s.opts)
+	}
+	return err
+}
+
+func (s *strippedTransportInfoStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil {
+		stripTransportInfo(s.opts)
+	}
+	return err
+}
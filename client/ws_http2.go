@@ -0,0 +1,244 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/h2connect"
+)
+
+const (
+	// webSocketGUID is the GUID from which the Sec-WebSocket-Accept header of a handshake response is derived
+	// (RFC 6455, section 4.2.2).
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+var (
+	errHTTP2NotNegotiated = errors.New("server did not negotiate HTTP/2")
+	errHTTP2Negotiated    = errors.New("server negotiated HTTP/2")
+)
+
+// webSocketTransport performs WebSocket handshakes via extended CONNECT requests (RFC 8441), such that the WebSockets
+// of all calls are streams of a single HTTP/2 connection. Responses are presented to the WebSocket library as if they
+// were HTTP/1.1 upgrade responses. If the server does not support extended CONNECT, i.e., if it does not negotiate
+// HTTP/2 or does not enable extended CONNECT via SETTINGS_ENABLE_CONNECT_PROTOCOL, the transport falls back to
+// HTTP/1.1 upgrades for this and all subsequent handshakes.
+type webSocketTransport struct {
+	h2     *h2connect.Transport
+	h1     closeableTransport
+	h1Only atomic.Bool
+}
+
+func (t *webSocketTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.h1Only.Load() {
+		resp, err := roundTripExtendedConnect(t.h2, req)
+		if !isExtendedConnectUnsupported(err) {
+			return resp, err
+		}
+		glog.V(1).Infof("Server %s does not support WebSockets over HTTP/2, falling back to HTTP/1.1 upgrades: %v", req.URL.Host, err)
+		t.h1Only.Store(true)
+	}
+	return t.h1.RoundTrip(req)
+}
+
+func (t *webSocketTransport) CloseIdleConnections() {
+	t.h2.CloseIdleConnections()
+	t.h1.CloseIdleConnections()
+}
+
+// negotiatedWebSocketTransport performs WebSocket handshakes via HTTP/1.1 upgrades on connections secured with
+// transport credentials, which determine the ALPN protocols offered to the server themselves. If the server negotiates
+// HTTP/2 nonetheless, the connection is used for extended CONNECT requests (RFC 8441) instead, and so are the
+// connections of all subsequent handshakes.
+type negotiatedWebSocketTransport struct {
+	h1      *http.Transport
+	h2      *h2connect.Transport
+	h2Conns *connHandoff
+	useH2   atomic.Bool
+}
+
+func (t *negotiatedWebSocketTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.useH2.Load() {
+		resp, err := t.h1.RoundTrip(req)
+		if !errors.Is(err, errHTTP2Negotiated) {
+			return resp, err
+		}
+		glog.V(1).Infof("Server %s negotiated HTTP/2, performing WebSocket handshakes via extended CONNECT requests", req.URL.Host)
+		t.useH2.Store(true)
+	}
+	resp, err := roundTripExtendedConnect(t.h2, req)
+	if errors.Is(err, h2connect.ErrExtendedConnectNotSupported) {
+		return nil, errors.Wrapf(err, "server %s negotiated HTTP/2, but WebSockets over HTTP/2 are not supported; "+
+			"the transport credentials must not offer \"h2\"", req.URL.Host)
+	}
+	return resp, err
+}
+
+func (t *negotiatedWebSocketTransport) CloseIdleConnections() {
+	t.h1.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+	t.h2Conns.closeAll()
+}
+
+// connHandoff holds connections on which the server negotiated HTTP/2 during a dial for an HTTP/1.1 upgrade, until
+// the HTTP/2 transport picks them up.
+type connHandoff struct {
+	mutex sync.Mutex
+	conns map[string][]net.Conn
+}
+
+func (h *connHandoff) put(addr string, conn net.Conn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.conns == nil {
+		h.conns = make(map[string][]net.Conn)
+	}
+	h.conns[addr] = append(h.conns[addr], conn)
+}
+
+// take returns a connection to the given address, or nil if there is none.
+func (h *connHandoff) take(addr string) net.Conn {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	conns := h.conns[addr]
+	if len(conns) == 0 {
+		return nil
+	}
+	if len(conns) == 1 {
+		delete(h.conns, addr)
+	} else {
+		h.conns[addr] = conns[1:]
+	}
+	return conns[0]
+}
+
+func (h *connHandoff) closeAll() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, conns := range h.conns {
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	}
+	h.conns = nil
+}
+
+// roundTripExtendedConnect performs the handshake of the given HTTP/1.1 WebSocket upgrade request via an extended
+// CONNECT request. A successful response is turned into an upgrade response, whose body is the bidirectional stream
+// of the WebSocket connection. Other responses are returned as-is.
+func roundTripExtendedConnect(h2 *h2connect.Transport, req *http.Request) (*http.Response, error) {
+	connectReq := req.Clone(req.Context())
+	connectReq.Method = http.MethodConnect
+	key := connectReq.Header.Get("Sec-Websocket-Key")
+	connectReq.Header.Del("Connection")
+	connectReq.Header.Del("Upgrade")
+	connectReq.Header.Del("Sec-Websocket-Key")
+	connectReq.Header.Set(":protocol", "websocket")
+
+	bodyReader, bodyWriter := io.Pipe()
+	connectReq.Body, connectReq.GetBody, connectReq.ContentLength = bodyReader, nil, -1
+
+	resp, err := h2.RoundTrip(connectReq)
+	if err != nil {
+		_ = bodyWriter.Close()
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		_ = bodyWriter.Close()
+		return resp, nil
+	}
+
+	resp.StatusCode, resp.Status = http.StatusSwitchingProtocols, "101 Switching Protocols"
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", "websocket")
+	resp.Header.Set("Sec-Websocket-Accept", webSocketAccept(key))
+	resp.Body = &webSocketStream{ReadCloser: resp.Body, writer: bodyWriter}
+	return resp, nil
+}
+
+// isExtendedConnectUnsupported checks whether an extended CONNECT request failed because the server does not
+// support it.
+func isExtendedConnectUnsupported(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, errHTTP2NotNegotiated) || errors.Is(err, h2connect.ErrExtendedConnectNotSupported)
+}
+
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	_, _ = h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// webSocketStream is the bidirectional stream of a WebSocket connection over HTTP/2, consisting of the response body
+// for reading, and the request body for writing.
+type webSocketStream struct {
+	io.ReadCloser
+	writer *io.PipeWriter
+}
+
+func (s *webSocketStream) Write(p []byte) (int, error) {
+	return s.writer.Write(p)
+}
+
+func (s *webSocketStream) Close() error {
+	_ = s.writer.Close()
+	return s.ReadCloser.Close()
+}
+
+// newHTTP2WebSocketTransport creates the HTTP/2 transport for extended CONNECT requests. If TLS is used, connections
+// are taken from h2Conns (if non-nil), or established via dialTLS, or via a dialer for the given connect options if
+// dialTLS is nil, and must negotiate HTTP/2. Otherwise, HTTP/2 is spoken with prior knowledge.
+func newHTTP2WebSocketTransport(tlsClientConf *tls.Config, connectOpts *connectOptions, dialTLS tlsDialFunc, h2Conns *connHandoff) *h2connect.Transport {
+	dialContext := newDialer(tlsClientConf, connectOpts).DialContext
+	if tlsClientConf != nil && dialTLS == nil {
+		tlsConf := tlsClientConf.Clone()
+		tlsConf.NextProtos = nextProtos(tlsClientConf, false, false)
+		dialTLS = newTLSDialFunc(tlsConf, connectOpts)
+	}
+	return &h2connect.Transport{
+		DialConn: func(ctx context.Context, addr string) (net.Conn, error) {
+			if tlsClientConf == nil {
+				return dialContext(ctx, "tcp", addr)
+			}
+			if h2Conns != nil {
+				if conn := h2Conns.take(addr); conn != nil {
+					return conn, nil
+				}
+			}
+			conn, err := dialTLS(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			if proto := conn.ConnectionState().NegotiatedProtocol; proto != "h2" {
+				_ = conn.Close()
+				return nil, errors.Wrapf(errHTTP2NotNegotiated, "server %s negotiated %q", addr, proto)
+			}
+			return conn, nil
+		},
+	}
+}
@@ -15,25 +15,24 @@
 package client
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
-	"net/textproto"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/coder/websocket"
 	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"golang.stackrox.io/grpc-http1/internal/grpcproto"
 	"golang.stackrox.io/grpc-http1/internal/grpcwebsocket"
-	"golang.stackrox.io/grpc-http1/internal/httputils"
-	"golang.stackrox.io/grpc-http1/internal/pipeconn"
+	"golang.stackrox.io/grpc-http1/internal/headerpolicy"
 	"golang.stackrox.io/grpc-http1/internal/size"
 	"google.golang.org/grpc/codes"
 )
@@ -42,50 +41,91 @@ const (
 	name = "websocket-proxy"
 )
 
+const (
+	// cancelTimeout is the time given to notifying the server of a canceled call.
+	cancelTimeout = 5 * time.Second
+
+	// deadlineSlack accounts for the time the request takes from the gRPC client to the proxy when telling whether a
+	// call was canceled because its deadline was exceeded.
+	deadlineSlack = 10 * time.Millisecond
+)
+
 var (
-	subprotocols = []string{grpcwebsocket.SubprotocolName}
+	// subprotocols are offered in the order of preference. Servers that do not know version 2 of gRPC-websocket pick
+	// the original version.
+	subprotocols = []string{grpcwebsocket.SubprotocolNameV2, grpcwebsocket.SubprotocolName}
 )
 
 type http2WebSocketProxy struct {
 	insecure   bool
 	endpoint   string
+	host       string
+	pathPrefix string
 	httpClient *http.Client
+	keepalive  keepaliveParams
+	retry      webSocketRetryParams
+
+	headerPolicy   *headerpolicy.Policy
+	metadataLimits grpcproto.MetadataLimits
 }
 
 type websocketConn struct {
-	ctx  context.Context
-	conn *websocket.Conn
-	w    http.ResponseWriter
+	ctx context.Context
+	// ioCtx is the context of reading from and writing to the connection. Canceling it closes the connection right
+	// away, hence it is not canceled along with ctx if the call can be canceled via cancel frames.
+	ioCtx context.Context
+	conn  *websocket.Conn
+	w     http.ResponseWriter
+
+	headerPolicy   *headerpolicy.Policy
+	metadataLimits grpcproto.MetadataLimits
 
 	url string
 
+	// controlFrames indicates that version 2 of gRPC-websocket has been negotiated, hence the call can be aborted via
+	// cancel frames and close codes conveying gRPC status codes.
+	controlFrames bool
+	// completed is set once the response has been read completely, after which the call can no longer be canceled.
+	completed atomic.Bool
+
 	errFlag int32
 	err     error
 }
 
 // readHeader reads gRPC response headers. Trailers-Only messages are treated as response headers.
 func (c *websocketConn) readHeader() error {
-	mt, msg, err := c.conn.Read(c.ctx)
+	mt, msg, err := c.readMessage()
 	if err != nil {
-		return err
+		return c.classifyReadError(err)
 	}
 	if mt != websocket.MessageBinary {
-		return errors.Errorf("incorrect message type; expected MessageBinary but got %v", mt)
+		return errWebSocketMessageType(mt)
 	}
 
 	if err := grpcproto.ValidateGRPCFrame(msg); err != nil {
-		return err
+		return errMalformedWebSocketFrame(err)
+	}
+	if c.isCancelFrame(msg) {
+		return errCanceledByServer(msg)
 	}
 	if !grpcproto.IsMetadataFrame(msg) {
 		return errors.New("did not receive metadata message")
 	}
 
-	return setHeader(c.w, msg[grpcproto.MessageHeaderLength:], false)
+	return c.setHeader(msg[grpcproto.MessageHeaderLength:], false)
 }
 
 // Read gRPC response messages from the server and write them back to the gRPC client.
-func (c *websocketConn) readFromServer() error {
-	defer c.conn.CloseRead(c.ctx)
+func (c *websocketConn) readFromServer() (err error) {
+	defer c.conn.CloseRead(c.ioCtx)
+	defer func() {
+		// The server may still be sending messages after metadata exceeding the limits, which are not read anymore.
+		// Abort the call instead of waiting for it to complete.
+		var tErr *transportError
+		if errors.As(err, &tErr) && tErr.code == codes.ResourceExhausted {
+			c.abort(tErr.code, tErr.msg)
+		}
+	}()
 
 	// Handle normal and trailers-only messages.
 	// Treat trailers-only the same as a headers-only response.
@@ -106,10 +146,10 @@ func (c *websocketConn) readFromServer() error {
 	// When false, we expect EOF.
 	dataExpected := true
 	for {
-		mt, msg, err := c.conn.Read(c.ctx)
+		mt, msg, err := c.readMessage()
 		if err != nil {
 			if dataExpected {
-				return errors.Wrap(err, "reading response body")
+				return errors.Wrap(c.classifyReadError(err), "reading response body")
 			}
 
 			switch websocket.CloseStatus(err) {
@@ -128,11 +168,14 @@ func (c *websocketConn) readFromServer() error {
 			return errors.New("received message after receiving trailers")
 		}
 		if mt != websocket.MessageBinary {
-			return errors.Errorf("incorrect message type; expected MessageBinary but got %v", mt)
+			return errWebSocketMessageType(mt)
 		}
 
 		if err := grpcproto.ValidateGRPCFrame(msg); err != nil {
-			return err
+			return errMalformedWebSocketFrame(err)
+		}
+		if c.isCancelFrame(msg) {
+			return errCanceledByServer(msg)
 		}
 		if grpcproto.IsDataFrame(msg) {
 			if _, err := c.w.Write(msg); err != nil {
@@ -143,7 +186,7 @@ func (c *websocketConn) readFromServer() error {
 				return errors.New("compression flag is set; compressed metadata is not supported")
 			}
 			dataExpected = false
-			if err := setHeader(c.w, msg[grpcproto.MessageHeaderLength:], true); err != nil {
+			if err := c.setHeader(msg[grpcproto.MessageHeaderLength:], true); err != nil {
 				return err
 			}
 		} else {
@@ -152,21 +195,98 @@ func (c *websocketConn) readFromServer() error {
 	}
 }
 
-// Set the http.Header. If isTrailers is true, http.TrailerPrefix is prepended to each key.
-func setHeader(w http.ResponseWriter, msg []byte, isTrailers bool) error {
-	hdr, err := textproto.NewReader(
-		bufio.NewReader(
-			io.MultiReader(
-				bytes.NewReader(msg),
-				strings.NewReader("\r\n"),
-			),
-		),
-	).ReadMIMEHeader()
+// readMessage reads the next message from the server. The size declared by metadata frames is checked against the
+// limits before reading them, such that the server cannot make the client buffer arbitrarily large metadata.
+func (c *websocketConn) readMessage() (websocket.MessageType, []byte, error) {
+	mt, reader, err := c.conn.Reader(c.ioCtx)
 	if err != nil {
+		return 0, nil, err
+	}
+	var msg bytes.Buffer
+	if _, err := io.CopyN(&msg, reader, grpcproto.MessageHeaderLength); err != nil {
+		if err == io.EOF {
+			// Too short to be a gRPC frame, which is detected when validating the frame.
+			return mt, msg.Bytes(), nil
+		}
+		return 0, nil, err
+	}
+	if grpcproto.IsMetadataFrame(msg.Bytes()) {
+		_, length, _ := grpcproto.ParseMessageHeader(msg.Bytes())
+		if err := c.metadataLimits.CheckSize(int64(length)); err != nil {
+			// Discard the rest of the message without buffering it, such that the connection can still be closed
+			// gracefully.
+			_, _ = io.Copy(io.Discard, reader)
+			return 0, nil, newTransportError(codes.ResourceExhausted, "receiving metadata: %v", err)
+		}
+	}
+	if _, err := msg.ReadFrom(reader); err != nil {
+		return 0, nil, err
+	}
+	return mt, msg.Bytes(), nil
+}
+
+// classifyReadError names the likely cause of an error reading from the server, unless the error is the result
+// of the gRPC client going away.
+func (c *websocketConn) classifyReadError(err error) error {
+	if c.ctx.Err() != nil {
 		return err
 	}
+	if c.controlFrames && websocket.CloseStatus(err) != -1 {
+		st := grpcwebsocket.CloseErrorStatus(err)
+		return newTransportError(st.Code(), "server closed the WebSocket connection: %s", st.Message())
+	}
+	return classifyWebSocketReadError(err)
+}
+
+func (c *websocketConn) isCancelFrame(msg []byte) bool {
+	return c.controlFrames && grpcwebsocket.IsControlFrame(msg)
+}
+
+func errCanceledByServer(msg []byte) error {
+	st, err := grpcwebsocket.ParseCancelFrame(msg)
+	if err != nil {
+		return errMalformedWebSocketFrame(err)
+	}
+	return newTransportError(st.Code(), "call aborted by server: %s", st.Message())
+}
 
-	wHdr := w.Header()
+// cancel notifies the server that the call has been canceled by the gRPC client, either explicitly or because the
+// given deadline has been exceeded, and closes the connection.
+func (c *websocketConn) cancel(deadline time.Time, hasDeadline bool) {
+	if c.completed.Load() {
+		return
+	}
+	code, msg := codes.Canceled, "call canceled by client"
+	if hasDeadline && time.Until(deadline) < deadlineSlack {
+		code, msg = codes.DeadlineExceeded, "deadline exceeded"
+	}
+	glog.V(2).Infof("Canceling call to %q: %s", c.url, msg)
+	c.abort(code, msg)
+}
+
+// abort notifies the server that the call has been aborted with the given status, and closes the connection.
+func (c *websocketConn) abort(code codes.Code, msg string) {
+	if c.controlFrames {
+		ctx, cancel := context.WithTimeout(c.ioCtx, cancelTimeout)
+		defer cancel()
+		_ = c.conn.Write(ctx, websocket.MessageBinary, grpcwebsocket.MakeCancelFrame(code, msg))
+	}
+	_ = grpcwebsocket.CloseWithStatus(c.conn, code, msg)
+}
+
+// setHeader sets the headers of the response to the gRPC client after applying the header policy. If isTrailers is
+// true, http.TrailerPrefix is prepended to each key.
+func (c *websocketConn) setHeader(msg []byte, isTrailers bool) error {
+	hdr, err := grpcwebsocket.ParseMetadata(msg, c.metadataLimits)
+	if err != nil {
+		if errors.Is(err, grpcproto.ErrMetadataLimitExceeded) {
+			return newTransportError(codes.ResourceExhausted, "receiving metadata: %v", err)
+		}
+		return err
+	}
+	c.headerPolicy.Apply(hdr, "")
+
+	wHdr := c.w.Header()
 	for k, vs := range hdr {
 		if isTrailers {
 			// Any trailers have had the prefix stripped off, so we replace it here.
@@ -181,12 +301,12 @@ func setHeader(w http.ResponseWriter, msg []byte, isTrailers bool) error {
 }
 
 func (c *websocketConn) writeToServer(body io.Reader) error {
-	if err := grpcwebsocket.Write(c.ctx, c.conn, body, name); err != nil {
+	if err := grpcwebsocket.Write(c.ioCtx, c.conn, body, name); err != nil {
 		glog.V(2).Infof("Error writing to %q: %v", c.url, err)
 		return err
 	}
 	// Signal to the server there are no more messages in the stream.
-	if err := c.conn.Write(c.ctx, websocket.MessageBinary, grpcproto.EndStreamHeader); err != nil {
+	if err := c.conn.Write(c.ioCtx, websocket.MessageBinary, grpcproto.EndStreamHeader); err != nil {
 		glog.V(2).Infof("Error writing EOS to %q: %v", c.url, err)
 		return err
 	}
@@ -207,11 +327,14 @@ func (c *websocketConn) writeErrorIfNecessary() {
 		return
 	}
 
+	// If the server failed before sending response headers, the response still has to be a gRPC response for the
+	// status to be conveyed. Otherwise, the headers have already been written, and this has no effect.
+	if c.w.Header().Get("Content-Type") == "" {
+		c.w.Header().Set("Content-Type", "application/grpc")
+	}
 	c.w.WriteHeader(http.StatusOK)
 
-	c.w.Header().Set("Trailer:Grpc-Status", fmt.Sprintf("%d", codes.Unavailable))
-	errMsg := errors.Wrap(c.err, "transport").Error()
-	c.w.Header().Set("Trailer:Grpc-Message", grpcproto.EncodeGrpcMessage(errMsg))
+	setStatusHeaders(c.w.Header(), http.TrailerPrefix, c.err)
 }
 
 // ServeHTTP handles gRPC-WebSocket traffic.
@@ -227,13 +350,19 @@ func (h *http2WebSocketProxy) ServeHTTP(w http.ResponseWriter, req *http.Request
 		scheme = "http"
 	}
 
+	deadline, hasDeadline := grpcDeadline(req.Header)
+
 	url := *req.URL // Copy the value, so we do not overwrite the URL.
 	url.Scheme = scheme
 	url.Host = h.endpoint
-	conn, resp, err := websocket.Dial(req.Context(), url.String(), &websocket.DialOptions{
+	if h.pathPrefix != "" {
+		url.Path, url.RawPath = h.pathPrefix+url.Path, ""
+	}
+	conn, resp, err := h.dialWebSocket(req, url.String(), &websocket.DialOptions{
 		// Add the gRPC headers to the WebSocket handshake request.
 		HTTPHeader:   req.Header,
 		HTTPClient:   h.httpClient,
+		Host:         h.host,
 		Subprotocols: subprotocols,
 		// gRPC already performs compression, so no need for WebSocket to add compression as well.
 		CompressionMode: websocket.CompressionDisabled,
@@ -245,20 +374,49 @@ func (h *http2WebSocketProxy) ServeHTTP(w http.ResponseWriter, req *http.Request
 	}
 	if err != nil {
 		if resp != nil && resp.Body != nil {
-			if respErr := httputils.ExtractResponseError(resp); respErr != nil {
-				err = fmt.Errorf("%w; response error: %v", err, respErr)
+			if respErr := extractResponseError(resp); respErr != nil {
+				err = fmt.Errorf("%w; response error: %w", err, respErr)
 			}
 		}
+		if incompatibleErr := checkWebSocketResponse(resp); incompatibleErr != nil {
+			err = incompatibleErr
+		} else {
+			err = classifyWebSocketDialError(err, resp)
+		}
 		writeError(w, errors.Wrapf(err, "connecting to gRPC endpoint %q", url.String()))
 		return
 	}
 	conn.SetReadLimit(64 * size.MB)
+	transportInfo := &TransportInfo{Transport: TransportWebSocket, Subprotocol: conn.Subprotocol()}
+	if resp != nil {
+		transportInfo.Proto = resp.Proto
+	}
+	setTransportInfoHeader(w.Header(), transportInfo)
 
 	wsConn := &websocketConn{
-		ctx:  req.Context(),
-		conn: conn,
-		w:    w,
-		url:  url.String(),
+		ctx:            req.Context(),
+		ioCtx:          req.Context(),
+		conn:           conn,
+		w:              w,
+		url:            url.String(),
+		controlFrames:  conn.Subprotocol() == grpcwebsocket.SubprotocolNameV2,
+		headerPolicy:   h.headerPolicy,
+		metadataLimits: h.metadataLimits,
+	}
+	// Wait for the cancellation of the call to complete before closing the connection.
+	waitCancel := func() {}
+	if wsConn.controlFrames {
+		wsConn.ioCtx = context.WithoutCancel(req.Context())
+		cancelDone := make(chan struct{})
+		stopCancel := context.AfterFunc(req.Context(), func() {
+			defer close(cancelDone)
+			wsConn.cancel(deadline, hasDeadline)
+		})
+		waitCancel = func() {
+			if !stopCancel() {
+				<-cancelDone
+			}
+		}
 	}
 
 	var wg sync.WaitGroup
@@ -268,21 +426,41 @@ func (h *http2WebSocketProxy) ServeHTTP(w http.ResponseWriter, req *http.Request
 		defer wg.Done()
 		if err := wsConn.writeToServer(req.Body); err != nil {
 			wsConn.setError(err)
-			_ = conn.Close(websocket.StatusInternalError, err.Error())
+			// If the gRPC client went away, the connection is closed by canceling the call.
+			if req.Context().Err() == nil || !wsConn.controlFrames {
+				_ = conn.Close(websocket.StatusInternalError, err.Error())
+			}
 		}
 	}()
 
+	keepaliveCtx, stopKeepalive := context.WithCancel(wsConn.ioCtx)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.keepalive.keepWebSocketAlive(keepaliveCtx, conn, func(err error) {
+			wsConn.setError(err)
+			// The path to the server is broken, so there is no point in attempting a closing handshake.
+			_ = conn.CloseNow()
+		})
+	}()
+
 	if err := wsConn.readFromServer(); err != nil {
 		glog.V(2).Infof("Error reading from %q: %v", wsConn.url, err)
 		wsConn.setError(err)
+	} else {
+		wsConn.completed.Store(true)
 	}
 
+	stopKeepalive()
+
 	// In-case of error, the request body may not be closed.
 	// Close it here to ensure no leaks.
 	_ = req.Body.Close()
 
 	wg.Wait()
 
+	waitCancel()
+
 	// If the connection had an error, write it back to the client.
 	wsConn.writeErrorIfNecessary()
 
@@ -292,15 +470,78 @@ func (h *http2WebSocketProxy) ServeHTTP(w http.ResponseWriter, req *http.Request
 	_ = conn.Close(websocket.StatusNormalClosure, "")
 }
 
-func createClientWSProxy(endpoint string, tlsClientConf *tls.Config) (*http.Server, pipeconn.DialContextFunc, error) {
+// createWebSocketHTTPClient creates an HTTP client for WebSocket handshakes. If TLS is used, the client establishes
+// TLS connections via dialTLS, or via a dialer for the given connect options if dialTLS is nil.
+func createWebSocketHTTPClient(tlsClientConf *tls.Config, connectOpts *connectOptions, dialTLS tlsDialFunc) *http.Client {
+	var transport closeableTransport
+	switch {
+	case connectOpts.webSocketOverHTTP2:
+		transport = &webSocketTransport{
+			h2: newHTTP2WebSocketTransport(tlsClientConf, connectOpts, dialTLS, nil),
+			// Fallback HTTP/1.1 upgrades need connections of their own, on which HTTP/2 is not offered.
+			h1: newHTTP1WebSocketTransport(tlsClientConf, connectOpts, nil, nil),
+		}
+	case tlsClientConf != nil && connectOpts.transportCreds != nil:
+		// Transport credentials may offer "h2" to the server, in which case connections on which the server
+		// negotiates it are used for WebSockets over HTTP/2.
+		h2Conns := &connHandoff{}
+		transport = &negotiatedWebSocketTransport{
+			h1:      newHTTP1WebSocketTransport(tlsClientConf, connectOpts, dialTLS, h2Conns),
+			h2:      newHTTP2WebSocketTransport(tlsClientConf, connectOpts, dialTLS, h2Conns),
+			h2Conns: h2Conns,
+		}
+	default:
+		transport = newHTTP1WebSocketTransport(tlsClientConf, connectOpts, dialTLS, nil)
+	}
+	return &http.Client{Transport: withHooks(transport, connectOpts)}
+}
+
+// newHTTP1WebSocketTransport creates the transport for HTTP/1.1 WebSocket upgrades. If TLS is used, connections are
+// established via dialTLS, or via a dialer for the given connect options if dialTLS is nil. Connections on which the
+// server negotiates HTTP/2 are handed off to h2Conns, if non-nil, and the handshake fails with errHTTP2Negotiated.
+func newHTTP1WebSocketTransport(tlsClientConf *tls.Config, connectOpts *connectOptions, dialTLS tlsDialFunc, h2Conns *connHandoff) *http.Transport {
+	transport := &http.Transport{
+		DialContext: newDialer(tlsClientConf, connectOpts).DialContext,
+	}
+	if tlsClientConf != nil {
+		if dialTLS == nil {
+			tlsConf := tlsClientConf.Clone()
+			tlsConf.NextProtos = nextProtos(tlsClientConf, false, true)
+			dialTLS = newTLSDialFunc(tlsConf, connectOpts)
+		}
+		transport.DialTLSContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, err := dialTLS(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			// Transport credentials may offer "h2" to the server, which cannot be used for HTTP/1.1 upgrades.
+			if proto := conn.ConnectionState().NegotiatedProtocol; proto == "h2" {
+				if h2Conns == nil {
+					_ = conn.Close()
+					return nil, errors.Wrapf(errHTTP2Negotiated, "WebSocket handshake with %s", addr)
+				}
+				h2Conns.put(addr, conn)
+				return nil, errHTTP2Negotiated
+			}
+			return conn, nil
+		}
+	}
+	return transport
+}
+
+func createClientWSProxyHandler(endpoint, host string, tlsClientConf *tls.Config, connectOpts *connectOptions, dialTLS tlsDialFunc) (http.Handler, idleConnCloser, error) {
+	httpClient := createWebSocketHTTPClient(tlsClientConf, connectOpts, dialTLS)
 	handler := &http2WebSocketProxy{
-		insecure: tlsClientConf == nil,
-		endpoint: endpoint,
-		httpClient: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: tlsClientConf,
-			},
-		},
-	}
-	return makeProxyServer(handler)
+		insecure:   tlsClientConf == nil,
+		endpoint:   endpoint,
+		host:       host,
+		pathPrefix: connectOpts.pathPrefix,
+		httpClient: httpClient,
+		keepalive:  connectOpts.keepalive,
+		retry:      connectOpts.webSocketRetry,
+
+		headerPolicy:   connectOpts.responseHeaderPolicy,
+		metadataLimits: connectOpts.metadataLimits,
+	}
+	return handler, httpClient, nil
 }
@@ -0,0 +1,142 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package client
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultWebSocketRetryInitialBackoff = 100 * time.Millisecond
+	defaultWebSocketRetryMaxBackoff     = 5 * time.Second
+
+	// Like in gRPC's default backoff config.
+	webSocketRetryBackoffMultiplier = 1.6
+	webSocketRetryJitter            = 0.2
+)
+
+// webSocketRetryParams configures retries of failed WebSocket handshakes. The zero value disables retries.
+type webSocketRetryParams struct {
+	// maxAttempts is the maximum number of handshake attempts, including the first one.
+	maxAttempts int
+	// initialBackoff is the duration to wait before the first retry.
+	initialBackoff time.Duration
+	// maxBackoff is the upper bound of the duration to wait between retries, before applying jitter.
+	maxBackoff time.Duration
+}
+
+// backoff returns the duration to wait before the given retry, starting at 1.
+func (p webSocketRetryParams) backoff(retry int) time.Duration {
+	backoff := float64(p.initialBackoff)
+	for i := 1; i < retry && backoff < float64(p.maxBackoff); i++ {
+		backoff *= webSocketRetryBackoffMultiplier
+	}
+	backoff = min(backoff, float64(p.maxBackoff))
+	backoff *= 1 + webSocketRetryJitter*(2*rand.Float64()-1)
+	return time.Duration(backoff)
+}
+
+// dialWebSocket performs the WebSocket handshake for the given gRPC request. Failed handshakes are retried according
+// to the configured retry params if the error is retryable, and if waiting for the next attempt does not exceed the
+// deadline of the call. Retrying is safe, as nothing of the request body is consumed before the handshake succeeded.
+func (h *http2WebSocketProxy) dialWebSocket(req *http.Request, url string, opts *websocket.DialOptions) (*websocket.Conn, *http.Response, error) {
+	ctx := req.Context()
+	deadline, hasDeadline := grpcDeadline(req.Header)
+	for attempt := 1; ; attempt++ {
+		conn, resp, err := websocket.Dial(ctx, url, opts)
+		if err == nil || attempt >= h.retry.maxAttempts || !isRetryableHandshakeError(err, resp) {
+			return conn, resp, err
+		}
+
+		backoff := h.retry.backoff(attempt)
+		if hasDeadline && time.Now().Add(backoff).After(deadline) {
+			return conn, resp, err
+		}
+		glog.V(2).Infof("WebSocket handshake attempt %d with %q failed, retrying in %v: %v", attempt, url, backoff, err)
+		if resp != nil && resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, errors.Wrapf(ctx.Err(), "waiting to retry failed WebSocket handshake (%v)", err)
+		case <-timer.C:
+		}
+	}
+}
+
+// isRetryableHandshakeError checks whether a failed WebSocket handshake is worth retrying, i.e., whether the error is
+// likely transient, such as a connection being reset or a load balancer not having any healthy backend during a
+// deployment.
+func isRetryableHandshakeError(err error, resp *http.Response) bool {
+	if resp != nil {
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// grpcDeadline returns the deadline of a gRPC call, as determined by its Grpc-Timeout header.
+func grpcDeadline(header http.Header) (time.Time, bool) {
+	timeout := header.Get("Grpc-Timeout")
+	if len(timeout) < 2 {
+		return time.Time{}, false
+	}
+	value, err := strconv.ParseInt(timeout[:len(timeout)-1], 10, 64)
+	if err != nil || value < 0 {
+		return time.Time{}, false
+	}
+	var unit time.Duration
+	switch timeout[len(timeout)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return time.Time{}, false
+	}
+	if value > math.MaxInt64/int64(unit) {
+		return time.Time{}, false
+	}
+	return time.Now().Add(time.Duration(value) * unit), true
+}
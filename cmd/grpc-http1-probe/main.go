@@ -0,0 +1,87 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Command grpc-http1-probe reports which ways of talking gRPC work on the network path to a server.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.stackrox.io/grpc-http1/client"
+)
+
+func main() {
+	plaintext := flag.Bool("plaintext", false, "connect without TLS")
+	insecureSkipVerify := flag.Bool("insecure-skip-verify", false, "do not verify the server certificate")
+	caFile := flag.String("ca-file", "", "PEM file with CA certificates to verify the server certificate against")
+	serverName := flag.String("server-name", "", "server name to use for TLS verification")
+	forceHTTP2 := flag.Bool("force-http2", false, "use HTTP/2 even in the absence of ALPN")
+	extraALPNs := flag.String("extra-h2-alpns", "", "comma-separated list of ALPN names to treat as HTTP/2")
+	timeout := flag.Duration("timeout", 30*time.Second, "overall timeout for the probe")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <host:port>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var tlsConf *tls.Config
+	if !*plaintext {
+		tlsConf = &tls.Config{
+			ServerName:         *serverName,
+			InsecureSkipVerify: *insecureSkipVerify,
+		}
+		if *caFile != "" {
+			pem, err := os.ReadFile(*caFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Reading CA file: %v\n", err)
+				os.Exit(1)
+			}
+			tlsConf.RootCAs = x509.NewCertPool()
+			if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+				fmt.Fprintf(os.Stderr, "No certificates found in %s\n", *caFile)
+				os.Exit(1)
+			}
+		}
+	}
+
+	var opts []client.ConnectOption
+	if *forceHTTP2 {
+		opts = append(opts, client.ForceHTTP2())
+	}
+	if *extraALPNs != "" {
+		opts = append(opts, client.ExtraH2ALPNs(strings.Split(*extraALPNs, ",")...))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	report, err := client.Probe(ctx, flag.Arg(0), tlsConf, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Probing %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+	fmt.Print(report)
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package capabilities
+
+import (
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// HeaderKey is the response header by which servers announce their capabilities, e.g.,
+	// `protocol=1; transports=grpc grpc-web websocket; websocket-subprotocols=grpc-ws.v2 grpc-ws`.
+	HeaderKey = "Grpc-Http1-Capabilities"
+	// WellKnownPath is the path at which servers may describe their capabilities as a JSON document.
+	WellKnownPath = "/.well-known/grpc-http1"
+
+	// ProtocolVersion is the version of the capability announcement. Later versions may add capabilities, which
+	// older clients ignore.
+	ProtocolVersion = 1
+
+	modulePath = "golang.stackrox.io/grpc-http1"
+)
+
+// Capabilities describes what a server supports.
+type Capabilities struct {
+	ProtocolVersion int `json:"protocolVersion"`
+	// Version is the version of this library used by the server, if known.
+	Version string `json:"version,omitempty"`
+	// Transports are the ways in which the server accepts calls, i.e., "grpc", "grpc-web" and "websocket".
+	Transports []string `json:"transports"`
+	// WebSocketSubprotocols are the WebSocket subprotocols the server accepts, in the order of preference.
+	WebSocketSubprotocols []string `json:"webSocketSubprotocols,omitempty"`
+}
+
+// Header returns the value of the capabilities header announcing the capabilities. The version of the library is
+// omitted, as the header is sent in every response, not only to clients interested in the capabilities.
+func (c *Capabilities) Header() string {
+	params := []string{
+		"protocol=" + strconv.Itoa(c.ProtocolVersion),
+		"transports=" + strings.Join(c.Transports, " "),
+	}
+	if len(c.WebSocketSubprotocols) > 0 {
+		params = append(params, "websocket-subprotocols="+strings.Join(c.WebSocketSubprotocols, " "))
+	}
+	return strings.Join(params, "; ")
+}
+
+// ParseHeader parses the value of a capabilities header. Unknown parameters are ignored, and the version of the library
+// is taken from the header, if present, as sent by earlier servers.
+func ParseHeader(value string) (*Capabilities, error) {
+	var c Capabilities
+	for _, param := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		val = strings.TrimSpace(val)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "protocol":
+			version, err := strconv.Atoi(val)
+			if err != nil || version < 1 {
+				return nil, errors.Errorf("invalid protocol version %q in %s header", val, HeaderKey)
+			}
+			c.ProtocolVersion = version
+		case "version":
+			c.Version = val
+		case "transports":
+			c.Transports = strings.Fields(val)
+		case "websocket-subprotocols":
+			c.WebSocketSubprotocols = strings.Fields(val)
+		}
+	}
+	if c.ProtocolVersion == 0 {
+		return nil, errors.Errorf("no protocol version in %s header", HeaderKey)
+	}
+	return &c, nil
+}
+
+// LibraryVersion returns the version of this library the running binary was built with, or an empty string if it is
+// unknown.
+func LibraryVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if info.Main.Path == modulePath {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path != modulePath {
+			continue
+		}
+		if dep.Replace != nil {
+			return dep.Replace.Version
+		}
+		return dep.Version
+	}
+	return ""
+}
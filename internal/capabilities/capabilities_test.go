@@ -0,0 +1,55 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package capabilities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	caps := &Capabilities{
+		ProtocolVersion:       ProtocolVersion,
+		Version:               "v1.2.3",
+		Transports:            []string{"grpc", "grpc-web", "websocket"},
+		WebSocketSubprotocols: []string{"grpc-ws.v2", "grpc-ws"},
+	}
+	header := caps.Header()
+	// The version is not revealed in the header.
+	assert.Equal(t, "protocol=1; transports=grpc grpc-web websocket; websocket-subprotocols=grpc-ws.v2 grpc-ws", header)
+
+	parsed, err := ParseHeader(header)
+	require.NoError(t, err)
+	caps.Version = ""
+	assert.Equal(t, caps, parsed)
+}
+
+func TestParseHeader(t *testing.T) {
+	// Parameters of later protocol versions are ignored.
+	parsed, err := ParseHeader("protocol=2; transports=grpc-web; compression=gzip")
+	require.NoError(t, err)
+	assert.Equal(t, &Capabilities{ProtocolVersion: 2, Transports: []string{"grpc-web"}}, parsed)
+
+	parsed, err = ParseHeader("protocol=1; version=v0.1.0; transports=grpc-web")
+	require.NoError(t, err)
+	assert.Equal(t, &Capabilities{ProtocolVersion: 1, Version: "v0.1.0", Transports: []string{"grpc-web"}}, parsed)
+
+	for _, invalid := range []string{"", "transports=grpc", "protocol=x; transports=grpc", "protocol=0"} {
+		_, err := ParseHeader(invalid)
+		assert.Error(t, err, "header %q", invalid)
+	}
+}
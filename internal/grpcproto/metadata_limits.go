@@ -0,0 +1,81 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package grpcproto
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/size"
+)
+
+const (
+	// DefaultMaxMetadataSize is the default maximum size of a metadata frame, like gRPC's default limit for metadata.
+	DefaultMaxMetadataSize = int(16 * size.KB)
+	// DefaultMaxMetadataCount is the default maximum number of header values in a metadata frame.
+	DefaultMaxMetadataCount = 100
+)
+
+var (
+	// ErrMetadataLimitExceeded indicates that a metadata frame exceeds the configured limits.
+	ErrMetadataLimitExceeded = errors.New("metadata limit exceeded")
+)
+
+// MetadataLimits bounds the metadata frames (headers and trailers) that are parsed, such that peers cannot exhaust
+// memory. The zero value applies the default limits.
+type MetadataLimits struct {
+	// MaxSize is the maximum size of the contents of a metadata frame. Non-positive values mean
+	// DefaultMaxMetadataSize.
+	MaxSize int
+	// MaxCount is the maximum number of header values in a metadata frame. Non-positive values mean
+	// DefaultMaxMetadataCount.
+	MaxCount int
+}
+
+// MaxSizeOrDefault returns the maximum size of the contents of a metadata frame.
+func (l MetadataLimits) MaxSizeOrDefault() int {
+	if l.MaxSize <= 0 {
+		return DefaultMaxMetadataSize
+	}
+	return l.MaxSize
+}
+
+func (l MetadataLimits) maxCount() int {
+	if l.MaxCount <= 0 {
+		return DefaultMaxMetadataCount
+	}
+	return l.MaxCount
+}
+
+// CheckSize returns an error wrapping ErrMetadataLimitExceeded if a metadata frame of the given size exceeds the
+// limits.
+func (l MetadataLimits) CheckSize(frameSize int64) error {
+	if maxSize := l.MaxSizeOrDefault(); frameSize > int64(maxSize) {
+		return errors.Wrapf(ErrMetadataLimitExceeded, "metadata frame of %d bytes exceeds the limit of %d bytes", frameSize, maxSize)
+	}
+	return nil
+}
+
+// CheckCount returns an error wrapping ErrMetadataLimitExceeded if the given metadata has more values than allowed.
+func (l MetadataLimits) CheckCount(hdr http.Header) error {
+	count := 0
+	for _, values := range hdr {
+		count += len(values)
+	}
+	if maxCount := l.maxCount(); count > maxCount {
+		return errors.Wrapf(ErrMetadataLimitExceeded, "metadata frame with %d values exceeds the limit of %d values", count, maxCount)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package grpcproto
+
+import (
+	"encoding/binary"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func FuzzValidateGRPCFrame(f *testing.F) {
+	f.Add(EndStreamHeader)
+	f.Add(append(MakeMessageHeader(0, 3), "foo"...))
+	f.Add(append(MakeMessageHeader(MetadataFlags, 6), "A: 1\r\n"...))
+	f.Add([]byte{0, 0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0x80, 0})
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		if err := ValidateGRPCFrame(msg); err != nil {
+			return
+		}
+		// A valid frame is exactly as long as declared, so that its header can be relied upon.
+		assert.Equal(t, len(msg)-MessageHeaderLength, int(binary.BigEndian.Uint32(msg[1:MessageHeaderLength])))
+		assert.Equal(t, IsDataFrame(msg), !IsMetadataFrame(msg))
+	})
+}
+
+func TestMetadataLimits(t *testing.T) {
+	var defaults MetadataLimits
+	assert.NoError(t, defaults.CheckSize(int64(DefaultMaxMetadataSize)))
+	assert.ErrorIs(t, defaults.CheckSize(int64(DefaultMaxMetadataSize)+1), ErrMetadataLimitExceeded)
+
+	limits := MetadataLimits{MaxSize: 10, MaxCount: 2}
+	assert.NoError(t, limits.CheckSize(10))
+	assert.ErrorIs(t, limits.CheckSize(11), ErrMetadataLimitExceeded)
+	assert.NoError(t, limits.CheckCount(http.Header{"A": {"1"}, "B": {"2"}}))
+	assert.ErrorIs(t, limits.CheckCount(http.Header{"A": {"1", "2"}, "B": {"3"}}), ErrMetadataLimitExceeded)
+}
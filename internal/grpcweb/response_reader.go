@@ -15,28 +15,32 @@
 package grpcweb
 
 import (
-	"bufio"
 	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net/http"
-	"net/textproto"
 	"strings"
 
 	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
 	"golang.stackrox.io/grpc-http1/internal/ioutils"
 )
 
-type errExtraData int64
+// ExtraDataError is returned if a response contains data after the trailers frame. Its value is a lower bound for
+// the number of extra bytes.
+type ExtraDataError int64
 
-func (e errExtraData) Error() string {
+func (e ExtraDataError) Error() string {
 	return fmt.Sprintf("at least %d extra bytes after trailers frame", int64(e))
 }
 
 var (
 	// ErrNoDecompressor means that we don't know how to decompress a compressed trailer message.
 	ErrNoDecompressor = errors.New("compressed message encountered, but no decompressor specified")
+
+	// ErrMissingTrailers means that the response ended after some data, but without a trailers frame.
+	ErrMissingTrailers = errors.Wrap(io.ErrUnexpectedEOF, "response ended without trailers frame")
 )
 
 // Decompressor returns a decompressed ReadCloser for a given compressed ReadCloser.
@@ -46,6 +50,7 @@ type responseReader struct {
 	io.ReadCloser
 	decompressor Decompressor
 	trailers     *http.Header
+	limits       grpcproto.MetadataLimits
 
 	// err is the error condition encountered, if any (sticky!)
 	err error
@@ -65,19 +70,21 @@ type responseReader struct {
 }
 
 // NewResponseReader returns a response reader that on-the-fly transcodes a gRPC web response into normal gRPC framing.
-// Once the reader has reached EOF, the given trailers (which must be non-nil) are populated.
-func NewResponseReader(origResp io.ReadCloser, trailers *http.Header, decompressor Decompressor) io.ReadCloser {
+// Once the reader has reached EOF, the given trailers (which must be non-nil) are populated. A trailers frame exceeding
+// the given limits results in an error wrapping grpcproto.ErrMetadataLimitExceeded.
+func NewResponseReader(origResp io.ReadCloser, trailers *http.Header, decompressor Decompressor, limits grpcproto.MetadataLimits) io.ReadCloser {
 	return &responseReader{
 		ReadCloser:   origResp,
 		trailers:     trailers,
 		decompressor: decompressor,
+		limits:       limits,
 	}
 }
 
 func (r *responseReader) adjustResult(n int, err error) (int, error) {
 	if r.hasReadTrailers {
 		if n > 0 && (err == nil || err == io.EOF) {
-			err = errExtraData(n)
+			err = ExtraDataError(n)
 		}
 		n = 0
 	} else if r.hasReadData && err == io.EOF /* && !r.hasReadTrailers */ {
@@ -87,7 +94,7 @@ func (r *responseReader) adjustResult(n int, err error) (int, error) {
 			// return `0, EOF` in a subsequent call.
 			err = nil
 		} else {
-			err = io.ErrUnexpectedEOF
+			err = ErrMissingTrailers
 		}
 	}
 	return n, err
@@ -149,6 +156,10 @@ func (r *responseReader) readFullTrailers() error {
 	}
 
 	frameLen := binary.BigEndian.Uint32(frameHeader[1:])
+	// Do not trust the frame length before allocating memory for the trailers.
+	if err := r.limits.CheckSize(int64(frameLen)); err != nil {
+		return err
+	}
 	var numBytesRead int64
 	trailersDataReader := ioutils.NewCountingReader(io.LimitReader(reader, int64(frameLen)), &numBytesRead)
 	if frameHeader[0]&compressedFlag != 0 {
@@ -158,19 +169,20 @@ func (r *responseReader) readFullTrailers() error {
 		trailersDataReader = r.decompressor(trailersDataReader)
 	}
 
-	// textproto Reader requires a terminating newline (\r\n) after the last header line, which is not contained in the
-	// gRPC web trailer frame.
-	trailersReader := textproto.NewReader(bufio.NewReader(
-		io.MultiReader(trailersDataReader, strings.NewReader("\r\n"))))
-	trailers, err := trailersReader.ReadMIMEHeader()
+	// Compressed trailers may decompress to more than the frame length.
+	maxSize := r.limits.MaxSizeOrDefault()
+	trailersData, err := io.ReadAll(io.LimitReader(trailersDataReader, int64(maxSize)+1))
 	if err != nil {
 		return err
 	}
-
-	if _, err := trailersReader.R.Peek(1); err != io.EOF {
-		if err == nil {
-			err = errors.New("incomplete read of trailers")
-		}
+	if err := r.limits.CheckSize(int64(len(trailersData))); err != nil {
+		return err
+	}
+	trailers, err := parseTrailers(trailersData)
+	if err != nil {
+		return err
+	}
+	if err := r.limits.CheckCount(trailers); err != nil {
 		return err
 	}
 
@@ -190,20 +202,51 @@ func (r *responseReader) readFullTrailers() error {
 	// Special case: if `r.partialTrailerData` contains data past the trailers frame, make sure we don't silently
 	// discard it (we still discard it, but with an error).
 	if extraBytes := int64(len(r.partialTrailerData)) - int64(len(frameHeader)) - int64(frameLen); extraBytes > 0 {
-		return errExtraData(extraBytes)
+		return ExtraDataError(extraBytes)
 	}
 
 	return nil
 }
 
-func (r *responseReader) populateTrailers(trailers textproto.MIMEHeader) {
+// parseTrailers parses the contents of a trailers frame. The gRPC-Web protocol specifies the trailers to be formatted
+// like HTTP/1 headers, with lower-case keys. As server implementations differ in the details, parsing is lenient: keys
+// are case-insensitive, the space after the colon is optional, lines may be terminated by "\n" instead of "\r\n", the
+// last line does not need to be terminated, and empty lines are ignored.
+func parseTrailers(data []byte) (http.Header, error) {
+	trailers := make(http.Header)
+	var lastKey string
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			// Obsolete line folding, continuing the value of the previous line.
+			if lastKey == "" {
+				return nil, errors.Errorf("malformed trailer line %q", line)
+			}
+			values := trailers[lastKey]
+			values[len(values)-1] = strings.TrimSpace(values[len(values)-1] + " " + string(bytes.TrimSpace(line)))
+			continue
+		}
+		key, value, ok := bytes.Cut(line, []byte(":"))
+		key = bytes.TrimSpace(key)
+		if !ok || len(key) == 0 || bytes.ContainsAny(key, " \t") {
+			return nil, errors.Errorf("malformed trailer line %q", line)
+		}
+		lastKey = http.CanonicalHeaderKey(string(key))
+		trailers[lastKey] = append(trailers[lastKey], string(bytes.TrimSpace(value)))
+	}
+	return trailers, nil
+}
+
+func (r *responseReader) populateTrailers(trailers http.Header) {
 	if *r.trailers == nil {
 		*r.trailers = make(http.Header)
 	}
 
 	for k, vs := range trailers {
-		canonicalK := http.CanonicalHeaderKey(k)
-		(*r.trailers)[canonicalK] = append((*r.trailers)[canonicalK], vs...)
+		(*r.trailers)[k] = append((*r.trailers)[k], vs...)
 	}
 }
 
@@ -22,6 +22,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
 )
 
 func frame(trailers bool, dataStr string) []byte {
@@ -64,7 +65,7 @@ func TestReadOK(t *testing.T) {
 
 	trailers := make(http.Header)
 
-	webResponseReader := NewResponseReader(input, &trailers, nil)
+	webResponseReader := NewResponseReader(input, &trailers, nil, grpcproto.MetadataLimits{})
 
 	readData, err := io.ReadAll(webResponseReader)
 	assert.NoError(t, err)
@@ -78,7 +79,7 @@ func TestNoDataOK(t *testing.T) {
 
 	trailers := make(http.Header)
 
-	webResponseReader := NewResponseReader(input, &trailers, nil)
+	webResponseReader := NewResponseReader(input, &trailers, nil, grpcproto.MetadataLimits{})
 
 	readData, err := io.ReadAll(webResponseReader)
 	assert.NoError(t, err)
@@ -104,10 +105,11 @@ func TestExtraDataError(t *testing.T) {
 
 	trailers := make(http.Header)
 
-	webResponseReader := NewResponseReader(input, &trailers, nil)
+	webResponseReader := NewResponseReader(input, &trailers, nil, grpcproto.MetadataLimits{})
 
 	readData, err := io.ReadAll(webResponseReader)
-	assert.Error(t, err)
+	var extraDataErr ExtraDataError
+	assert.ErrorAs(t, err, &extraDataErr)
 	assert.Equal(t, messagePayload, readData)
 	assert.Equal(t, expectedTrailers, trailers)
 }
@@ -122,10 +124,68 @@ func TestNoTrailersError(t *testing.T) {
 
 	trailers := make(http.Header)
 
-	webResponseReader := NewResponseReader(input, &trailers, nil)
+	webResponseReader := NewResponseReader(input, &trailers, nil, grpcproto.MetadataLimits{})
 
 	readData, err := io.ReadAll(webResponseReader)
-	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrMissingTrailers)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
 	assert.Equal(t, messagePayload, readData)
 	assert.Empty(t, trailers)
 }
+
+func TestTrailersLimits(t *testing.T) {
+	limits := grpcproto.MetadataLimits{MaxSize: 32, MaxCount: 2}
+	cases := map[string][]byte{
+		// The declared length of the trailers frame is checked before reading it.
+		"declared-size": {trailerMessageFlag, 0xff, 0xff, 0xff, 0xff},
+		"size":          frame(true, "Trailer-Value: 0123456789abcdefghij\r\n"),
+		"count":         frame(true, "A: 1\r\nB: 2\r\nC: 3\r\n"),
+	}
+	for name, trailersFrame := range cases {
+		t.Run(name, func(t *testing.T) {
+			trailers := make(http.Header)
+			webResponseReader := NewResponseReader(stream(frame(false, "foo"), trailersFrame), &trailers, nil, limits)
+			_, err := io.ReadAll(webResponseReader)
+			assert.ErrorIs(t, err, grpcproto.ErrMetadataLimitExceeded)
+			assert.Empty(t, trailers)
+		})
+	}
+
+	trailers := make(http.Header)
+	webResponseReader := NewResponseReader(stream(frame(false, "foo"), frame(true, "A: 1\r\nB: 2\r\n")), &trailers, nil, limits)
+	_, err := io.ReadAll(webResponseReader)
+	assert.NoError(t, err)
+	assert.Equal(t, http.Header{"A": {"1"}, "B": {"2"}}, trailers)
+}
+
+// chunkedReader returns at most the given number of bytes per read, exercising frames spanning reads.
+type chunkedReader struct {
+	r         io.Reader
+	chunkSize int
+}
+
+func (r *chunkedReader) Read(buf []byte) (int, error) {
+	if len(buf) > r.chunkSize {
+		buf = buf[:r.chunkSize]
+	}
+	return r.r.Read(buf)
+}
+
+func FuzzResponseReader(f *testing.F) {
+	f.Add(concat(frame(false, "foo bar baz"), frame(true, "Trailer-Value: foo\r\nTrailer2-Value: bar\r\n")), uint8(3))
+	f.Add(concat(frame(false, "foo"), frame(true, "A: 1\r\nB: 2\r\nC: 3\r\n")), uint8(255))
+	f.Add(concat(frame(true, "A: 1\r\n"), []byte("extra")), uint8(1))
+	f.Add([]byte{trailerMessageFlag, 0xff, 0xff, 0xff, 0xff}, uint8(0))
+
+	limits := grpcproto.MetadataLimits{MaxSize: 64, MaxCount: 4}
+	f.Fuzz(func(t *testing.T, data []byte, chunkSize uint8) {
+		trailers := make(http.Header)
+		input := io.NopCloser(&chunkedReader{r: bytes.NewReader(data), chunkSize: int(chunkSize) + 1})
+		readData, err := io.ReadAll(NewResponseReader(input, &trailers, nil, limits))
+		assert.LessOrEqual(t, len(readData), len(data))
+		assert.NoError(t, limits.CheckCount(trailers))
+		if err == nil {
+			assert.Equal(t, data[:len(readData)], readData)
+		}
+	})
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package grpcweb
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+)
+
+// echoResponse returns the protobuf encoding of an echo response with the given message.
+func echoResponse(msg string) string {
+	return string([]byte{0x0a, byte(len(msg))}) + msg
+}
+
+func TestThirdPartyTranscripts(t *testing.T) {
+	cases := []struct {
+		file             string
+		expectedData     []byte
+		expectedHeaders  http.Header
+		expectedTrailers http.Header
+	}{
+		{
+			file:         "envoy-unary.http",
+			expectedData: frame(false, echoResponse("hello")),
+			expectedTrailers: http.Header{
+				"Grpc-Status":           {"0"},
+				"Trailer-Echo-Response": {"trl"},
+			},
+		},
+		{
+			file:         "envoy-server-streaming.http",
+			expectedData: concat(frame(false, echoResponse("one")), frame(false, echoResponse("two"))),
+			expectedTrailers: http.Header{
+				"Grpc-Status": {"0"},
+			},
+		},
+		{
+			file: "envoy-trailers-only.http",
+			expectedHeaders: http.Header{
+				"Grpc-Status":  {"3"},
+				"Grpc-Message": {"oops"},
+			},
+			expectedTrailers: http.Header{},
+		},
+		{
+			file:         "grpcwebproxy-unary.http",
+			expectedData: frame(false, echoResponse("hello")),
+			expectedTrailers: http.Header{
+				"Grpc-Status":           {"0"},
+				"Grpc-Message":          {""},
+				"Trailer-Echo-Response": {"trl"},
+			},
+		},
+		{
+			file: "grpcwebproxy-error.http",
+			expectedTrailers: http.Header{
+				"Grpc-Status":  {"3"},
+				"Grpc-Message": {"oops"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.file, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", c.file))
+			require.NoError(t, err)
+			defer func() { _ = f.Close() }()
+
+			resp, err := http.ReadResponse(bufio.NewReader(f), nil)
+			require.NoError(t, err)
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, "application/grpc-web+proto", resp.Header.Get("Content-Type"))
+			for k, vs := range c.expectedHeaders {
+				assert.Equal(t, vs, resp.Header.Values(k))
+			}
+
+			trailers := make(http.Header)
+			data, err := io.ReadAll(NewResponseReader(resp.Body, &trailers, nil, grpcproto.MetadataLimits{}))
+			require.NoError(t, err)
+			assert.Equal(t, string(c.expectedData), string(data))
+			assert.Equal(t, c.expectedTrailers, trailers)
+		})
+	}
+}
+
+func TestParseTrailers(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		expected http.Header
+	}{
+		{
+			name:     "canonical",
+			data:     "Grpc-Status: 0\r\nGrpc-Message: \r\n",
+			expected: http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {""}},
+		},
+		{
+			name:     "no-space-after-colon",
+			data:     "grpc-status:3\r\ngrpc-message:oops\r\n",
+			expected: http.Header{"Grpc-Status": {"3"}, "Grpc-Message": {"oops"}},
+		},
+		{
+			name:     "mixed-case",
+			data:     "GRPC-STATUS: 0\r\ngRPC-Message: ok\r\n",
+			expected: http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}},
+		},
+		{
+			name:     "bare-newlines",
+			data:     "grpc-status: 0\ngrpc-message: ok\n",
+			expected: http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}},
+		},
+		{
+			name:     "unterminated-last-line",
+			data:     "grpc-status: 0\r\ngrpc-message: ok",
+			expected: http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}},
+		},
+		{
+			name:     "empty-lines",
+			data:     "grpc-status: 0\r\n\r\ngrpc-message: ok\r\n\r\n",
+			expected: http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}},
+		},
+		{
+			name:     "repeated-keys",
+			data:     "x-trailer: a\r\nX-Trailer: b\r\n",
+			expected: http.Header{"X-Trailer": {"a", "b"}},
+		},
+		{
+			name:     "folded-value",
+			data:     "grpc-message: first\r\n second\r\n",
+			expected: http.Header{"Grpc-Message": {"first second"}},
+		},
+		{
+			name:     "empty",
+			data:     "",
+			expected: http.Header{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			trailers, err := parseTrailers([]byte(c.data))
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, trailers)
+		})
+	}
+
+	for _, malformed := range []string{"grpc-status 0\r\n", ": 0\r\n", "grpc status: 0\r\n", " continuation\r\n"} {
+		_, err := parseTrailers([]byte(malformed))
+		assert.Error(t, err, "parsing %q should fail", malformed)
+	}
+}
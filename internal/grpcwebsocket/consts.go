@@ -4,4 +4,15 @@ const (
 	// SubprotocolName is the subprotocol for gRPC-websocket specified in the Sec-Websocket-Protocol
 	// header.
 	SubprotocolName = "grpc-ws"
+
+	// SubprotocolNameV2 is the subprotocol for version 2 of gRPC-websocket. It extends gRPC-websocket with cancel
+	// frames, by which either side can abort the call with a gRPC status, and with WebSocket close codes conveying gRPC
+	// status codes. Clients offer it alongside SubprotocolName, such that they can still talk to servers that do not
+	// know it.
+	SubprotocolNameV2 = "grpc-ws.v2"
+
+	// GRPCWebSocketsSubprotocolName is the subprotocol used by the WebSocket transport of improbable-eng's grpc-web
+	// browser client. Unlike gRPC-websocket, it sends request headers in-band and prefixes each request message with a
+	// flag byte.
+	GRPCWebSocketsSubprotocolName = "grpc-websockets"
 )
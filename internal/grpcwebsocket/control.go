@@ -0,0 +1,148 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package grpcwebsocket
+
+import (
+	"encoding/binary"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/coder/websocket"
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// This file contains the extensions of version 2 of gRPC-websocket (see SubprotocolNameV2).
+//
+// A cancel frame is a gRPC frame with the ControlFlags, whose payload is the control type (controlTypeCancel),
+// followed by the gRPC status code as a 32-bit big-endian integer and the UTF-8 encoded status message. Either side may
+// send it at any time, including after the end of its stream, to abort the call. The sender then closes the WebSocket
+// connection with the close code for the status code.
+//
+// WebSocket close codes 4000 to 4016 convey the gRPC status codes 0 to 16. Other close codes are mapped to gRPC status
+// codes like the corresponding HTTP/2 error codes (see CloseStatusCode).
+
+const (
+	// ControlFlags is the flags of control frames. As the MSB is unset, older peers would take them for data frames,
+	// hence they are only sent if SubprotocolNameV2 has been negotiated.
+	ControlFlags grpcproto.MessageFlags = 1 << 6
+
+	controlTypeCancel = 1
+
+	// cancelHeaderLength is the length of the payload of a cancel frame preceding the status message.
+	cancelHeaderLength = 1 + 4
+
+	// closeCodeBase is the close code conveying codes.OK. It is the first of the close codes reserved for private
+	// use.
+	closeCodeBase = 4000
+
+	// maxCloseReason is the maximum length of the reason of a close frame.
+	maxCloseReason = 123
+)
+
+// MakeCancelFrame creates a cancel frame for the given status.
+func MakeCancelFrame(code codes.Code, msg string) []byte {
+	payloadLen := cancelHeaderLength + len(msg)
+	frame := make([]byte, 0, grpcproto.MessageHeaderLength+payloadLen)
+	frame = append(frame, grpcproto.MakeMessageHeader(ControlFlags, uint32(payloadLen))...)
+	frame = append(frame, controlTypeCancel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(code))
+	return append(frame, msg...)
+}
+
+// IsControlFrame checks whether the given well-formed gRPC frame is a control frame.
+func IsControlFrame(msg []byte) bool {
+	return grpcproto.MessageFlags(msg[0])&ControlFlags != 0 && !grpcproto.IsMetadataFrame(msg)
+}
+
+// ParseCancelFrame returns the status conveyed by the given control frame.
+func ParseCancelFrame(msg []byte) (*status.Status, error) {
+	if err := grpcproto.ValidateGRPCFrame(msg); err != nil {
+		return nil, err
+	}
+	payload := msg[grpcproto.MessageHeaderLength:]
+	if len(payload) < cancelHeaderLength {
+		return nil, errors.Errorf("control frame is too short: %d bytes", len(payload))
+	}
+	if payload[0] != controlTypeCancel {
+		return nil, errors.Errorf("unknown control frame type %d", payload[0])
+	}
+	code := codes.Code(binary.BigEndian.Uint32(payload[1:]))
+	if code == codes.OK || code > codes.Unauthenticated {
+		return nil, errors.Errorf("invalid status code %d in cancel frame", code)
+	}
+	return status.New(code, string(payload[cancelHeaderLength:])), nil
+}
+
+// CloseCode returns the WebSocket close code conveying the given gRPC status code.
+func CloseCode(code codes.Code) websocket.StatusCode {
+	return websocket.StatusCode(closeCodeBase + int(code))
+}
+
+// CloseStatusCode returns the gRPC status code for a connection that was closed with the given close code.
+func CloseStatusCode(closeCode websocket.StatusCode) codes.Code {
+	if closeCode >= closeCodeBase && closeCode <= CloseCode(codes.Unauthenticated) {
+		return codes.Code(closeCode - closeCodeBase)
+	}
+	switch closeCode {
+	case websocket.StatusGoingAway, websocket.StatusAbnormalClosure, websocket.StatusServiceRestart,
+		websocket.StatusTryAgainLater, websocket.StatusBadGateway, websocket.StatusTLSHandshake:
+		return codes.Unavailable
+	case websocket.StatusPolicyViolation:
+		return codes.PermissionDenied
+	case websocket.StatusMessageTooBig:
+		return codes.ResourceExhausted
+	case websocket.StatusNormalClosure, websocket.StatusNoStatusRcvd, websocket.StatusProtocolError,
+		websocket.StatusUnsupportedData, websocket.StatusInvalidFramePayloadData, websocket.StatusMandatoryExtension,
+		websocket.StatusInternalError:
+		// Like an HTTP/2 stream reset with NO_ERROR, a normal closure before the call has completed is an error.
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// CloseErrorStatus returns the gRPC status for an error reading from or writing to a WebSocket connection of
+// version 2 of gRPC-websocket.
+func CloseErrorStatus(err error) *status.Status {
+	var closeErr websocket.CloseError
+	if !errors.As(err, &closeErr) {
+		return status.New(codes.Unavailable, err.Error())
+	}
+	msg := closeErr.Reason
+	if msg == "" {
+		msg = fmt.Sprintf("WebSocket connection closed with status %v", closeErr.Code)
+	}
+	return status.New(CloseStatusCode(closeErr.Code), msg)
+}
+
+// CloseWithStatus closes the connection with the close code for the given gRPC status code. The message is truncated
+// if it does not fit into a close frame.
+func CloseWithStatus(conn *websocket.Conn, code codes.Code, msg string) error {
+	return Close(conn, CloseCode(code), msg)
+}
+
+// Close closes the connection with the given close code. Unlike (*websocket.Conn).Close, which fails to send the close
+// frame for long reasons, the reason is truncated if it does not fit into a close frame.
+func Close(conn *websocket.Conn, code websocket.StatusCode, reason string) error {
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+	return conn.Close(code, reason)
+}
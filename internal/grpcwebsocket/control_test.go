@@ -0,0 +1,71 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package grpcwebsocket
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coder/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"google.golang.org/grpc/codes"
+)
+
+func TestCancelFrame(t *testing.T) {
+	frame := MakeCancelFrame(codes.ResourceExhausted, "quota exceeded")
+	assert.Equal(t, []byte{0x40, 0, 0, 0, 19, 1, 0, 0, 0, 8}, frame[:10])
+	assert.True(t, IsControlFrame(frame))
+
+	st, err := ParseCancelFrame(frame)
+	require.NoError(t, err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	assert.Equal(t, "quota exceeded", st.Message())
+
+	assert.False(t, IsControlFrame(grpcproto.MakeMessageHeader(0, 0)))
+	assert.False(t, IsControlFrame(grpcproto.MakeMessageHeader(grpcproto.MetadataFlags, 0)))
+}
+
+func TestParseInvalidCancelFrame(t *testing.T) {
+	for name, frame := range map[string][]byte{
+		"truncated":    MakeCancelFrame(codes.Canceled, "canceled")[:8],
+		"too short":    {0x40, 0, 0, 0, 2, 1, 0},
+		"unknown type": {0x40, 0, 0, 0, 5, 2, 0, 0, 0, 1},
+		"ok status":    MakeCancelFrame(codes.OK, ""),
+		"bad status":   MakeCancelFrame(codes.Code(17), ""),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseCancelFrame(frame)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCloseStatusCode(t *testing.T) {
+	for code := codes.OK; code <= codes.Unauthenticated; code++ {
+		assert.Equal(t, code, CloseStatusCode(CloseCode(code)))
+	}
+	assert.Equal(t, codes.Unknown, CloseStatusCode(CloseCode(codes.Unauthenticated)+1))
+	assert.Equal(t, codes.Unavailable, CloseStatusCode(websocket.StatusGoingAway))
+	assert.Equal(t, codes.PermissionDenied, CloseStatusCode(websocket.StatusPolicyViolation))
+	assert.Equal(t, codes.ResourceExhausted, CloseStatusCode(websocket.StatusMessageTooBig))
+	assert.Equal(t, codes.Internal, CloseStatusCode(websocket.StatusNormalClosure))
+
+	st := CloseErrorStatus(websocket.CloseError{Code: CloseCode(codes.NotFound), Reason: "gone"})
+	assert.Equal(t, codes.NotFound, st.Code())
+	assert.Equal(t, "gone", st.Message())
+	assert.Equal(t, codes.Unavailable, CloseErrorStatus(errors.New("connection reset")).Code())
+}
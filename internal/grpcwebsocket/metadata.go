@@ -0,0 +1,46 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package grpcwebsocket
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+)
+
+// ParseMetadata parses the contents of a metadata frame, or of a message holding request headers, in which headers
+// are formatted like HTTP/1 headers without the terminating empty line. Contents exceeding the given limits result in
+// an error wrapping grpcproto.ErrMetadataLimitExceeded.
+func ParseMetadata(data []byte, limits grpcproto.MetadataLimits) (http.Header, error) {
+	if err := limits.CheckSize(int64(len(data))); err != nil {
+		return nil, err
+	}
+	// Terminate the header block, as the data only contains the header lines.
+	reader := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(data), strings.NewReader("\r\n"))))
+	mimeHeader, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	hdr := http.Header(mimeHeader)
+	if err := limits.CheckCount(hdr); err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
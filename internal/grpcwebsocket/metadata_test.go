@@ -0,0 +1,61 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package grpcwebsocket
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+)
+
+func TestParseMetadata(t *testing.T) {
+	limits := grpcproto.MetadataLimits{MaxSize: 64, MaxCount: 3}
+
+	hdr, err := ParseMetadata([]byte("content-type: application/grpc\r\ngrpc-status: 0\r\nx-custom: a\r\n"), limits)
+	require.NoError(t, err)
+	assert.Equal(t, http.Header{
+		"Content-Type": {"application/grpc"},
+		"Grpc-Status":  {"0"},
+		"X-Custom":     {"a"},
+	}, hdr)
+
+	_, err = ParseMetadata([]byte("x-custom: "+strings.Repeat("a", 60)+"\r\n"), limits)
+	assert.ErrorIs(t, err, grpcproto.ErrMetadataLimitExceeded)
+	_, err = ParseMetadata([]byte("a: 1\r\na: 2\r\nb: 3\r\nc: 4\r\n"), limits)
+	assert.ErrorIs(t, err, grpcproto.ErrMetadataLimitExceeded)
+	_, err = ParseMetadata([]byte("no colon\r\n"), limits)
+	assert.Error(t, err)
+}
+
+func FuzzParseMetadata(f *testing.F) {
+	f.Add([]byte("content-type: application/grpc\r\ngrpc-status: 0\r\n"))
+	f.Add([]byte("grpc-status: 0\r\ngrpc-message: a\r\n continued\r\n"))
+	f.Add([]byte("a: 1\na: 2\nb: 3\nc: 4\n"))
+	f.Add([]byte(": no key\r\n"))
+
+	limits := grpcproto.MetadataLimits{MaxSize: 128, MaxCount: 4}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hdr, err := ParseMetadata(data, limits)
+		if err != nil {
+			return
+		}
+		assert.LessOrEqual(t, len(data), 128)
+		assert.NoError(t, limits.CheckCount(hdr))
+	})
+}
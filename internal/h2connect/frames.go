@@ -0,0 +1,134 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package h2connect
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// maxHeaderListSize is the maximum size of a header block, as defined for SETTINGS_MAX_HEADER_LIST_SIZE, i.e.,
+	// the sum of the lengths of all names and values plus 32 bytes per field.
+	maxHeaderListSize = 64 << 10
+
+	// maxContinuationFrames is the maximum number of CONTINUATION frames of a header block. Empty CONTINUATION frames
+	// do not count towards the size of the header block, so without a limit, a server could keep the client busy
+	// with a single header block forever.
+	maxContinuationFrames = 16
+)
+
+var (
+	errHeaderListTooLarge   = errors.New("response header list exceeds the size limit")
+	errTooManyContinuations = errors.New("response header block consists of too many CONTINUATION frames")
+)
+
+// frameReader reads the frames of an HTTP/2 connection, combining every HEADERS frame with its CONTINUATION frames
+// into a single MetaHeadersFrame. Unlike the framer itself, it bounds the number of CONTINUATION frames as well as the
+// size of the header list.
+type frameReader struct {
+	framer *http2.Framer
+	hdec   *hpack.Decoder
+
+	// The header block being read, if any.
+	headers       *http2.HeadersFrame
+	fields        []hpack.HeaderField
+	size          int
+	continuations int
+}
+
+func newFrameReader(framer *http2.Framer) *frameReader {
+	r := &frameReader{framer: framer}
+	r.hdec = hpack.NewDecoder(4096, r.emit)
+	r.hdec.SetMaxStringLength(maxHeaderListSize)
+	return r
+}
+
+func (r *frameReader) emit(field hpack.HeaderField) {
+	r.size += int(field.Size())
+	if r.size <= maxHeaderListSize {
+		r.fields = append(r.fields, field)
+	}
+}
+
+// ReadFrame reads the next frame. Header blocks are returned as MetaHeadersFrames. Errors that only affect a single
+// stream are returned as http2.StreamError; all other errors are fatal for the connection.
+func (r *frameReader) ReadFrame() (http2.Frame, error) {
+	for {
+		fh, err := r.framer.ReadFrameHeader()
+		if err != nil {
+			return nil, err
+		}
+		f, err := r.framer.ReadFrameForHeader(fh)
+		if err != nil {
+			if fh.Type == http2.FrameHeaders || fh.Type == http2.FrameContinuation {
+				// The fragment of a rejected frame is never decoded, which leaves the decoder out of sync with the
+				// server's encoder, so no later header block on this connection can be trusted.
+				return nil, http2.ConnectionError(http2.ErrCodeProtocol)
+			}
+			return nil, err
+		}
+		var fragment []byte
+		var ended bool
+		switch f := f.(type) {
+		case *http2.HeadersFrame:
+			// The framer makes sure that a header block is not interleaved with other frames.
+			r.headers, r.fields, r.size, r.continuations = f, nil, 0, 0
+			fragment, ended = f.HeaderBlockFragment(), f.HeadersEnded()
+		case *http2.ContinuationFrame:
+			if r.headers == nil {
+				return nil, http2.ConnectionError(http2.ErrCodeProtocol)
+			}
+			r.continuations++
+			if r.continuations > maxContinuationFrames {
+				return nil, errTooManyContinuations
+			}
+			fragment, ended = f.HeaderBlockFragment(), f.HeadersEnded()
+		default:
+			return f, nil
+		}
+
+		// The header block must be decoded completely to keep the state of the decoder in sync with the server's.
+		if _, err := r.hdec.Write(fragment); err != nil {
+			return nil, http2.ConnectionError(http2.ErrCodeCompression)
+		}
+		if r.size > maxHeaderListSize {
+			return nil, errHeaderListTooLarge
+		}
+		if ended {
+			return r.endHeaderBlock()
+		}
+	}
+}
+
+func (r *frameReader) endHeaderBlock() (http2.Frame, error) {
+	if err := r.hdec.Close(); err != nil {
+		return nil, http2.ConnectionError(http2.ErrCodeCompression)
+	}
+	mh := &http2.MetaHeadersFrame{HeadersFrame: r.headers, Fields: r.fields}
+	r.headers, r.fields = nil, nil
+
+	sawRegular := false
+	for _, field := range mh.Fields {
+		if !field.IsPseudo() {
+			sawRegular = true
+		} else if sawRegular || field.Name != ":status" {
+			return nil, http2.StreamError{StreamID: mh.StreamID, Code: http2.ErrCodeProtocol,
+				Cause: errors.Errorf("invalid pseudo-header %q in response", field.Name)}
+		}
+	}
+	return mh, nil
+}
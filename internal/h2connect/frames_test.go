@@ -0,0 +1,178 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package h2connect
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// framesConn is a connection from which the given frames are read, and to which all writes are discarded.
+type framesConn struct {
+	io.Reader
+}
+
+func (framesConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (framesConn) Close() error                     { return nil }
+func (framesConn) LocalAddr() net.Addr              { return nil }
+func (framesConn) RemoteAddr() net.Addr             { return nil }
+func (framesConn) SetDeadline(time.Time) error      { return nil }
+func (framesConn) SetReadDeadline(time.Time) error  { return nil }
+func (framesConn) SetWriteDeadline(time.Time) error { return nil }
+
+// frameWriter writes the frames a server sends.
+type frameWriter struct {
+	buf    bytes.Buffer
+	framer *http2.Framer
+	hbuf   bytes.Buffer
+	henc   *hpack.Encoder
+}
+
+func newFrameWriter() *frameWriter {
+	w := &frameWriter{}
+	w.framer = http2.NewFramer(&w.buf, nil)
+	w.henc = hpack.NewEncoder(&w.hbuf)
+	return w
+}
+
+func (w *frameWriter) headerBlock(fields ...string) []byte {
+	w.hbuf.Reset()
+	for i := 0; i+1 < len(fields); i += 2 {
+		_ = w.henc.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return bytes.Clone(w.hbuf.Bytes())
+}
+
+func (w *frameWriter) bytes() []byte {
+	return bytes.Clone(w.buf.Bytes())
+}
+
+// readFrames reads all frames of a response to stream 1 on a new connection, and returns the stream.
+func readFrames(data []byte) (*clientConn, *clientStream) {
+	cc := makeClientConn(framesConn{Reader: bytes.NewReader(data)})
+	cs := &clientStream{cc: cc, id: 1, respReady: make(chan struct{}), sendWindow: initialWindowSize}
+	cc.streams[cs.id] = cs
+	cc.readLoop()
+	return cc, cs
+}
+
+func TestHeaderBlockLimits(t *testing.T) {
+	t.Run("continuations", func(t *testing.T) {
+		w := newFrameWriter()
+		block := w.headerBlock(":status", "200", "x-header", "value")
+		require.NoError(t, w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block[:1]}))
+		for i := 0; i < maxContinuationFrames; i++ {
+			require.NoError(t, w.framer.WriteContinuation(1, false, nil))
+		}
+		require.NoError(t, w.framer.WriteContinuation(1, true, block[1:]))
+
+		cc, cs := readFrames(w.bytes())
+		assert.ErrorIs(t, cc.err, errTooManyContinuations)
+		assert.Nil(t, cs.resp)
+		assert.ErrorIs(t, cs.err, errTooManyContinuations)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		w := newFrameWriter()
+		block := w.headerBlock(":status", "200", "x-header", strings.Repeat("x", maxHeaderListSize))
+		require.NoError(t, w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block[:initialMaxFrameSize]}))
+		for block = block[initialMaxFrameSize:]; len(block) > initialMaxFrameSize; block = block[initialMaxFrameSize:] {
+			require.NoError(t, w.framer.WriteContinuation(1, false, block[:initialMaxFrameSize]))
+		}
+		require.NoError(t, w.framer.WriteContinuation(1, true, block))
+
+		cc, cs := readFrames(w.bytes())
+		assert.ErrorIs(t, cc.err, errHeaderListTooLarge)
+		assert.Nil(t, cs.resp)
+	})
+
+	t.Run("rejected-headers-frame", func(t *testing.T) {
+		w := newFrameWriter()
+		// The padding is longer than the frame, so the framer rejects the frame, but the header block remains open.
+		require.NoError(t, w.framer.WriteRawFrame(http2.FrameHeaders, http2.FlagHeadersPadded, 1, []byte{8}))
+		require.NoError(t, w.framer.WriteContinuation(1, true, w.headerBlock(":status", "200")))
+
+		cc, cs := readFrames(w.bytes())
+		assert.Equal(t, http2.ConnectionError(http2.ErrCodeProtocol), cc.err)
+		assert.Nil(t, cs.resp)
+	})
+
+	t.Run("within-limits", func(t *testing.T) {
+		w := newFrameWriter()
+		block := w.headerBlock(":status", "200", "x-header", "value")
+		require.NoError(t, w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block[:1]}))
+		for i := 1; i < maxContinuationFrames; i++ {
+			require.NoError(t, w.framer.WriteContinuation(1, false, nil))
+		}
+		require.NoError(t, w.framer.WriteContinuation(1, true, block[1:]))
+
+		_, cs := readFrames(w.bytes())
+		require.NotNil(t, cs.resp)
+		assert.Equal(t, 200, cs.resp.StatusCode)
+		assert.Equal(t, "value", cs.resp.Header.Get("X-Header"))
+	})
+}
+
+func FuzzReadFrames(f *testing.F) {
+	w := newFrameWriter()
+	_ = w.framer.WriteSettings(http2.Setting{ID: http2.SettingEnableConnectProtocol, Val: 1})
+	_ = w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: w.headerBlock(":status", "200"), EndHeaders: true})
+	_ = w.framer.WriteData(1, false, []byte("hello"))
+	_ = w.framer.WriteWindowUpdate(1, 1024)
+	_ = w.framer.WritePing(false, [8]byte{1})
+	_ = w.framer.WriteData(1, true, nil)
+	f.Add(w.bytes())
+
+	w = newFrameWriter()
+	block := w.headerBlock(":status", "403", "content-type", "text/plain")
+	_ = w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block[:2]})
+	_ = w.framer.WriteContinuation(1, true, block[2:])
+	_ = w.framer.WriteRSTStream(1, http2.ErrCodeCancel)
+	f.Add(w.bytes())
+
+	w = newFrameWriter()
+	_ = w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: w.headerBlock(":status", "100"), EndHeaders: true})
+	_ = w.framer.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: w.headerBlock("x-a", "1", ":status", "200"), EndHeaders: true})
+	_ = w.framer.WriteGoAway(0, http2.ErrCodeNo, nil)
+	f.Add(w.bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		cc, cs := readFrames(data)
+
+		cc.mutex.Lock()
+		defer cc.mutex.Unlock()
+		// The connection is closed once all data has been read.
+		assert.Error(t, cc.err)
+		assert.LessOrEqual(t, cs.recvBuf.Len(), streamWindowSize)
+		if cs.resp != nil {
+			size := 0
+			for name, values := range cs.resp.Header {
+				for _, value := range values {
+					size += len(name) + len(value) + 32
+				}
+			}
+			assert.LessOrEqual(t, size, maxHeaderListSize)
+		}
+	})
+}
@@ -0,0 +1,875 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+// Package h2connect implements a minimal HTTP/2 client for extended CONNECT requests (RFC 8441). The HTTP/2
+// transports of the standard library (and, as of Go 1.27, of golang.org/x/net, which wraps them) reject the
+// ":protocol" pseudo-header, hence extended CONNECT requests cannot be sent through them.
+//
+// This package is meant to be removed once the HTTP/2 client of the standard library accepts extended CONNECT
+// requests, like its server already does (with GODEBUG=http2xconnect=1). The client then only needs to send its
+// requests through the regular HTTP/2 transport instead.
+package h2connect
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// streamWindowSize and connWindowSize are the receive windows advertised for every stream and for the entire
+	// connection, respectively. They bound the amount of data buffered for streams that are not read from.
+	streamWindowSize = 4 << 20
+	connWindowSize   = 16 << 20
+
+	// defaultMaxConcurrentStreams is the number of concurrent streams assumed until the server announces its limit.
+	defaultMaxConcurrentStreams = 100
+
+	// initialWindowSize and initialMaxFrameSize are the defaults of the respective HTTP/2 settings.
+	initialWindowSize   = 65535
+	initialMaxFrameSize = 16384
+
+	maxStreamID = 1<<31 - 1
+)
+
+var (
+	// ErrExtendedConnectNotSupported indicates that the server has not enabled extended CONNECT via
+	// SETTINGS_ENABLE_CONNECT_PROTOCOL.
+	ErrExtendedConnectNotSupported = errors.New("server does not support extended CONNECT")
+
+	errConnClosed   = errors.New("HTTP/2 connection closed")
+	errStreamClosed = errors.New("HTTP/2 stream closed")
+)
+
+// Transport sends extended CONNECT requests over HTTP/2. The streams of concurrent requests to the same address share
+// a single connection, unless this exceeds the number of concurrent streams allowed by the server.
+type Transport struct {
+	// DialConn establishes a connection over which HTTP/2 is spoken, i.e., either a TLS connection that negotiated
+	// "h2", or a plaintext connection for HTTP/2 with prior knowledge.
+	DialConn func(ctx context.Context, addr string) (net.Conn, error)
+
+	mutex sync.Mutex
+	conns map[string][]*clientConn
+}
+
+// RoundTrip sends the given extended CONNECT request, i.e., a request with the CONNECT method and a ":protocol"
+// pseudo-header. The request body is sent as the data of the stream, and the body of the returned response is the
+// data received on it. Closing the response body resets the stream, unless it has ended in both directions. The
+// request context only governs the stream until a successful (2xx) response has been received.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	protocol := req.Header.Get(":protocol")
+	if req.Method != http.MethodConnect || protocol == "" {
+		closeBody(req)
+		return nil, errors.New("only extended CONNECT requests are supported")
+	}
+
+	cc, err := t.getConn(req.Context(), req.URL.Host)
+	if err != nil {
+		closeBody(req)
+		return nil, err
+	}
+	return cc.roundTrip(req, protocol)
+}
+
+// CloseIdleConnections closes all connections that do not carry any streams.
+func (t *Transport) CloseIdleConnections() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for addr, conns := range t.conns {
+		var remaining []*clientConn
+		for _, cc := range conns {
+			if !cc.closeIfIdle() {
+				remaining = append(remaining, cc)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(t.conns, addr)
+		} else {
+			t.conns[addr] = remaining
+		}
+	}
+}
+
+// getConn returns a connection to the given address on which a stream has been reserved, dialing a new one if no
+// existing connection can take another stream.
+func (t *Transport) getConn(ctx context.Context, addr string) (*clientConn, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var usable []*clientConn
+	var reserved *clientConn
+	for _, cc := range t.conns[addr] {
+		if cc.isClosed() || cc.closeIfDrained() {
+			continue
+		}
+		usable = append(usable, cc)
+		if reserved == nil && cc.reserveStream() {
+			reserved = cc
+		}
+	}
+	if reserved == nil {
+		cc, err := t.dial(ctx, addr)
+		if err != nil {
+			t.setConns(addr, usable)
+			return nil, err
+		}
+		cc.reserveStream()
+		usable = append(usable, cc)
+		reserved = cc
+	}
+	t.setConns(addr, usable)
+	return reserved, nil
+}
+
+func (t *Transport) setConns(addr string, conns []*clientConn) {
+	if len(conns) == 0 {
+		delete(t.conns, addr)
+		return
+	}
+	if t.conns == nil {
+		t.conns = make(map[string][]*clientConn)
+	}
+	t.conns[addr] = conns
+}
+
+func (t *Transport) dial(ctx context.Context, addr string) (*clientConn, error) {
+	conn, err := t.DialConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := newClientConn(ctx, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+}
+
+// clientConn is an HTTP/2 connection to a server that supports extended CONNECT.
+type clientConn struct {
+	conn net.Conn
+
+	// writeMutex guards writing frames, and the header encoder. It must not be acquired while holding mutex.
+	writeMutex sync.Mutex
+	framer     *http2.Framer
+	frames     *frameReader
+	henc       *hpack.Encoder
+	hbuf       bytes.Buffer
+
+	settingsReceived chan struct{}
+
+	// mutex guards the state of the connection and its streams, and cond is signaled whenever it changes.
+	mutex                sync.Mutex
+	cond                 *sync.Cond
+	err                  error
+	goAway               bool
+	gotSettings          bool
+	extendedConnect      bool
+	streams              map[uint32]*clientStream
+	reserved             int
+	nextStreamID         uint32
+	maxConcurrentStreams uint32
+	peerMaxFrameSize     uint32
+	peerInitialWindow    int32
+	sendWindow           int32
+	recvUnacked          int
+}
+
+// newClientConn performs the HTTP/2 handshake on the given connection, and waits for the settings of the server,
+// which must enable extended CONNECT.
+func newClientConn(ctx context.Context, conn net.Conn) (*clientConn, error) {
+	cc := makeClientConn(conn)
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, errors.Wrap(err, "writing HTTP/2 preface")
+	}
+	err := cc.framer.WriteSettings(
+		http2.Setting{ID: http2.SettingEnablePush, Val: 0},
+		http2.Setting{ID: http2.SettingInitialWindowSize, Val: streamWindowSize},
+		http2.Setting{ID: http2.SettingMaxHeaderListSize, Val: maxHeaderListSize},
+	)
+	if err == nil {
+		err = cc.framer.WriteWindowUpdate(0, connWindowSize-initialWindowSize)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "writing HTTP/2 settings")
+	}
+
+	go cc.readLoop()
+
+	select {
+	case <-cc.settingsReceived:
+	case <-ctx.Done():
+		cc.closeWithError(ctx.Err())
+		return nil, ctx.Err()
+	}
+
+	cc.mutex.Lock()
+	err, extendedConnect := cc.err, cc.extendedConnect
+	cc.mutex.Unlock()
+	if err != nil {
+		return nil, errors.Wrap(err, "performing HTTP/2 handshake")
+	}
+	if !extendedConnect {
+		cc.closeWithError(ErrExtendedConnectNotSupported)
+		return nil, ErrExtendedConnectNotSupported
+	}
+	return cc, nil
+}
+
+// makeClientConn creates the state of a connection on which the HTTP/2 handshake has yet to be performed.
+func makeClientConn(conn net.Conn) *clientConn {
+	cc := &clientConn{
+		conn:                 conn,
+		settingsReceived:     make(chan struct{}),
+		streams:              make(map[uint32]*clientStream),
+		nextStreamID:         1,
+		maxConcurrentStreams: defaultMaxConcurrentStreams,
+		peerMaxFrameSize:     initialMaxFrameSize,
+		peerInitialWindow:    initialWindowSize,
+		sendWindow:           initialWindowSize,
+	}
+	cc.cond = sync.NewCond(&cc.mutex)
+	cc.framer = http2.NewFramer(conn, bufio.NewReader(conn))
+	// The client does not announce a larger maximum frame size than the default.
+	cc.framer.SetMaxReadFrameSize(initialMaxFrameSize)
+	cc.frames = newFrameReader(cc.framer)
+	cc.henc = hpack.NewEncoder(&cc.hbuf)
+	return cc
+}
+
+// reserveStream reserves a stream on the connection, if it can take another one.
+func (cc *clientConn) reserveStream() bool {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cc.err != nil || cc.goAway || cc.nextStreamID+2*uint32(cc.reserved) > maxStreamID ||
+		uint32(len(cc.streams)+cc.reserved) >= cc.maxConcurrentStreams {
+		return false
+	}
+	cc.reserved++
+	return true
+}
+
+func (cc *clientConn) isClosed() bool {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.err != nil
+}
+
+// closeIfIdle closes the connection if it does not carry any streams, and returns whether it is closed.
+func (cc *clientConn) closeIfIdle() bool {
+	return cc.closeIf(func() bool { return true })
+}
+
+// closeIfDrained closes the connection if the server has sent a GOAWAY frame and the connection no longer carries
+// any streams, and returns whether it is closed.
+func (cc *clientConn) closeIfDrained() bool {
+	return cc.closeIf(func() bool { return cc.goAway })
+}
+
+func (cc *clientConn) closeIf(cond func() bool) bool {
+	cc.mutex.Lock()
+	closeConn := len(cc.streams) == 0 && cc.reserved == 0 && cond()
+	cc.mutex.Unlock()
+	if !closeConn {
+		return false
+	}
+	cc.closeWithError(errConnClosed)
+	return true
+}
+
+// closeWithError closes the connection, and fails all its streams with the given error.
+func (cc *clientConn) closeWithError(err error) {
+	if err == nil {
+		err = errConnClosed
+	}
+	cc.mutex.Lock()
+	if cc.err != nil {
+		cc.mutex.Unlock()
+		return
+	}
+	cc.err = err
+	for _, cs := range cc.streams {
+		cs.abortLocked(err)
+	}
+	if !cc.gotSettings {
+		cc.gotSettings = true
+		close(cc.settingsReceived)
+	}
+	cc.cond.Broadcast()
+	cc.mutex.Unlock()
+	_ = cc.conn.Close()
+}
+
+func (cc *clientConn) roundTrip(req *http.Request, protocol string) (*http.Response, error) {
+	cs := &clientStream{cc: cc, respReady: make(chan struct{})}
+
+	cc.writeMutex.Lock()
+	cc.mutex.Lock()
+	cc.reserved--
+	if cc.err != nil || cc.goAway {
+		err := cc.err
+		if err == nil {
+			err = errConnClosed
+		}
+		cc.mutex.Unlock()
+		cc.writeMutex.Unlock()
+		closeBody(req)
+		return nil, err
+	}
+	cs.id = cc.nextStreamID
+	cc.nextStreamID += 2
+	cs.sendWindow = cc.peerInitialWindow
+	maxFrameSize := cc.peerMaxFrameSize
+	cc.streams[cs.id] = cs
+	cc.mutex.Unlock()
+	err := cc.writeHeaders(cs.id, req, protocol, maxFrameSize)
+	cc.writeMutex.Unlock()
+	if err != nil {
+		cc.closeWithError(err)
+		closeBody(req)
+		return nil, errors.Wrap(err, "writing request headers")
+	}
+
+	ctx := req.Context()
+	stopCancel := context.AfterFunc(ctx, func() {
+		cs.reset(ctx.Err())
+	})
+	cc.mutex.Lock()
+	if cs.removed {
+		stopCancel()
+	} else {
+		cs.stopCancel = stopCancel
+	}
+	cc.mutex.Unlock()
+
+	go cs.writeBody(req.Body)
+
+	<-cs.respReady
+	cc.mutex.Lock()
+	resp, err := cs.resp, cs.err
+	cc.mutex.Unlock()
+	if resp == nil {
+		cs.reset(err)
+		return nil, err
+	}
+	// As for protocol switches in HTTP/1.1, the request context does not govern the stream established by a
+	// successful response.
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 && !stopCancel() && ctx.Err() != nil {
+		cs.reset(ctx.Err())
+		return nil, ctx.Err()
+	}
+	resp.Request = req
+	resp.Body = &responseBody{cs: cs, reqBody: req.Body}
+	return resp, nil
+}
+
+// writeHeaders writes the headers of the given request as a header block of the given stream. It must be called
+// with the write mutex held.
+func (cc *clientConn) writeHeaders(streamID uint32, req *http.Request, protocol string, maxFrameSize uint32) error {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	path := req.URL.RequestURI()
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	cc.hbuf.Reset()
+	writeField := func(name, value string) {
+		_ = cc.henc.WriteField(hpack.HeaderField{Name: name, Value: value})
+	}
+	writeField(":method", http.MethodConnect)
+	writeField(":protocol", protocol)
+	writeField(":scheme", scheme)
+	writeField(":authority", host)
+	writeField(":path", path)
+	for name, values := range req.Header {
+		if strings.HasPrefix(name, ":") || isConnectionSpecific(name) {
+			continue
+		}
+		lowerName := strings.ToLower(name)
+		for _, value := range values {
+			writeField(lowerName, value)
+		}
+	}
+
+	block := cc.hbuf.Bytes()
+	first := true
+	for first || len(block) > 0 {
+		chunk := block
+		if len(chunk) > int(maxFrameSize) {
+			chunk = chunk[:maxFrameSize]
+		}
+		block = block[len(chunk):]
+		var err error
+		if first {
+			err = cc.framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      streamID,
+				BlockFragment: chunk,
+				EndHeaders:    len(block) == 0,
+			})
+			first = false
+		} else {
+			err = cc.framer.WriteContinuation(streamID, len(block) == 0, chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isConnectionSpecific checks whether the given header must not be sent over HTTP/2 (RFC 9113, section 8.2.2).
+func isConnectionSpecific(name string) bool {
+	switch http.CanonicalHeaderKey(name) {
+	case "Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade", "Te", "Host":
+		return true
+	}
+	return false
+}
+
+func (cc *clientConn) readLoop() {
+	var err error
+	for err == nil {
+		var f http2.Frame
+		f, err = cc.frames.ReadFrame()
+		if err != nil {
+			var streamErr http2.StreamError
+			if errors.As(err, &streamErr) {
+				cc.resetStream(streamErr.StreamID, streamErr.Code, streamErr)
+				err = nil
+			}
+			continue
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			err = cc.processSettings(f)
+		case *http2.MetaHeadersFrame:
+			cc.processHeaders(f)
+		case *http2.DataFrame:
+			err = cc.processData(f)
+		case *http2.WindowUpdateFrame:
+			cc.processWindowUpdate(f)
+		case *http2.RSTStreamFrame:
+			cc.processReset(f)
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				err = cc.writeFrame(func() error { return cc.framer.WritePing(true, f.Data) })
+			}
+		case *http2.GoAwayFrame:
+			cc.processGoAway(f)
+		case *http2.PushPromiseFrame:
+			err = http2.ConnectionError(http2.ErrCodeProtocol)
+		}
+	}
+	cc.closeWithError(err)
+}
+
+func (cc *clientConn) writeFrame(write func() error) error {
+	cc.writeMutex.Lock()
+	defer cc.writeMutex.Unlock()
+	return write()
+}
+
+func (cc *clientConn) processSettings(f *http2.SettingsFrame) error {
+	if f.IsAck() {
+		return nil
+	}
+
+	var headerTableSize *uint32
+	cc.mutex.Lock()
+	err := f.ForeachSetting(func(s http2.Setting) error {
+		switch s.ID {
+		case http2.SettingMaxFrameSize:
+			cc.peerMaxFrameSize = s.Val
+		case http2.SettingMaxConcurrentStreams:
+			cc.maxConcurrentStreams = s.Val
+		case http2.SettingInitialWindowSize:
+			delta := int32(s.Val) - cc.peerInitialWindow
+			for _, cs := range cc.streams {
+				cs.sendWindow += delta
+			}
+			cc.peerInitialWindow = int32(s.Val)
+		case http2.SettingHeaderTableSize:
+			val := s.Val
+			headerTableSize = &val
+		case http2.SettingEnableConnectProtocol:
+			// The setting must not be withdrawn once it has been sent (RFC 8441, section 3).
+			if !cc.gotSettings {
+				cc.extendedConnect = s.Val == 1
+			}
+		}
+		return nil
+	})
+	if !cc.gotSettings {
+		cc.gotSettings = true
+		close(cc.settingsReceived)
+	}
+	cc.cond.Broadcast()
+	cc.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return cc.writeFrame(func() error {
+		if headerTableSize != nil {
+			cc.henc.SetMaxDynamicTableSizeLimit(*headerTableSize)
+		}
+		return cc.framer.WriteSettingsAck()
+	})
+}
+
+func (cc *clientConn) processHeaders(f *http2.MetaHeadersFrame) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cs := cc.streams[f.StreamID]
+	if cs == nil {
+		return
+	}
+
+	if cs.resp == nil {
+		statusCode, err := strconv.Atoi(f.PseudoValue("status"))
+		if err != nil {
+			cs.abortLocked(errors.Errorf("malformed response status %q", f.PseudoValue("status")))
+			return
+		}
+		if statusCode >= 100 && statusCode < 200 {
+			// Informational responses are skipped.
+			return
+		}
+		resp := &http.Response{
+			Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+			StatusCode:    statusCode,
+			Proto:         "HTTP/2.0",
+			ProtoMajor:    2,
+			Header:        make(http.Header),
+			ContentLength: -1,
+		}
+		for _, field := range f.RegularFields() {
+			resp.Header.Add(http.CanonicalHeaderKey(field.Name), field.Value)
+		}
+		if contentLength, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+			resp.ContentLength = contentLength
+		}
+		cs.resp = resp
+		close(cs.respReady)
+	}
+	// Trailers, if any, are ignored.
+	if f.StreamEnded() {
+		cs.recvEnded = true
+		cs.maybeFinishLocked()
+	}
+	cc.cond.Broadcast()
+}
+
+func (cc *clientConn) processData(f *http2.DataFrame) error {
+	length := int(f.Length)
+	data := f.Data()
+
+	cc.mutex.Lock()
+	cs := cc.streams[f.StreamID]
+	var connIncrement uint32
+	if cs == nil || cs.recvEnded || cs.resp == nil {
+		// Data of streams that are gone is discarded, but still counts towards the connection window.
+		cc.recvUnacked += length
+	} else {
+		if cs.recvBuf.Len()+len(data) > streamWindowSize {
+			cc.mutex.Unlock()
+			return http2.ConnectionError(http2.ErrCodeFlowControl)
+		}
+		cs.recvBuf.Write(data)
+		// Padding is consumed right away.
+		cs.recvUnacked += length - len(data)
+		cc.recvUnacked += length - len(data)
+		if f.StreamEnded() {
+			cs.recvEnded = true
+			cs.maybeFinishLocked()
+		}
+		cc.cond.Broadcast()
+	}
+	if cc.recvUnacked >= connWindowSize/4 {
+		connIncrement = uint32(cc.recvUnacked)
+		cc.recvUnacked = 0
+	}
+	cc.mutex.Unlock()
+
+	if connIncrement == 0 {
+		return nil
+	}
+	return cc.writeFrame(func() error { return cc.framer.WriteWindowUpdate(0, connIncrement) })
+}
+
+func (cc *clientConn) processWindowUpdate(f *http2.WindowUpdateFrame) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if f.StreamID == 0 {
+		cc.sendWindow += int32(f.Increment)
+	} else if cs := cc.streams[f.StreamID]; cs != nil {
+		cs.sendWindow += int32(f.Increment)
+	}
+	cc.cond.Broadcast()
+}
+
+func (cc *clientConn) processReset(f *http2.RSTStreamFrame) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	if cs := cc.streams[f.StreamID]; cs != nil {
+		cs.abortLocked(http2.StreamError{StreamID: f.StreamID, Code: f.ErrCode})
+	}
+}
+
+func (cc *clientConn) processGoAway(f *http2.GoAwayFrame) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.goAway = true
+	for id, cs := range cc.streams {
+		if id > f.LastStreamID {
+			cs.abortLocked(errors.Errorf("stream not processed by server (GOAWAY %v)", f.ErrCode))
+		}
+	}
+}
+
+// resetStream resets the given stream, and fails it with the given error.
+func (cc *clientConn) resetStream(streamID uint32, code http2.ErrCode, err error) {
+	cc.mutex.Lock()
+	if cs := cc.streams[streamID]; cs != nil {
+		cs.abortLocked(err)
+	}
+	cc.mutex.Unlock()
+	_ = cc.writeFrame(func() error { return cc.framer.WriteRSTStream(streamID, code) })
+}
+
+// clientStream is a stream of a client connection. Its fields are guarded by the connection's mutex.
+type clientStream struct {
+	cc         *clientConn
+	id         uint32
+	stopCancel func() bool
+
+	respReady   chan struct{}
+	resp        *http.Response
+	err         error
+	removed     bool
+	sendWindow  int32
+	sendEnded   bool
+	recvEnded   bool
+	recvBuf     bytes.Buffer
+	recvUnacked int
+}
+
+// abortLocked fails the stream with the given error, and removes it from the connection.
+func (cs *clientStream) abortLocked(err error) {
+	if cs.err == nil {
+		cs.err = err
+	}
+	if cs.resp == nil && !cs.removed {
+		close(cs.respReady)
+	}
+	cs.removeLocked()
+}
+
+// maybeFinishLocked removes the stream from the connection once it has ended in both directions.
+func (cs *clientStream) maybeFinishLocked() {
+	if cs.sendEnded && cs.recvEnded {
+		cs.removeLocked()
+	}
+}
+
+func (cs *clientStream) removeLocked() {
+	if cs.removed {
+		return
+	}
+	cs.removed = true
+	cc := cs.cc
+	delete(cc.streams, cs.id)
+	// Data that is never going to be read no longer counts towards the connection window.
+	cc.recvUnacked += cs.recvBuf.Len()
+	if cs.stopCancel != nil {
+		cs.stopCancel()
+	}
+	cc.cond.Broadcast()
+}
+
+// reset fails the stream with the given error and, unless it has already been closed, e.g., because it has ended in
+// both directions, resets it.
+func (cs *clientStream) reset(err error) {
+	cc := cs.cc
+	cc.mutex.Lock()
+	if err == nil {
+		err = errStreamClosed
+	}
+	closed := cs.removed
+	cs.abortLocked(err)
+	connErr := cc.err
+	cc.mutex.Unlock()
+	if !closed && connErr == nil {
+		_ = cc.writeFrame(func() error { return cc.framer.WriteRSTStream(cs.id, http2.ErrCodeCancel) })
+	}
+}
+
+// writeBody sends the given body as the data of the stream, and ends the stream once it has been read completely.
+func (cs *clientStream) writeBody(body io.ReadCloser) {
+	if body == nil || body == http.NoBody {
+		_ = cs.writeData(nil, true)
+		return
+	}
+	defer func() { _ = body.Close() }()
+	buf := make([]byte, initialMaxFrameSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if writeErr := cs.writeData(buf[:n], false); writeErr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			_ = cs.writeData(nil, true)
+			return
+		}
+		if err != nil {
+			cs.reset(err)
+			return
+		}
+	}
+}
+
+// writeData sends the given data on the stream, waiting for the flow control windows to allow it.
+func (cs *clientStream) writeData(p []byte, endStream bool) error {
+	cc := cs.cc
+	for {
+		cc.mutex.Lock()
+		for len(p) > 0 && cs.err == nil && !cs.removed && (cs.sendWindow <= 0 || cc.sendWindow <= 0) {
+			cc.cond.Wait()
+		}
+		if cs.err != nil || cs.removed {
+			err := cs.err
+			cc.mutex.Unlock()
+			if err == nil {
+				err = errStreamClosed
+			}
+			return err
+		}
+		n := len(p)
+		for _, limit := range []int{int(cs.sendWindow), int(cc.sendWindow), int(cc.peerMaxFrameSize)} {
+			if n > limit {
+				n = limit
+			}
+		}
+		cs.sendWindow -= int32(n)
+		cc.sendWindow -= int32(n)
+		cc.mutex.Unlock()
+
+		chunk := p[:n]
+		p = p[n:]
+		end := endStream && len(p) == 0
+		if err := cc.writeFrame(func() error { return cc.framer.WriteData(cs.id, end, chunk) }); err != nil {
+			cc.closeWithError(err)
+			return err
+		}
+		if end {
+			cc.mutex.Lock()
+			cs.sendEnded = true
+			cs.maybeFinishLocked()
+			cc.mutex.Unlock()
+		}
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// read reads data received on the stream, and returns the flow control windows once enough data has been read.
+func (cs *clientStream) read(p []byte) (int, error) {
+	cc := cs.cc
+	cc.mutex.Lock()
+	for cs.recvBuf.Len() == 0 && !cs.recvEnded && cs.err == nil {
+		cc.cond.Wait()
+	}
+	if cs.recvBuf.Len() == 0 {
+		// Once all data has been received, a subsequent reset, e.g., via RST_STREAM with NO_ERROR after a complete
+		// response (RFC 9113, section 8.1), does not affect reading.
+		err := io.EOF
+		if !cs.recvEnded {
+			err = cs.err
+		}
+		cc.mutex.Unlock()
+		return 0, err
+	}
+	n, _ := cs.recvBuf.Read(p)
+	var streamIncrement, connIncrement uint32
+	if !cs.removed {
+		cs.recvUnacked += n
+		if cs.recvUnacked >= streamWindowSize/4 && !cs.recvEnded {
+			streamIncrement = uint32(cs.recvUnacked)
+			cs.recvUnacked = 0
+		}
+	}
+	cc.recvUnacked += n
+	if cc.recvUnacked >= connWindowSize/4 {
+		connIncrement = uint32(cc.recvUnacked)
+		cc.recvUnacked = 0
+	}
+	cc.mutex.Unlock()
+
+	if streamIncrement != 0 || connIncrement != 0 {
+		_ = cc.writeFrame(func() error {
+			if streamIncrement != 0 {
+				if err := cc.framer.WriteWindowUpdate(cs.id, streamIncrement); err != nil {
+					return err
+				}
+			}
+			if connIncrement != 0 {
+				return cc.framer.WriteWindowUpdate(0, connIncrement)
+			}
+			return nil
+		})
+	}
+	return n, nil
+}
+
+// responseBody is the body of an extended CONNECT response. Closing it also closes the request body, such that
+// writers of the request body do not block.
+type responseBody struct {
+	cs      *clientStream
+	reqBody io.Closer
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	return b.cs.read(p)
+}
+
+func (b *responseBody) Close() error {
+	b.cs.reset(errStreamClosed)
+	if b.reqBody != nil {
+		_ = b.reqBody.Close()
+	}
+	return nil
+}
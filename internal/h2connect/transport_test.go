@@ -0,0 +1,280 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package h2connect
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// extendedConnectGODEBUG enables extended CONNECT in Go's HTTP/2 servers. It is only read from the environment at
+// program start, hence the tests re-execute themselves with it if necessary.
+const extendedConnectGODEBUG = "http2xconnect=1"
+
+func TestMain(m *testing.M) {
+	if strings.Contains(os.Getenv("GODEBUG"), extendedConnectGODEBUG) {
+		os.Exit(m.Run())
+	}
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), "GODEBUG="+strings.TrimPrefix(os.Getenv("GODEBUG")+","+extendedConnectGODEBUG, ","))
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// echoHandler echoes the data of extended CONNECT streams for the "echo" protocol.
+func echoHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect || req.Header.Get(":protocol") != "echo" {
+		http.Error(w, "not an echo request", http.StatusForbidden)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := req.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			_ = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// startServer starts an HTTP/2 server with prior knowledge, and returns its address along with a transport, which
+// counts the connections it dials.
+func startServer(t *testing.T, handler http.HandlerFunc, maxConcurrentStreams int) (string, *Transport, *atomic.Int32) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{
+		Handler:   handler,
+		Protocols: new(http.Protocols),
+		HTTP2:     &http.HTTP2Config{MaxConcurrentStreams: maxConcurrentStreams},
+	}
+	srv.Protocols.SetUnencryptedHTTP2(true)
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	var dials atomic.Int32
+	transport := &Transport{
+		DialConn: func(ctx context.Context, addr string) (net.Conn, error) {
+			dials.Add(1)
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return lis.Addr().String(), transport, &dials
+}
+
+// openStream sends an extended CONNECT request for the given protocol, and returns the response along with the writer
+// for the request body.
+func openStream(t *testing.T, transport *Transport, addr, protocol string) (*http.Response, *io.PipeWriter) {
+	bodyReader, bodyWriter := io.Pipe()
+	req, err := http.NewRequest(http.MethodConnect, "http://"+addr+"/stream", bodyReader)
+	require.NoError(t, err)
+	req.Header.Set(":protocol", protocol)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	return resp, bodyWriter
+}
+
+func TestEcho(t *testing.T) {
+	addr, transport, dials := startServer(t, echoHandler, 0)
+
+	resp, bodyWriter := openStream(t, transport, addr, "echo")
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, msg := range []string{"hello", "world"} {
+		_, err := bodyWriter.Write([]byte(msg))
+		require.NoError(t, err)
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(resp.Body, buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf))
+	}
+	require.NoError(t, bodyWriter.Close())
+	rest, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+	assert.EqualValues(t, 1, dials.Load())
+}
+
+func TestLargeTransfer(t *testing.T) {
+	addr, transport, _ := startServer(t, echoHandler, 0)
+
+	resp, bodyWriter := openStream(t, transport, addr, "echo")
+	defer func() { _ = resp.Body.Close() }()
+
+	// The data exceeds both the stream and the connection windows.
+	data := make([]byte, 3*connWindowSize/2)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	go func() {
+		_, _ = bodyWriter.Write(data)
+		_ = bodyWriter.Close()
+	}()
+	received, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, received), "received data differs from sent data")
+}
+
+func TestMultiplexing(t *testing.T) {
+	cases := []struct {
+		maxConcurrentStreams int
+		expectedDials        int32
+	}{
+		{expectedDials: 1},
+		{maxConcurrentStreams: 4, expectedDials: 3},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("max-%d", c.maxConcurrentStreams), func(t *testing.T) {
+			addr, transport, dials := startServer(t, echoHandler, c.maxConcurrentStreams)
+
+			var streams []*http.Response
+			var writers []*io.PipeWriter
+			for i := 0; i < 10; i++ {
+				resp, bodyWriter := openStream(t, transport, addr, "echo")
+				streams = append(streams, resp)
+				writers = append(writers, bodyWriter)
+			}
+
+			var wg sync.WaitGroup
+			for i := range streams {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					msg := fmt.Sprintf("stream %d", i)
+					go func() {
+						_, _ = writers[i].Write([]byte(msg))
+						_ = writers[i].Close()
+					}()
+					received, err := io.ReadAll(streams[i].Body)
+					assert.NoError(t, err)
+					assert.Equal(t, msg, string(received))
+					_ = streams[i].Body.Close()
+				}(i)
+			}
+			wg.Wait()
+			assert.Equal(t, c.expectedDials, dials.Load())
+
+			// Streams that have ended no longer count towards the limit.
+			resp, bodyWriter := openStream(t, transport, addr, "echo")
+			_ = bodyWriter.Close()
+			_ = resp.Body.Close()
+			assert.Equal(t, c.expectedDials, dials.Load())
+		})
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	addr, transport, _ := startServer(t, echoHandler, 0)
+
+	resp, bodyWriter := openStream(t, transport, addr, "other")
+	defer func() { _ = bodyWriter.Close() }()
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "not an echo request\n", string(body))
+}
+
+func TestCloseResetsStream(t *testing.T) {
+	handlerDone := make(chan error, 1)
+	addr, transport, _ := startServer(t, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_ = http.NewResponseController(w).Flush()
+		_, err := io.Copy(io.Discard, req.Body)
+		handlerDone <- err
+	}, 0)
+
+	resp, bodyWriter := openStream(t, transport, addr, "echo")
+	defer func() { _ = bodyWriter.Close() }()
+	require.NoError(t, resp.Body.Close())
+
+	select {
+	case err := <-handlerDone:
+		assert.Error(t, err, "request body should fail after the stream has been reset")
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not observe the reset")
+	}
+	_, err := bodyWriter.Write([]byte("data"))
+	assert.Error(t, err)
+}
+
+func TestExtendedConnectNotSupported(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = lis.Close() }()
+
+	// The server only sends its settings, which do not enable extended CONNECT.
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		preface := make([]byte, len(http2.ClientPreface))
+		if _, err := io.ReadFull(conn, preface); err != nil {
+			return
+		}
+		framer := http2.NewFramer(conn, conn)
+		_ = framer.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: 100})
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	transport := &Transport{
+		DialConn: func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		},
+	}
+	req, err := http.NewRequest(http.MethodConnect, "http://"+lis.Addr().String()+"/", nil)
+	require.NoError(t, err)
+	req.Header.Set(":protocol", "echo")
+	_, err = transport.RoundTrip(req)
+	assert.ErrorIs(t, err, ErrExtendedConnectNotSupported)
+}
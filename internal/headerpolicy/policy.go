@@ -0,0 +1,157 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package headerpolicy
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Policy filters and renames the HTTP headers that are translated into gRPC metadata. A nil policy keeps all
+// headers.
+type Policy struct {
+	allow, deny  []string
+	rename       map[string]string
+	maxValueSize int
+	maxTotalSize int
+}
+
+// Config configures which HTTP headers are passed on as gRPC metadata, and under which names. It is exported as
+// server.HeaderPolicy and client.HeaderPolicy.
+//
+// Header names are matched case-insensitively. Allow and Deny take patterns that are either a header name, or a prefix
+// of header names followed by "*", e.g., "X-Amzn-*". Headers gRPC relies on, i.e., Content-Type, TE and Grpc-*
+// headers, are neither filtered nor renamed.
+type Config struct {
+	// Allow lists the headers passed on. If empty, all headers not denied are passed on.
+	Allow []string
+	// Deny lists the headers that are not passed on, even if allowed.
+	Deny []string
+	// Rename maps header names to the names of the metadata they are passed on as. Headers are renamed before checking
+	// them against Allow and Deny, and values of renamed headers are added to those of headers that already have the
+	// new name.
+	Rename map[string]string
+	// MaxValueSize is the maximum length of header values passed on. Longer values are dropped. Zero means no limit.
+	MaxValueSize int
+	// MaxTotalSize is the maximum total length of the names and values of headers passed on. Headers not fitting in are
+	// dropped, in the order of their names. Zero means no limit.
+	MaxTotalSize int
+}
+
+// Compile returns the policy described by the config.
+func (c *Config) Compile() *Policy {
+	return New(c.Allow, c.Deny, c.Rename, c.MaxValueSize, c.MaxTotalSize)
+}
+
+// New returns a policy keeping headers that match any of the allow patterns (or all headers, if there are none) and
+// none of the deny patterns, after renaming them according to the given rules. A pattern is either a header name, or
+// a prefix of header names followed by "*". Header values longer than maxValueSize are dropped, as are headers that
+// would make the total size of the kept names and values exceed maxTotalSize. Zero sizes mean no limit.
+func New(allow, deny []string, rename map[string]string, maxValueSize, maxTotalSize int) *Policy {
+	p := &Policy{
+		allow:        lowerAll(allow),
+		deny:         lowerAll(deny),
+		maxValueSize: maxValueSize,
+		maxTotalSize: maxTotalSize,
+	}
+	for from, to := range rename {
+		from, to = http.CanonicalHeaderKey(from), http.CanonicalHeaderKey(to)
+		if IsReserved(from) || IsReserved(to) {
+			continue
+		}
+		if p.rename == nil {
+			p.rename = make(map[string]string)
+		}
+		p.rename[from] = to
+	}
+	return p
+}
+
+func lowerAll(patterns []string) []string {
+	lowered := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		lowered = append(lowered, strings.ToLower(pattern))
+	}
+	return lowered
+}
+
+// IsReserved checks whether the given canonical header key is one that gRPC or this library rely on, i.e.,
+// Content-Type, Te, Trailer, or a key starting with "Grpc-" or "Grpchttp1-". Policies never apply to such headers.
+func IsReserved(key string) bool {
+	switch key {
+	case "Content-Type", "Te", "Trailer":
+		return true
+	}
+	return strings.HasPrefix(key, "Grpc-") || strings.HasPrefix(key, "Grpchttp1-")
+}
+
+func matches(patterns []string, key string) bool {
+	key = strings.ToLower(key)
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			return strings.HasPrefix(key, prefix)
+		}
+		return key == pattern
+	})
+}
+
+// Apply applies the policy to the given header in place. Keys with the given prefix, such as http.TrailerPrefix, are
+// treated as if they did not have it.
+func (p *Policy) Apply(hdr http.Header, keyPrefix string) {
+	if p == nil || len(hdr) == 0 {
+		return
+	}
+
+	// Process keys in a deterministic order, such that it does not depend on map iteration which headers exceed the
+	// total size limit.
+	keys := make([]string, 0, len(hdr))
+	for key := range hdr {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	kept := make(http.Header, len(hdr))
+	totalSize := 0
+	for _, key := range keys {
+		values := hdr[key]
+		name, ok := strings.CutPrefix(key, keyPrefix)
+		if !ok || IsReserved(name) {
+			kept[key] = append(kept[key], values...)
+			continue
+		}
+		if to, ok := p.rename[name]; ok {
+			name = to
+		}
+		if (len(p.allow) > 0 && !matches(p.allow, name)) || matches(p.deny, name) {
+			continue
+		}
+		for _, value := range values {
+			if p.maxValueSize > 0 && len(value) > p.maxValueSize {
+				continue
+			}
+			if p.maxTotalSize > 0 && totalSize+len(name)+len(value) > p.maxTotalSize {
+				continue
+			}
+			totalSize += len(name) + len(value)
+			kept[keyPrefix+name] = append(kept[keyPrefix+name], value)
+		}
+	}
+
+	clear(hdr)
+	for key, values := range kept {
+		hdr[key] = values
+	}
+}
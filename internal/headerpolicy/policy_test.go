@@ -0,0 +1,126 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package headerpolicy
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy(t *testing.T) {
+	hdr := func() http.Header {
+		return http.Header{
+			"Content-Type":       {"application/grpc"},
+			"Grpc-Timeout":       {"1S"},
+			"Cookie":             {"session=abc"},
+			"Origin":             {"https://example.com"},
+			"User-Agent":         {"test"},
+			"X-Amzn-Trace-Id":    {"Root=1-abc"},
+			"X-Amzn-Mtls-Cert":   {"MIIB..."},
+			"X-Request-Id":       {"1234"},
+			"Custom-Large-Value": {"0123456789abcdef"},
+		}
+	}
+
+	cases := []struct {
+		name     string
+		policy   *Policy
+		prefix   string
+		expected http.Header
+	}{
+		{
+			name:     "nil",
+			expected: hdr(),
+		},
+		{
+			name:   "allow",
+			policy: New([]string{"x-request-id", "X-Amzn-*", "content-type"}, nil, nil, 0, 0),
+			expected: http.Header{
+				"Content-Type":     {"application/grpc"},
+				"Grpc-Timeout":     {"1S"},
+				"X-Amzn-Trace-Id":  {"Root=1-abc"},
+				"X-Amzn-Mtls-Cert": {"MIIB..."},
+				"X-Request-Id":     {"1234"},
+			},
+		},
+		{
+			name:   "allow-and-deny",
+			policy: New([]string{"X-*"}, []string{"x-amzn-mtls-cert"}, nil, 0, 0),
+			expected: http.Header{
+				"Content-Type":    {"application/grpc"},
+				"Grpc-Timeout":    {"1S"},
+				"X-Amzn-Trace-Id": {"Root=1-abc"},
+				"X-Request-Id":    {"1234"},
+			},
+		},
+		{
+			name: "rename",
+			// Reserved headers can neither be renamed nor be the target of renames.
+			policy: New([]string{"Authorization", "Request-Id"}, []string{"Cookie"},
+				map[string]string{"cookie": "authorization", "X-Request-Id": "Request-Id", "Content-Type": "X", "Origin": "Grpc-Timeout"}, 0, 0),
+			expected: http.Header{
+				"Content-Type":  {"application/grpc"},
+				"Grpc-Timeout":  {"1S"},
+				"Authorization": {"session=abc"},
+				"Request-Id":    {"1234"},
+			},
+		},
+		{
+			name:   "size-limits",
+			policy: New(nil, []string{"Origin", "User-Agent"}, nil, 12, 40),
+			expected: http.Header{
+				"Content-Type": {"application/grpc"},
+				"Grpc-Timeout": {"1S"},
+				// Headers are kept in the order of their keys as long as they fit into the total size.
+				"Cookie":           {"session=abc"},
+				"X-Amzn-Mtls-Cert": {"MIIB..."},
+			},
+		},
+		{
+			name:   "trailer-prefix",
+			policy: New(nil, []string{"Cookie", "X-Amzn-*"}, map[string]string{"X-Request-Id": "Request-Id"}, 0, 0),
+			prefix: "Trailer:",
+			expected: http.Header{
+				"Content-Type":       {"application/grpc"},
+				"Grpc-Timeout":       {"1S"},
+				"Cookie":             {"session=abc"},
+				"Origin":             {"https://example.com"},
+				"User-Agent":         {"test"},
+				"X-Amzn-Trace-Id":    {"Root=1-abc"},
+				"X-Amzn-Mtls-Cert":   {"MIIB..."},
+				"X-Request-Id":       {"1234"},
+				"Custom-Large-Value": {"0123456789abcdef"},
+				"Trailer:Origin":     {"https://example.com"},
+				"Trailer:Request-Id": {"1234"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := hdr()
+			if c.prefix != "" {
+				h["Trailer:Cookie"] = []string{"session=abc"}
+				h["Trailer:Origin"] = []string{"https://example.com"}
+				h["Trailer:X-Amzn-Trace-Id"] = []string{"Root=1-abc"}
+				h["Trailer:X-Request-Id"] = []string{"1234"}
+			}
+			c.policy.Apply(h, c.prefix)
+			assert.Equal(t, c.expected, h)
+		})
+	}
+}
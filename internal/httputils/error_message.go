@@ -1,13 +1,16 @@
 package httputils
 
 import (
-	"errors"
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
 	"strings"
 	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 const (
@@ -15,39 +18,182 @@ const (
 )
 
 var (
-	httpHeaderOptSeparatorRegex = regexp.MustCompile(`;\s*`)
+	// headersOfInterest are the response headers retained in a ResponseError. They help to identify the party that
+	// produced the response, e.g., a load balancer, and whether and when to retry.
+	headersOfInterest = []string{
+		"Content-Type",
+		"Grpc-Message",
+		"Grpc-Status",
+		"Location",
+		"Retry-After",
+		"Server",
+		"Via",
+		"Www-Authenticate",
+		"X-Request-Id",
+		"X-Amzn-Requestid",
+		"X-Amzn-Trace-Id",
+		"X-Cloud-Trace-Context",
+		"Cf-Ray",
+	}
+
+	// jsonMessageFields are the fields of JSON error bodies that commonly contain the error message, in order of
+	// preference.
+	jsonMessageFields = []string{"message", "error_description", "error", "detail", "title", "msg"}
 )
 
+// ResponseError is an HTTP error response.
+type ResponseError struct {
+	// StatusCode is the HTTP status code of the response.
+	StatusCode int
+	// Status is the HTTP status of the response, e.g., "503 Service Unavailable".
+	Status string
+	// Header contains the headers of the response that help to identify its origin or to decide whether to retry.
+	Header http.Header
+	// Body contains at most the first 1024 bytes of the response body.
+	Body []byte
+	// Message is the error message extracted from a plain text, JSON or HTML body, if any.
+	Message string
+
+	mediaType string
+	readErr   error
+}
+
+// Error returns the HTTP status, along with the extracted message or the content type of the response.
+func (e *ResponseError) Error() string {
+	var msg string
+	switch {
+	case e.Message != "":
+		msg = fmt.Sprintf("%s: %s", e.Status, e.Message)
+	case e.mediaType != "" && len(e.Body) > 0:
+		msg = fmt.Sprintf("%s, content-type %s", e.Status, e.mediaType)
+	default:
+		msg = e.Status
+	}
+	if e.readErr != nil {
+		if len(e.Body) == 0 {
+			return fmt.Sprintf("%s, error reading response body: %v", msg, e.readErr)
+		}
+		return fmt.Sprintf("%s, error reading response body after %d bytes: %v", msg, len(e.Body), e.readErr)
+	}
+	return msg
+}
+
 // ExtractResponseError extracts an error from an HTTP response, reading at most 1024 bytes of the
-// response body.
+// response body. The returned error, if any, is a *ResponseError.
 func ExtractResponseError(resp *http.Response) error {
 	if resp.StatusCode < 400 {
 		return nil
 	}
-	contentTypeFields := httpHeaderOptSeparatorRegex.Split(resp.Header.Get("Content-Type"), 2)
-	if len(contentTypeFields) == 0 {
-		return errors.New(resp.Status)
+	respErr := &ResponseError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     make(http.Header),
+	}
+	if respErr.Status == "" {
+		respErr.Status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	for _, key := range headersOfInterest {
+		if values := resp.Header.Values(key); len(values) > 0 {
+			respErr.Header[key] = values
+		}
+	}
+	respErr.mediaType, _, _ = strings.Cut(resp.Header.Get("Content-Type"), ";")
+	respErr.mediaType = strings.ToLower(strings.TrimSpace(respErr.mediaType))
+
+	if resp.Body != nil {
+		respErr.Body, respErr.readErr = io.ReadAll(io.LimitReader(resp.Body, maxBodyBytes))
+	}
+	if !utf8.Valid(respErr.Body) {
+		respErr.Message = "invalid UTF-8 characters in response"
+		return respErr
 	}
 
-	if contentTypeFields[0] != "text/plain" {
-		return fmt.Errorf("%s, content-type %s", resp.Status, contentTypeFields[0])
+	switch mt := respErr.mediaType; {
+	case mt == "text/plain":
+		respErr.Message = strings.TrimSpace(string(respErr.Body))
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		respErr.Message = jsonErrorMessage(respErr.Body)
+	case mt == "text/html":
+		respErr.Message = htmlErrorMessage(respErr.Body)
 	}
+	return respErr
+}
 
-	bodyReader := io.LimitReader(resp.Body, maxBodyBytes)
-	contents, err := io.ReadAll(bodyReader)
-	contentsStr := strings.TrimSpace(string(contents))
-	if !utf8.Valid(contents) {
-		contentsStr = "invalid UTF-8 characters in response"
+// jsonErrorMessage extracts the error message from a JSON error body, such as `{"message": "..."}` or
+// `{"error": {"code": 403, "message": "..."}}`.
+func jsonErrorMessage(body []byte) string {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		// The body might be truncated or not be an object. Fall back to the raw contents.
+		return strings.TrimSpace(string(body))
 	}
-	if err != nil {
-		if contentsStr == "" {
-			return fmt.Errorf("%s, error reading response body: %v", resp.Status, err)
+	return jsonObjectMessage(obj)
+}
+
+func jsonObjectMessage(obj map[string]interface{}) string {
+	for _, field := range jsonMessageFields {
+		switch v := obj[field].(type) {
+		case string:
+			if msg := strings.TrimSpace(v); msg != "" {
+				return msg
+			}
+		case map[string]interface{}:
+			if msg := jsonObjectMessage(v); msg != "" {
+				return msg
+			}
 		}
-		return fmt.Errorf("%s: %s, error reading response body after %d bytes: %v", resp.Status, contentsStr, len(contents), err)
 	}
+	return ""
+}
 
-	if contentsStr == "" {
-		return errors.New(resp.Status)
+// htmlErrorMessage extracts the error message from an HTML error page. Error pages of load balancers and proxies
+// usually state the error in the title or the first heading, e.g., "502 Bad Gateway"; if there is neither, the text
+// of the page is used.
+func htmlErrorMessage(body []byte) string {
+	var title, heading, text strings.Builder
+	var current *strings.Builder
+	skip := false
+
+	tokenizer := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			for _, b := range []*strings.Builder{&title, &heading, &text} {
+				if msg := strings.Join(strings.Fields(b.String()), " "); msg != "" {
+					return msg
+				}
+			}
+			return ""
+		case html.StartTagToken:
+			tag, _ := tokenizer.TagName()
+			switch atom.Lookup(tag) {
+			case atom.Title:
+				current = &title
+			case atom.H1:
+				if heading.Len() == 0 {
+					current = &heading
+				}
+			case atom.Script, atom.Style:
+				skip = true
+			}
+		case html.EndTagToken:
+			tag, _ := tokenizer.TagName()
+			switch atom.Lookup(tag) {
+			case atom.Title, atom.H1:
+				current = nil
+			case atom.Script, atom.Style:
+				skip = false
+			}
+		case html.TextToken:
+			if skip {
+				continue
+			}
+			data := string(tokenizer.Text())
+			if current != nil {
+				current.WriteString(data)
+			}
+			text.WriteString(data)
+			text.WriteByte(' ')
+		}
 	}
-	return fmt.Errorf("%s: %s", resp.Status, contentsStr)
 }
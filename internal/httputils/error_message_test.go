@@ -0,0 +1,134 @@
+package httputils
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeadersOfInterestAreCanonical(t *testing.T) {
+	for _, key := range headersOfInterest {
+		assert.Equal(t, http.CanonicalHeaderKey(key), key)
+	}
+}
+
+func TestExtractResponseError(t *testing.T) {
+	cases := map[string]struct {
+		contentType string
+		body        string
+		expectedMsg string
+		expectedErr string
+	}{
+		"plain text": {
+			contentType: "text/plain; charset=utf-8",
+			body:        "upstream connect error\n",
+			expectedMsg: "upstream connect error",
+			expectedErr: "503 Service Unavailable: upstream connect error",
+		},
+		"json message": {
+			contentType: "application/json",
+			body:        `{"message": "Too Many Requests"}`,
+			expectedMsg: "Too Many Requests",
+			expectedErr: "503 Service Unavailable: Too Many Requests",
+		},
+		"nested json error": {
+			contentType: "application/problem+json",
+			body:        `{"error": {"code": 503, "message": "backend unavailable", "status": "UNAVAILABLE"}}`,
+			expectedMsg: "backend unavailable",
+			expectedErr: "503 Service Unavailable: backend unavailable",
+		},
+		"truncated json": {
+			contentType: "application/json",
+			body:        `{"message": "trunc`,
+			expectedMsg: `{"message": "trunc`,
+			expectedErr: `503 Service Unavailable: {"message": "trunc`,
+		},
+		"html title": {
+			contentType: "text/html",
+			body:        "<html><head><title>503 Service Temporarily Unavailable</title></head><body><center><h1>503 Service Temporarily Unavailable</h1></center><hr><center>nginx</center></body></html>",
+			expectedMsg: "503 Service Temporarily Unavailable",
+			expectedErr: "503 Service Unavailable: 503 Service Temporarily Unavailable",
+		},
+		"html heading": {
+			contentType: "text/html; charset=utf-8",
+			body:        "<html><body><h1>\n  Maintenance\n  in progress </h1><p>Please come back later.</p></body></html>",
+			expectedMsg: "Maintenance in progress",
+			expectedErr: "503 Service Unavailable: Maintenance in progress",
+		},
+		"html text": {
+			contentType: "text/html",
+			body:        "<html><head><script>var x = 1;</script></head><body><p>Service down</p></body></html>",
+			expectedMsg: "Service down",
+			expectedErr: "503 Service Unavailable: Service down",
+		},
+		"other content type": {
+			contentType: "application/xml",
+			body:        "<error/>",
+			expectedErr: "503 Service Unavailable, content-type application/xml",
+		},
+		"empty body": {
+			expectedErr: "503 Service Unavailable",
+		},
+		"invalid utf-8": {
+			contentType: "text/plain",
+			body:        "\xff\xfe",
+			expectedMsg: "invalid UTF-8 characters in response",
+			expectedErr: "503 Service Unavailable: invalid UTF-8 characters in response",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Status:     "503 Service Unavailable",
+				Header:     http.Header{},
+				Body:       io.NopCloser(strings.NewReader(c.body)),
+			}
+			if c.contentType != "" {
+				resp.Header.Set("Content-Type", c.contentType)
+			}
+
+			err := ExtractResponseError(resp)
+			var respErr *ResponseError
+			require.ErrorAs(t, err, &respErr)
+			assert.Equal(t, c.expectedMsg, respErr.Message)
+			assert.Equal(t, c.expectedErr, err.Error())
+			assert.Equal(t, c.body, string(respErr.Body))
+		})
+	}
+}
+
+func TestExtractResponseError_NoError(t *testing.T) {
+	assert.NoError(t, ExtractResponseError(&http.Response{StatusCode: http.StatusOK}))
+}
+
+func TestExtractResponseError_HeadersAndTruncation(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header: http.Header{
+			"Content-Type":  []string{"text/plain"},
+			"Retry-After":   []string{"30"},
+			"Via":           []string{"1.1 proxy-a", "1.1 proxy-b"},
+			"Set-Cookie":    []string{"session=secret"},
+			"X-Request-Id":  []string{"abc"},
+			"Cache-Control": []string{"no-cache"},
+		},
+		Body: io.NopCloser(strings.NewReader(strings.Repeat("x", 2*maxBodyBytes))),
+	}
+
+	var respErr *ResponseError
+	require.ErrorAs(t, ExtractResponseError(resp), &respErr)
+	assert.Equal(t, "429 Too Many Requests", respErr.Status)
+	assert.Equal(t, http.Header{
+		"Content-Type": []string{"text/plain"},
+		"Retry-After":  []string{"30"},
+		"Via":          []string{"1.1 proxy-a", "1.1 proxy-b"},
+		"X-Request-Id": []string{"abc"},
+	}, respErr.Header)
+	assert.Len(t, respErr.Body, maxBodyBytes)
+}
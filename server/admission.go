@@ -0,0 +1,259 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"golang.stackrox.io/grpc-http1/internal/grpcweb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AdmissionLimit is a limit on the number of concurrent calls of a certain kind, see MaxWebSocketStreams,
+// MaxWebSocketStreamsPerIP, MaxWebSocketStreamsPerIdentity and MaxDowngradedCalls.
+type AdmissionLimit int
+
+const (
+	// LimitWebSocketStreams is the limit on concurrent WebSocket streams.
+	LimitWebSocketStreams AdmissionLimit = iota
+	// LimitWebSocketStreamsPerIP is the limit on concurrent WebSocket streams per remote IP address.
+	LimitWebSocketStreamsPerIP
+	// LimitWebSocketStreamsPerIdentity is the limit on concurrent WebSocket streams per authenticated identity.
+	LimitWebSocketStreamsPerIdentity
+	// LimitDowngradedCalls is the limit on concurrent calls with responses downgraded to gRPC-Web.
+	LimitDowngradedCalls
+
+	numAdmissionLimits = iota
+)
+
+func (l AdmissionLimit) String() string {
+	switch l {
+	case LimitWebSocketStreams:
+		return "websocket_streams"
+	case LimitWebSocketStreamsPerIP:
+		return "websocket_streams_per_ip"
+	case LimitWebSocketStreamsPerIdentity:
+		return "websocket_streams_per_identity"
+	case LimitDowngradedCalls:
+		return "downgraded_calls"
+	}
+	return fmt.Sprintf("AdmissionLimit(%d)", int(l))
+}
+
+// AdmissionMetrics counts the WebSocket streams and downgraded calls of a handler, as well as the calls rejected
+// because they exceeded a limit, e.g., to export them to a monitoring system. The zero value is ready to use, and the
+// metrics may be read concurrently. See ReportAdmissionMetrics.
+type AdmissionMetrics struct {
+	rejected               [numAdmissionLimits]atomic.Uint64
+	activeWebSocketStreams atomic.Int64
+	activeDowngradedCalls  atomic.Int64
+}
+
+// Rejected returns the number of calls rejected because they exceeded the given limit.
+func (m *AdmissionMetrics) Rejected(limit AdmissionLimit) uint64 {
+	if limit < 0 || limit >= numAdmissionLimits {
+		return 0
+	}
+	return m.rejected[limit].Load()
+}
+
+// ActiveWebSocketStreams returns the number of WebSocket streams currently served.
+func (m *AdmissionMetrics) ActiveWebSocketStreams() int64 {
+	return m.activeWebSocketStreams.Load()
+}
+
+// ActiveDowngradedCalls returns the number of calls with responses downgraded to gRPC-Web currently served.
+func (m *AdmissionMetrics) ActiveDowngradedCalls() int64 {
+	return m.activeDowngradedCalls.Load()
+}
+
+// admissionControl enforces the limits on concurrent WebSocket streams and downgraded calls of a handler. A nil
+// admission control admits all calls.
+type admissionControl struct {
+	maxStreams            int
+	maxStreamsPerIP       int
+	maxStreamsPerIdentity int
+	maxDowngradedCalls    int
+	identity              func(req *http.Request) string
+	metrics               *AdmissionMetrics
+
+	mutex              sync.Mutex
+	streams            int
+	streamsPerIP       map[netip.Addr]int
+	streamsPerIdentity map[string]int
+	downgradedCalls    int
+}
+
+func newAdmissionControl(o *options) *admissionControl {
+	if o.maxStreams <= 0 && o.maxStreamsPerIP <= 0 && o.maxStreamsPerIdentity <= 0 && o.maxDowngradedCalls <= 0 &&
+		o.admissionMetrics == nil {
+		return nil
+	}
+	a := &admissionControl{
+		maxStreams:            o.maxStreams,
+		maxStreamsPerIP:       o.maxStreamsPerIP,
+		maxStreamsPerIdentity: o.maxStreamsPerIdentity,
+		maxDowngradedCalls:    o.maxDowngradedCalls,
+		identity:              o.identity,
+		metrics:               o.admissionMetrics,
+		streamsPerIP:          make(map[netip.Addr]int),
+		streamsPerIdentity:    make(map[string]int),
+	}
+	if a.identity == nil {
+		a.identity = clientCertificateSubject
+	}
+	if a.metrics == nil {
+		a.metrics = &AdmissionMetrics{}
+	}
+	return a
+}
+
+// clientCertificateSubject returns the subject of the certificate the client of the given request presented, either
+// directly or via a trusted proxy, or an empty string if there is none.
+func clientCertificateSubject(req *http.Request) string {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return req.TLS.PeerCertificates[0].Subject.String()
+}
+
+// admitWebSocketStream admits a WebSocket stream for the given request, unless that exceeds a limit. The returned
+// function must be called exactly once when the stream has ended.
+func (a *admissionControl) admitWebSocketStream(req *http.Request) (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	var ip netip.Addr
+	if a.maxStreamsPerIP > 0 {
+		// The remote address is not an IP address if the server listens on a Unix socket, for example.
+		if addrPort, err := netip.ParseAddrPort(req.RemoteAddr); err == nil {
+			ip = addrPort.Addr().Unmap()
+		}
+	}
+	var identity string
+	if a.maxStreamsPerIdentity > 0 {
+		identity = a.identity(req)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	switch {
+	case a.maxStreams > 0 && a.streams >= a.maxStreams:
+		return nil, a.reject(LimitWebSocketStreams, "too many concurrent WebSocket streams")
+	case ip.IsValid() && a.streamsPerIP[ip] >= a.maxStreamsPerIP:
+		return nil, a.reject(LimitWebSocketStreamsPerIP, "too many concurrent WebSocket streams from %s", ip)
+	case identity != "" && a.streamsPerIdentity[identity] >= a.maxStreamsPerIdentity:
+		return nil, a.reject(LimitWebSocketStreamsPerIdentity, "too many concurrent WebSocket streams of the same client")
+	}
+
+	a.streams++
+	if ip.IsValid() {
+		a.streamsPerIP[ip]++
+	}
+	if identity != "" {
+		a.streamsPerIdentity[identity]++
+	}
+	a.metrics.activeWebSocketStreams.Add(1)
+
+	return func() {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+
+		a.streams--
+		if ip.IsValid() {
+			decrement(a.streamsPerIP, ip)
+		}
+		if identity != "" {
+			decrement(a.streamsPerIdentity, identity)
+		}
+		a.metrics.activeWebSocketStreams.Add(-1)
+	}, nil
+}
+
+// admitDowngradedCall admits a call with a response downgraded to gRPC-Web, unless that exceeds the limit. The
+// returned function must be called exactly once when the call has ended.
+func (a *admissionControl) admitDowngradedCall() (func(), error) {
+	if a == nil {
+		return func() {}, nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.maxDowngradedCalls > 0 && a.downgradedCalls >= a.maxDowngradedCalls {
+		return nil, a.reject(LimitDowngradedCalls, "too many concurrent gRPC-Web calls")
+	}
+	a.downgradedCalls++
+	a.metrics.activeDowngradedCalls.Add(1)
+
+	return func() {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+
+		a.downgradedCalls--
+		a.metrics.activeDowngradedCalls.Add(-1)
+	}, nil
+}
+
+// reject records a call rejected because of the given limit, and returns the error to reject it with.
+func (a *admissionControl) reject(limit AdmissionLimit, format string, args ...interface{}) error {
+	a.metrics.rejected[limit].Add(1)
+	err := status.Errorf(codes.ResourceExhausted, format, args...)
+	glog.V(2).Infof("Rejecting call exceeding the %s limit: %v", limit, err)
+	return err
+}
+
+// decrement decrements the count of the given key, deleting the key once its count is zero, such that the map does
+// not grow with every client ever seen.
+func decrement[K comparable](counts map[K]int, key K) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// writeWebSocketRejection rejects a WebSocket handshake, before upgrading the connection, because of the given error.
+// The response is an HTTP error, whose headers convey the gRPC status as well.
+func writeWebSocketRejection(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(st.Code())))
+	w.Header().Set("Grpc-Message", grpcproto.EncodeGrpcMessage(st.Message()))
+	http.Error(w, st.Message(), http.StatusTooManyRequests)
+}
+
+// writeGRPCWebRejection rejects a call with a trailers-only gRPC-Web response because of the given error.
+func writeGRPCWebRejection(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	transcodingWriter, finalize := grpcweb.NewResponseWriter(w)
+	hdr := transcodingWriter.Header()
+	hdr.Set("Content-Type", "application/grpc")
+	hdr.Set("Grpc-Status", strconv.Itoa(int(st.Code())))
+	hdr.Set("Grpc-Message", grpcproto.EncodeGrpcMessage(st.Message()))
+	transcodingWriter.WriteHeader(http.StatusOK)
+	if err := finalize(); err != nil {
+		glog.Errorf("Error rejecting downgraded gRPC web call: %v", err)
+	}
+}
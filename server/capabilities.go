@@ -0,0 +1,54 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+	"golang.stackrox.io/grpc-http1/internal/capabilities"
+)
+
+// serverCapabilities returns the capabilities of handlers created via CreateDowngradingHandler.
+func serverCapabilities() *capabilities.Capabilities {
+	subprotocols := make([]string, 0, len(webSocketProtocols))
+	for _, p := range webSocketProtocols {
+		subprotocols = append(subprotocols, p.subprotocol)
+	}
+	return &capabilities.Capabilities{
+		ProtocolVersion:       capabilities.ProtocolVersion,
+		Version:               capabilities.LibraryVersion(),
+		Transports:            []string{TransportGRPC.String(), TransportGRPCWeb.String(), TransportWebSocket.String()},
+		WebSocketSubprotocols: subprotocols,
+	}
+}
+
+// isCapabilitiesRequest checks whether the given request, whose path prefix has been stripped, asks for the
+// capabilities document.
+func isCapabilitiesRequest(req *http.Request) bool {
+	return req.URL.Path == capabilities.WellKnownPath && (req.Method == http.MethodGet || req.Method == http.MethodHead)
+}
+
+func serveCapabilities(w http.ResponseWriter, req *http.Request, caps *capabilities.Capabilities) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if req.Method == http.MethodHead {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(caps); err != nil {
+		glog.V(2).Infof("Error writing capabilities: %v", err)
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	forwardedHeader            = "Forwarded"
+	xForwardedForHeader        = "X-Forwarded-For"
+	xForwardedProtoHeader      = "X-Forwarded-Proto"
+	xForwardedClientCertHeader = "X-Forwarded-Client-Cert"
+)
+
+// forwardedHop is the information about a hop of a request, as forwarded by the proxy that received it.
+type forwardedHop struct {
+	// addr is the address of the sender of the request. It is invalid if the proxy did not disclose the address.
+	addr  netip.AddrPort
+	proto string
+}
+
+// applyForwardedHeaders returns a request whose remote address and TLS connection state are those of the client, as
+// forwarded by trusted proxies. If the request was not sent by a trusted proxy, it is returned as-is.
+//
+// gRPC derives the address and the auth info of the peer of a call from the remote address and the TLS connection
+// state of the request. If a trusted proxy forwarded the protocol of the client or its certificate, the TLS connection
+// state only conveys the certificate chain of the client, which is empty unless the client presented a certificate.
+func (o *options) applyForwardedHeaders(req *http.Request) *http.Request {
+	if len(o.trustedProxies) == 0 {
+		return req
+	}
+	remoteAddr, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil || !o.isTrustedProxy(remoteAddr.Addr()) {
+		return req
+	}
+
+	hop := o.clientHop(req.Header)
+	certs, err := forwardedClientCertificates(req.Header, o.clientCertHeader)
+	if err != nil {
+		glog.Warningf("Ignoring client certificate forwarded by %s: %v", req.RemoteAddr, err)
+	}
+	if !hop.addr.IsValid() && hop.proto == "" && certs == nil {
+		return req
+	}
+
+	// Like http.StripPrefix, do not modify the original request.
+	forwarded := new(http.Request)
+	*forwarded = *req
+	if hop.addr.IsValid() {
+		forwarded.RemoteAddr = hop.addr.String()
+	}
+	switch {
+	case len(certs) > 0 || strings.EqualFold(hop.proto, "https"):
+		forwarded.TLS = &tls.ConnectionState{
+			HandshakeComplete: true,
+			PeerCertificates:  certs,
+		}
+		if req.TLS != nil {
+			forwarded.TLS.ServerName = req.TLS.ServerName
+		}
+	case strings.EqualFold(hop.proto, "http"):
+		forwarded.TLS = nil
+	}
+	return forwarded
+}
+
+func (o *options) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range o.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientHop returns the first hop of the request that was not received by a trusted proxy. The hops are taken from
+// the Forwarded header (RFC 7239) if present, and from the X-Forwarded-For and X-Forwarded-Proto headers otherwise.
+// Hops are appended by each proxy, hence they are walked from right to left, as only the hops added by trusted
+// proxies can be relied upon.
+func (o *options) clientHop(header http.Header) forwardedHop {
+	hops := parseForwarded(header.Values(forwardedHeader))
+	if len(hops) == 0 {
+		hops = parseXForwarded(header.Values(xForwardedForHeader), header.Values(xForwardedProtoHeader))
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if i == 0 || !hops[i].addr.IsValid() || !o.isTrustedProxy(hops[i].addr.Addr()) {
+			return hops[i]
+		}
+	}
+	return forwardedHop{}
+}
+
+// parseForwarded parses the hops in the given values of Forwarded headers.
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, element := range splitQuoted(strings.Join(values, ","), ',') {
+		var hop forwardedHop
+		for _, pair := range splitQuoted(element, ';') {
+			key, value, _ := strings.Cut(pair, "=")
+			value = unquote(strings.TrimSpace(value))
+			switch strings.ToLower(strings.TrimSpace(key)) {
+			case "for":
+				hop.addr = parseNode(value)
+			case "proto":
+				hop.proto = value
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// parseXForwarded parses the hops in the given values of X-Forwarded-For and X-Forwarded-Proto headers. Proxies may
+// set rather than append X-Forwarded-Proto, in which case the last protocol is assumed to be the one of the client.
+func parseXForwarded(forValues, protoValues []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, node := range strings.Split(strings.Join(forValues, ","), ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			hops = append(hops, forwardedHop{addr: parseNode(node)})
+		}
+	}
+	var protos []string
+	for _, proto := range strings.Split(strings.Join(protoValues, ","), ",") {
+		if proto = strings.TrimSpace(proto); proto != "" {
+			protos = append(protos, proto)
+		}
+	}
+	if len(protos) == 0 {
+		return hops
+	}
+	if len(hops) == 0 {
+		return []forwardedHop{{proto: protos[len(protos)-1]}}
+	}
+	for i := range hops {
+		if len(protos) == len(hops) {
+			hops[i].proto = protos[i]
+		} else {
+			hops[i].proto = protos[len(protos)-1]
+		}
+	}
+	return hops
+}
+
+// parseNode parses an IP address with an optional port, such as "192.0.2.1", "[2001:db8::1]:4711" or
+// "2001:db8::1". Obfuscated identifiers, such as "unknown" or "_hidden", yield an invalid address.
+func parseNode(node string) netip.AddrPort {
+	if addrPort, err := netip.ParseAddrPort(node); err == nil {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	if addr, err := netip.ParseAddr(node); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), 0)
+	}
+	return netip.AddrPort{}
+}
+
+// forwardedClientCertificates returns the certificate chain of the client forwarded in the given header, which holds
+// URL-encoded PEM or base64-encoded DER certificates, as forwarded by, e.g., nginx or Traefik. If the header name is
+// empty, the chain is taken from the X-Forwarded-Client-Cert header of Envoy instead.
+func forwardedClientCertificates(header http.Header, certHeader string) ([]*x509.Certificate, error) {
+	if certHeader == "" {
+		return parseXFCC(header.Values(xForwardedClientCertHeader))
+	}
+	value := strings.TrimSpace(strings.Join(header.Values(certHeader), ","))
+	if value == "" {
+		return nil, nil
+	}
+	decoded, err := url.PathUnescape(value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decoding %s header", certHeader)
+	}
+	if strings.Contains(decoded, "-----BEGIN") {
+		return parsePEMCertificates(decoded)
+	}
+	var certs []*x509.Certificate
+	for _, encoded := range strings.Split(decoded, ",") {
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding %s header", certHeader)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing certificate in %s header", certHeader)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// parseXFCC returns the certificate chain of the client in the given values of X-Forwarded-Client-Cert headers. Only
+// the last element is considered, as it was added by the trusted proxy the request was received from. If the element
+// does not contain the certificate itself, a certificate only made of the subject and the subject alternative names
+// in the element is returned.
+func parseXFCC(values []string) ([]*x509.Certificate, error) {
+	elements := splitQuoted(strings.Join(values, ","), ',')
+	if len(elements) == 0 {
+		return nil, nil
+	}
+
+	var certPEM, chainPEM string
+	var identity x509.Certificate
+	hasIdentity := false
+	for _, pair := range splitQuoted(elements[len(elements)-1], ';') {
+		key, value, _ := strings.Cut(pair, "=")
+		value = unquote(strings.TrimSpace(value))
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "cert":
+			certPEM = value
+		case "chain":
+			chainPEM = value
+		case "subject":
+			identity.Subject, hasIdentity = parseDistinguishedName(value), true
+		case "uri":
+			uri, err := url.Parse(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing URI %q in %s header", value, xForwardedClientCertHeader)
+			}
+			identity.URIs, hasIdentity = append(identity.URIs, uri), true
+		case "dns":
+			identity.DNSNames, hasIdentity = append(identity.DNSNames, value), true
+		}
+	}
+
+	for _, encoded := range []string{chainPEM, certPEM} {
+		if encoded == "" {
+			continue
+		}
+		decoded, err := url.PathUnescape(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding certificate in %s header", xForwardedClientCertHeader)
+		}
+		return parsePEMCertificates(decoded)
+	}
+	if hasIdentity {
+		return []*x509.Certificate{&identity}, nil
+	}
+	return nil, nil
+}
+
+func parsePEMCertificates(data string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing forwarded certificate")
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate in PEM data")
+	}
+	return certs, nil
+}
+
+// parseDistinguishedName parses the common attributes of a distinguished name in the string representation of
+// RFC 4514, e.g., "CN=client,OU=Engineering,O=Example". Other attributes are ignored.
+func parseDistinguishedName(dn string) pkix.Name {
+	var name pkix.Name
+	for _, attr := range splitEscaped(dn) {
+		attrType, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			continue
+		}
+		value = unescapeDistinguishedNameValue(strings.TrimSpace(value))
+		switch strings.ToUpper(strings.TrimSpace(attrType)) {
+		case "CN":
+			name.CommonName = value
+		case "SERIALNUMBER":
+			name.SerialNumber = value
+		case "C":
+			name.Country = append(name.Country, value)
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "L":
+			name.Locality = append(name.Locality, value)
+		case "ST":
+			name.Province = append(name.Province, value)
+		case "STREET":
+			name.StreetAddress = append(name.StreetAddress, value)
+		case "POSTALCODE":
+			name.PostalCode = append(name.PostalCode, value)
+		}
+	}
+	return name
+}
+
+// splitEscaped splits a distinguished name into its attributes, which are separated by unescaped commas or plus
+// signs.
+func splitEscaped(dn string) []string {
+	var attrs []string
+	start := 0
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',', '+':
+			attrs = append(attrs, dn[start:i])
+			start = i + 1
+		}
+	}
+	return append(attrs, dn[start:])
+}
+
+func unescapeDistinguishedNameValue(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			sb.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i+1 < len(value) && isHexDigit(value[i]) && isHexDigit(value[i+1]) {
+			sb.WriteByte(unhex(value[i])<<4 | unhex(value[i+1]))
+			i++
+			continue
+		}
+		sb.WriteByte(value[i])
+	}
+	return sb.String()
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	default:
+		return c - 'a' + 10
+	}
+}
+
+// splitQuoted splits the given header value at the given separator, unless it is part of a quoted string. Empty parts
+// are omitted.
+func splitQuoted(value string, sep byte) []string {
+	var parts []string
+	start, quoted := 0, false
+	appendPart := func(end int) {
+		if part := strings.TrimSpace(value[start:end]); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			appendPart(i)
+			start = i + 1
+		}
+	}
+	appendPart(len(value))
+	return parts
+}
+
+// unquote removes the quotes of a quoted string, and unescapes the double quotes escaped in it. Other backslashes are
+// kept, as they may be part of the value, e.g., the escaped commas of a distinguished name in an X-Forwarded-Client-Cert
+// header.
+func unquote(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	return strings.ReplaceAll(value[1:len(value)-1], `\"`, `"`)
+}
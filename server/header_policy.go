@@ -0,0 +1,24 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package server
+
+import (
+	"golang.stackrox.io/grpc-http1/internal/headerpolicy"
+)
+
+// HeaderPolicy controls which HTTP request headers are passed on to gRPC handlers as metadata, and under which names.
+// See RequestHeaderPolicy for where it applies. The fields are documented on headerpolicy.Config, which is also
+// exported as client.HeaderPolicy.
+type HeaderPolicy = headerpolicy.Config
@@ -1,7 +1,33 @@
 package server
 
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"golang.stackrox.io/grpc-http1/internal/headerpolicy"
+)
+
 type options struct {
 	preferGRPCWeb bool
+	pathPrefix    string
+
+	trustedProxies   []netip.Prefix
+	clientCertHeader string
+
+	serveCapabilities bool
+
+	requestHeaderPolicy *headerpolicy.Policy
+
+	metadataLimits grpcproto.MetadataLimits
+
+	maxStreams            int
+	maxStreamsPerIP       int
+	maxStreamsPerIdentity int
+	identity              func(req *http.Request) string
+	maxDowngradedCalls    int
+	admissionMetrics      *AdmissionMetrics
 }
 
 // Option is an object that controls the behavior of the downgrading gRPC server.
@@ -22,3 +48,122 @@ func PreferGRPCWeb(prefer bool) Option {
 		o.preferGRPCWeb = prefer
 	})
 }
+
+// PathPrefix instructs the server to serve gRPC requests whose path starts with the given prefix, such as
+// "/api/grpc", as if the prefix was not present. This allows mounting the server at a path of a reverse proxy or
+// ingress. Requests without the prefix, e.g., from vanilla gRPC clients connecting directly, are served as usual.
+func PathPrefix(prefix string) Option {
+	return optionFunc(func(o *options) {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix != "" && !strings.HasPrefix(prefix, "/") {
+			prefix = "/" + prefix
+		}
+		o.pathPrefix = prefix
+	})
+}
+
+// ServeCapabilities instructs the server to describe its capabilities, such as the transports and WebSocket
+// subprotocols it supports, as a JSON document at the well-known path "/.well-known/grpc-http1" (below the path prefix,
+// if any). The same information is always announced in the Grpc-Http1-Capabilities header of every response, except
+// for the version of this library, which only the document discloses.
+func ServeCapabilities(serve bool) Option {
+	return optionFunc(func(o *options) {
+		o.serveCapabilities = serve
+	})
+}
+
+// TrustedProxies instructs the server to trust the forwarding headers of gRPC requests sent by proxies with addresses
+// in the given networks, such as TLS-terminating load balancers. For such requests, the address and the auth info of
+// the peer reported to gRPC handlers are those of the client: the address is taken from the Forwarded or
+// X-Forwarded-For header, and, if the proxy forwarded the protocol of the client via the Forwarded or X-Forwarded-Proto
+// header or the certificate of the client, the auth info is a credentials.TLSInfo, whose peer certificates are those
+// forwarded by the proxy. By default, client certificates are taken from the X-Forwarded-Client-Cert header, as sent
+// by Envoy; see ForwardedClientCertHeader for other proxies.
+//
+// Forwarding headers of requests from other addresses are ignored. Only trust proxies that overwrite or append to the
+// headers they forward, as clients could otherwise impersonate other clients.
+func TrustedProxies(prefixes ...netip.Prefix) Option {
+	return optionFunc(func(o *options) {
+		o.trustedProxies = append(o.trustedProxies, prefixes...)
+	})
+}
+
+// ForwardedClientCertHeader instructs the server to take the certificates of clients from the given header of requests
+// sent by trusted proxies (see TrustedProxies) instead of the X-Forwarded-Client-Cert header. The header must hold
+// either URL-encoded PEM certificates, such as nginx's $ssl_client_escaped_cert, or comma-separated base64-encoded DER
+// certificates, such as Traefik's X-Forwarded-Tls-Client-Cert header.
+func ForwardedClientCertHeader(header string) Option {
+	return optionFunc(func(o *options) {
+		o.clientCertHeader = http.CanonicalHeaderKey(header)
+	})
+}
+
+// RequestHeaderPolicy instructs the server to apply the given policy when translating the headers of HTTP requests
+// into gRPC metadata. This applies alike to the headers of WebSocket handshakes, the headers sent in-band over
+// WebSockets, and the headers of gRPC-Web requests, i.e., requests whose responses are downgraded. The metadata of
+// regular gRPC calls is left untouched. Without a policy, all headers other than those specific to WebSockets are
+// passed on, including headers added by browsers and load balancers, such as Cookie, Origin or X-Amzn-Trace-Id.
+func RequestHeaderPolicy(policy HeaderPolicy) Option {
+	return optionFunc(func(o *options) {
+		o.requestHeaderPolicy = policy.Compile()
+	})
+}
+
+// MetadataLimits limits the size of request header frames sent over WebSockets that the server parses, such as the
+// headers sent in-band by grpc-web browser clients, as well as the number of values in them. Requests with larger
+// frames fail with status ResourceExhausted. Non-positive values keep the defaults of 16KB and 100 values. The headers
+// of HTTP requests are limited by the HTTP server instead, see http.Server.MaxHeaderBytes.
+func MetadataLimits(maxSize, maxCount int) Option {
+	return optionFunc(func(o *options) {
+		o.metadataLimits = grpcproto.MetadataLimits{MaxSize: maxSize, MaxCount: maxCount}
+	})
+}
+
+// MaxWebSocketStreams limits the number of concurrent calls via WebSockets. Handshakes of WebSockets beyond the limit
+// are rejected before upgrading the connection, with an HTTP 429 (Too Many Requests) response conveying status
+// ResourceExhausted. Non-positive values mean no limit, which is the default.
+func MaxWebSocketStreams(limit int) Option {
+	return optionFunc(func(o *options) {
+		o.maxStreams = limit
+	})
+}
+
+// MaxWebSocketStreamsPerIP limits the number of concurrent calls via WebSockets from the same remote IP address, which
+// is the address of the client as forwarded by trusted proxies, see TrustedProxies. Like for MaxWebSocketStreams,
+// WebSockets beyond the limit are rejected. Non-positive values mean no limit, which is the default.
+func MaxWebSocketStreamsPerIP(limit int) Option {
+	return optionFunc(func(o *options) {
+		o.maxStreamsPerIP = limit
+	})
+}
+
+// MaxWebSocketStreamsPerIdentity limits the number of concurrent calls via WebSockets of the same authenticated
+// client. The identity of the client is returned by the given function for the WebSocket handshake request; an empty
+// identity means the client is not authenticated, in which case the limit does not apply. If the function is nil, the
+// identity is the subject of the certificate presented by the client, directly or via a trusted proxy. Like for
+// MaxWebSocketStreams, WebSockets beyond the limit are rejected. Non-positive values mean no limit, which is the
+// default.
+func MaxWebSocketStreamsPerIdentity(limit int, identity func(req *http.Request) string) Option {
+	return optionFunc(func(o *options) {
+		o.maxStreamsPerIdentity = limit
+		o.identity = identity
+	})
+}
+
+// MaxDowngradedCalls limits the number of concurrent calls whose responses are downgraded to gRPC-Web, i.e., calls of
+// clients that cannot use HTTP/2 gRPC. Calls beyond the limit are rejected with status ResourceExhausted. Non-positive
+// values mean no limit, which is the default.
+func MaxDowngradedCalls(limit int) Option {
+	return optionFunc(func(o *options) {
+		o.maxDowngradedCalls = limit
+	})
+}
+
+// ReportAdmissionMetrics instructs the server to count the WebSocket streams and downgraded calls it serves, as well as
+// the calls it rejects because of the limits set by MaxWebSocketStreams, MaxWebSocketStreamsPerIP,
+// MaxWebSocketStreamsPerIdentity and MaxDowngradedCalls, in the given metrics.
+func ReportAdmissionMetrics(metrics *AdmissionMetrics) Option {
+	return optionFunc(func(o *options) {
+		o.admissionMetrics = metrics
+	})
+}
@@ -15,9 +15,10 @@
 package server
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"slices"
 	"strings"
 	"sync"
@@ -25,21 +26,35 @@ import (
 
 	"github.com/coder/websocket"
 	"github.com/golang/glog"
+	"golang.stackrox.io/grpc-http1/internal/capabilities"
 	"golang.stackrox.io/grpc-http1/internal/grpcweb"
 	"golang.stackrox.io/grpc-http1/internal/grpcwebsocket"
 	"golang.stackrox.io/grpc-http1/internal/size"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
 	name = "server"
 )
 
-// handleGRPCWS handles gRPC requests via WebSockets.
-func handleGRPCWS(w http.ResponseWriter, req *http.Request, grpcSrv *grpc.Server) {
+// handleGRPCWS handles gRPC requests via WebSockets, using the given protocol.
+func handleGRPCWS(w http.ResponseWriter, req *http.Request, grpcSrv *grpc.Server, protocol *webSocketProtocol, srvOpts *options) {
+	if isExtendedConnect(req) {
+		upgradeW, upgradeReq, finish, err := extendedConnectUpgrade(w, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer finish()
+		w, req = upgradeW, upgradeReq
+	}
+
 	// TODO: Accept the websocket on-demand. For now, this is fine.
 	// Accept a WebSocket connection. No need for compression, as gRPC already compresses messages.
 	conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{
+		Subprotocols:    []string{protocol.subprotocol},
 		CompressionMode: websocket.CompressionDisabled,
 	})
 	if err != nil {
@@ -49,6 +64,24 @@ func handleGRPCWS(w http.ResponseWriter, req *http.Request, grpcSrv *grpc.Server
 	conn.SetReadLimit(64 * size.MB)
 
 	ctx := req.Context()
+	// With control frames, the call is canceled if the client sends a cancel frame or closes the connection.
+	var cancel context.CancelCauseFunc
+	if protocol.controlFrames {
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+	}
+
+	var inBandHdr http.Header
+	if protocol.readRequestHeader != nil {
+		if inBandHdr, err = protocol.readRequestHeader(ctx, conn, srvOpts.metadataLimits); err != nil {
+			closeStatus := websocket.StatusProtocolError
+			if status.Code(err) == codes.ResourceExhausted {
+				closeStatus = websocket.StatusMessageTooBig
+			}
+			_ = grpcwebsocket.Close(conn, closeStatus, err.Error())
+			return
+		}
+	}
 
 	grpcReq := req.Clone(ctx)
 	grpcReq.ProtoMajor, grpcReq.ProtoMinor, grpcReq.Proto = 2, 0, "HTTP/2.0"
@@ -63,28 +96,33 @@ func handleGRPCWS(w http.ResponseWriter, req *http.Request, grpcSrv *grpc.Server
 			delete(hdr, k)
 		}
 	}
+	// Headers sent in-band take precedence over the ones of the WebSocket handshake.
+	for k, vs := range inBandHdr {
+		hdr[k] = vs
+	}
+	srvOpts.requestHeaderPolicy.Apply(hdr, "")
 	// Remove content-length header info.
 	hdr.Del("Content-Length")
 	grpcReq.ContentLength = -1
 
 	// Set the body to a custom WebSocket reader.
-	grpcReq.Body = newWebSocketReader(ctx, conn)
+	grpcReq.Body = newWebSocketReader(ctx, conn, protocol, srvOpts.metadataLimits, cancel)
 
 	// Use a custom WebSocket http.ResponseWriter to write messages back to the client.
-	grpcResponseWriter, respReader := newWebSocketResponseWriter()
+	grpcResponseWriter, respReader := newWebSocketResponseWriter(protocol.noTrailersOnly)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		if err := grpcwebsocket.Write(ctx, conn, respReader, name); err != nil {
-			_ = conn.Close(websocket.StatusInternalError, err.Error())
+			protocol.closeWithError(ctx, conn, err)
 		}
 	}()
 
 	grpcSrv.ServeHTTP(grpcResponseWriter, grpcReq)
 	if err := grpcResponseWriter.Close(); err != nil {
-		_ = conn.Close(websocket.StatusInternalError, err.Error())
+		protocol.closeWithError(ctx, conn, err)
 	}
 
 	wg.Wait()
@@ -93,8 +131,9 @@ func handleGRPCWS(w http.ResponseWriter, req *http.Request, grpcSrv *grpc.Server
 	_ = conn.Close(websocket.StatusNormalClosure, "")
 }
 
-func handleGRPCWeb(w http.ResponseWriter, req *http.Request, validPaths map[string]struct{}, grpcSrv *grpc.Server, srvOpts *options) {
+func handleGRPCWeb(w http.ResponseWriter, req *http.Request, validPaths map[string]struct{}, grpcSrv *grpc.Server, srvOpts *options, admission *admissionControl) {
 	_, isDowngradableMethod := validPaths[req.URL.Path]
+	proto := req.Proto
 
 	// Check for HTTP/2.
 	if req.ProtoMajor != 2 {
@@ -122,7 +161,7 @@ func handleGRPCWeb(w http.ResponseWriter, req *http.Request, validPaths map[stri
 	// If the client accepts trailers, AND gRPC responses, AND did not set the "Grpc-Web-Only" header,
 	// return the response as a normal gRPC response.
 	if req.Header.Get("TE") == "trailers" && acceptGRPC && len(req.Header[grpcweb.GRPCWebOnlyHeader]) == 0 {
-		grpcSrv.ServeHTTP(w, req)
+		grpcSrv.ServeHTTP(w, withTransportInfo(req, &TransportInfo{Transport: TransportGRPC, Proto: proto}))
 		return
 	}
 
@@ -140,10 +179,22 @@ func handleGRPCWeb(w http.ResponseWriter, req *http.Request, validPaths map[stri
 	// Tell the server we would accept trailers (the gRPC server currently (v1.29.1) doesn't check for this, but it
 	// really should, as the purpose of the TE header according to the gRPC spec is to detect incompatible proxies).
 	req.Header.Set("TE", "trailers")
+	srvOpts.requestHeaderPolicy.Apply(req.Header, "")
+
+	release, err := admission.admitDowngradedCall()
+	if err != nil {
+		writeGRPCWebRejection(w, err)
+		return
+	}
+	defer release()
 
 	// Downgrade response to gRPC web.
 	transcodingWriter, finalize := grpcweb.NewResponseWriter(w)
-	grpcSrv.ServeHTTP(transcodingWriter, req)
+	grpcSrv.ServeHTTP(transcodingWriter, withTransportInfo(req, &TransportInfo{
+		Transport:  TransportGRPCWeb,
+		Proto:      proto,
+		Downgraded: true,
+	}))
 	if err := finalize(); err != nil {
 		glog.Errorf("Error sending trailers in downgraded gRPC web response: %v", err)
 	}
@@ -171,13 +222,33 @@ func CreateDowngradingHandler(grpcSrv *grpc.Server, httpHandler http.Handler, op
 	for _, opt := range opts {
 		opt.apply(&serverOpts)
 	}
+	admission := newAdmissionControl(&serverOpts)
+	caps := serverCapabilities()
+	capsHeader := caps.Header()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if isUpgrade, err := isWebSocketUpgrade(req.Header); err != nil {
+		w.Header().Set(capabilities.HeaderKey, capsHeader)
+		if serverOpts.serveCapabilities && isCapabilitiesRequest(stripPathPrefix(req, serverOpts.pathPrefix)) {
+			serveCapabilities(w, req, caps)
+			return
+		}
+
+		if protocol, err := webSocketUpgradeProtocol(req); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
-		} else if isUpgrade {
-			handleGRPCWS(w, req, grpcSrv)
+		} else if protocol != nil {
+			req = withTransportInfo(serverOpts.applyForwardedHeaders(req), &TransportInfo{
+				Transport:   TransportWebSocket,
+				Proto:       req.Proto,
+				Subprotocol: protocol.subprotocol,
+			})
+			release, err := admission.admitWebSocketStream(req)
+			if err != nil {
+				writeWebSocketRejection(w, err)
+				return
+			}
+			defer release()
+			handleGRPCWS(w, stripPathPrefix(req, serverOpts.pathPrefix), grpcSrv, protocol, &serverOpts)
 			return
 		}
 
@@ -186,34 +257,38 @@ func CreateDowngradingHandler(grpcSrv *grpc.Server, httpHandler http.Handler, op
 			httpHandler.ServeHTTP(w, req)
 			return
 		}
+		req = stripPathPrefix(serverOpts.applyForwardedHeaders(req), serverOpts.pathPrefix)
 
 		// Internally content type must be application/grpc,
 		// See: https://github.com/grpc/grpc-go/blob/9deee9b/internal/grpcutil/method.go#L61
 		req.Header.Set("Content-Type", "application/grpc")
 
-		handleGRPCWeb(w, req, validGRPCWebPaths, grpcSrv, &serverOpts)
+		handleGRPCWeb(w, req, validGRPCWebPaths, grpcSrv, &serverOpts, admission)
 	})
 }
 
-func isContentTypeValid(contentType string) bool {
-	ct, _, _ := strings.Cut(contentType, "+")
-	return ct == "application/grpc" || ct == "application/grpc-web"
-}
-
-func isWebSocketUpgrade(header http.Header) (bool, error) {
-	if header.Get("Sec-Websocket-Protocol") != grpcwebsocket.SubprotocolName {
-		return false, nil
+// stripPathPrefix returns a request for the path without the given prefix, if the path of the given request has that
+// prefix. Otherwise, the request is returned as-is.
+func stripPathPrefix(req *http.Request, prefix string) *http.Request {
+	if prefix == "" {
+		return req
 	}
-
-	if !strings.EqualFold(header.Get("Connection"), "upgrade") {
-		return false, errors.New("missing 'Connection: Upgrade' header in gRPC-websocket request (this usually means your proxy or load balancer does not support websockets)")
-	}
-
-	if !strings.EqualFold(header.Get("Upgrade"), "websocket") {
-		return false, errors.New("missing 'Upgrade: websocket' header in gRPC-websocket request (this usually means your proxy or load balancer does not support websockets)")
+	path, ok := strings.CutPrefix(req.URL.Path, prefix)
+	if !ok || !strings.HasPrefix(path, "/") {
+		return req
 	}
+	// Like http.StripPrefix, do not modify the original request.
+	stripped := new(http.Request)
+	*stripped = *req
+	stripped.URL = new(url.URL)
+	*stripped.URL = *req.URL
+	stripped.URL.Path, stripped.URL.RawPath = path, ""
+	return stripped
+}
 
-	return true, nil
+func isContentTypeValid(contentType string) bool {
+	ct, _, _ := strings.Cut(contentType, "+")
+	return ct == "application/grpc" || ct == "application/grpc-web"
 }
 
 func spaceOrComma(r rune) bool {
@@ -0,0 +1,71 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Transport is the way a gRPC call reached the server.
+type Transport int
+
+const (
+	// TransportGRPC is a regular gRPC call, which usually is an HTTP/2 request, but may also be an HTTP/1.1 request
+	// of a client that supports trailers.
+	TransportGRPC Transport = iota + 1
+	// TransportGRPCWeb is a call whose response is downgraded to gRPC-Web.
+	TransportGRPCWeb
+	// TransportWebSocket is a call via a WebSocket.
+	TransportWebSocket
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportGRPC:
+		return "grpc"
+	case TransportGRPCWeb:
+		return "grpc-web"
+	case TransportWebSocket:
+		return "websocket"
+	}
+	return fmt.Sprintf("Transport(%d)", int(t))
+}
+
+// TransportInfo describes how a gRPC call reached the server.
+type TransportInfo struct {
+	Transport Transport
+	// Proto is the protocol of the HTTP request of the call, as received by the server, e.g., "HTTP/1.1". For calls via
+	// WebSockets, it is the protocol of the WebSocket handshake, i.e., "HTTP/2.0" for extended CONNECT requests.
+	Proto string
+	// Downgraded indicates that the response is sent in the gRPC-Web format.
+	Downgraded bool
+	// Subprotocol is the WebSocket subprotocol of calls via WebSockets, e.g., "grpc-ws.v2".
+	Subprotocol string
+}
+
+type transportInfoKey struct{}
+
+// TransportFromContext returns how the gRPC call with the given context reached the server, if the call was handled
+// by a handler created via CreateDowngradingHandler. The context is the one passed to gRPC handlers and interceptors.
+func TransportFromContext(ctx context.Context) (*TransportInfo, bool) {
+	info, ok := ctx.Value(transportInfoKey{}).(*TransportInfo)
+	return info, ok
+}
+
+func withTransportInfo(req *http.Request, info *TransportInfo) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), transportInfoKey{}, info))
+}
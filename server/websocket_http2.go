@@ -0,0 +1,183 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// isExtendedConnect checks whether the request is an HTTP/2 extended CONNECT request (RFC 8441) for a WebSocket.
+// The HTTP/2 server only accepts these if extended CONNECT is enabled via `GODEBUG=http2xconnect=1`, in which case it
+// announces its support via SETTINGS_ENABLE_CONNECT_PROTOCOL.
+func isExtendedConnect(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodConnect && strings.EqualFold(req.Header.Get(":protocol"), "websocket")
+}
+
+// extendedConnectUpgrade turns an extended CONNECT request for a WebSocket into an HTTP/1.1 upgrade request, as
+// understood by the WebSocket library. The returned response writer translates the upgrade response into a successful
+// extended CONNECT response, and can be hijacked, which yields the stream made of the request and response bodies. The
+// returned function must be called before the handler returns, and ensures that the response is not written to
+// afterwards.
+func extendedConnectUpgrade(w http.ResponseWriter, req *http.Request) (http.ResponseWriter, *http.Request, func(), error) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, nil, nil, errors.Wrap(err, "generating WebSocket key")
+	}
+
+	upgradeReq := req.Clone(req.Context())
+	upgradeReq.Method = http.MethodGet
+	upgradeReq.ProtoMajor, upgradeReq.ProtoMinor, upgradeReq.Proto = 1, 1, "HTTP/1.1"
+	upgradeReq.Header.Del(":protocol")
+	upgradeReq.Header.Set("Connection", "Upgrade")
+	upgradeReq.Header.Set("Upgrade", "websocket")
+	// The key only serves the purpose of the HTTP/1.1 handshake, for which the response is never sent.
+	upgradeReq.Header.Set("Sec-Websocket-Key", base64.StdEncoding.EncodeToString(key[:]))
+
+	stream := &extendedConnectStream{
+		body:       req.Body,
+		w:          w,
+		rc:         http.NewResponseController(w),
+		remoteAddr: stringAddr(req.RemoteAddr),
+	}
+	if localAddr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		stream.localAddr = localAddr
+	} else {
+		stream.localAddr = stringAddr("")
+	}
+	return &extendedConnectResponseWriter{ResponseWriter: w, stream: stream}, upgradeReq, stream.finish, nil
+}
+
+// extendedConnectResponseWriter is the response writer for an extended CONNECT request that was turned into an
+// HTTP/1.1 upgrade request.
+type extendedConnectResponseWriter struct {
+	http.ResponseWriter
+	stream *extendedConnectStream
+}
+
+func (w *extendedConnectResponseWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusSwitchingProtocols {
+		// HTTP/2 responses must not contain connection-specific headers, and extended CONNECT responses do not
+		// contain the accept key.
+		hdr := w.Header()
+		hdr.Del("Connection")
+		hdr.Del("Upgrade")
+		hdr.Del("Sec-Websocket-Accept")
+		statusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *extendedConnectResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if err := w.stream.rc.Flush(); err != nil {
+		return nil, nil, errors.Wrap(err, "flushing extended CONNECT response")
+	}
+	return w.stream, bufio.NewReadWriter(bufio.NewReader(w.stream), bufio.NewWriter(w.stream)), nil
+}
+
+// extendedConnectStream is the stream of a WebSocket connection over HTTP/2, made of the request body for reading
+// and the response body for writing.
+type extendedConnectStream struct {
+	body io.ReadCloser
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+
+	localAddr, remoteAddr net.Addr
+
+	closed atomic.Bool
+	// writeMutex is held while writing, and finished indicates that the handler is about to return, after which the
+	// response must not be written to.
+	writeMutex sync.Mutex
+	finished   bool
+}
+
+func (s *extendedConnectStream) Read(p []byte) (int, error) {
+	if s.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	return s.body.Read(p)
+}
+
+func (s *extendedConnectStream) Write(p []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	if s.finished || s.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.rc.Flush()
+}
+
+func (s *extendedConnectStream) Close() error {
+	s.closed.Store(true)
+	return s.body.Close()
+}
+
+// finish closes the stream, and waits for ongoing writes to return.
+func (s *extendedConnectStream) finish() {
+	_ = s.Close()
+	// Unblock writes waiting for flow control.
+	_ = s.rc.SetWriteDeadline(time.Now())
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.finished = true
+}
+
+func (s *extendedConnectStream) LocalAddr() net.Addr {
+	return s.localAddr
+}
+
+func (s *extendedConnectStream) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+func (s *extendedConnectStream) SetDeadline(t time.Time) error {
+	if err := s.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
+}
+
+func (s *extendedConnectStream) SetReadDeadline(t time.Time) error {
+	return s.rc.SetReadDeadline(t)
+}
+
+func (s *extendedConnectStream) SetWriteDeadline(t time.Time) error {
+	return s.rc.SetWriteDeadline(t)
+}
+
+// stringAddr is a network address of which only the string representation is known.
+type stringAddr string
+
+func (a stringAddr) Network() string {
+	return "tcp"
+}
+
+func (a stringAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2020 StackRox Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/pkg/errors"
+	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"golang.stackrox.io/grpc-http1/internal/grpcwebsocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Flags prefixing request messages of the grpc-websockets protocol.
+	grpcWebSocketsDataFlag      = 0
+	grpcWebSocketsEndStreamFlag = 1
+
+	// cancelTimeout bounds writing the cancel frame once the call was aborted.
+	cancelTimeout = 5 * time.Second
+)
+
+// webSocketProtocol is a protocol for tunneling gRPC calls through WebSockets. Responses are sent the same way by all
+// protocols: as a metadata frame with the headers, followed by the gRPC messages and a metadata frame with the
+// trailers, each in a WebSocket message of its own.
+type webSocketProtocol struct {
+	// subprotocol is the WebSocket subprotocol identifying the protocol.
+	subprotocol string
+	// readRequestHeader reads request headers sent in-band, if the protocol does so.
+	readRequestHeader func(ctx context.Context, conn *websocket.Conn, limits grpcproto.MetadataLimits) (http.Header, error)
+	// decodeMessage returns the part of the request body contained in a WebSocket message, or io.EOF if the message
+	// marks the end of the request body.
+	decodeMessage func(msg []byte) ([]byte, error)
+	// grpcFrames indicates that every request message is a gRPC frame, such that metadata frames can be told apart
+	// before reading them completely.
+	grpcFrames bool
+	// noTrailersOnly indicates that clients do not support trailers-only responses, as they treat the first metadata
+	// frame as headers.
+	noTrailersOnly bool
+	// controlFrames indicates that either side may abort the call via cancel frames and close codes conveying gRPC
+	// status codes.
+	controlFrames bool
+}
+
+var (
+	// grpcWSProtocol is the protocol spoken by the client of this library. Request headers are sent with the
+	// WebSocket handshake, and every request message is a gRPC message frame.
+	grpcWSProtocol = &webSocketProtocol{
+		subprotocol:   grpcwebsocket.SubprotocolName,
+		decodeMessage: decodeGRPCWSMessage,
+		grpcFrames:    true,
+	}
+
+	// grpcWSV2Protocol is version 2 of the protocol spoken by the client of this library, which adds cancel frames and
+	// close codes conveying gRPC status codes.
+	grpcWSV2Protocol = &webSocketProtocol{
+		subprotocol:   grpcwebsocket.SubprotocolNameV2,
+		decodeMessage: decodeGRPCWSMessage,
+		grpcFrames:    true,
+		controlFrames: true,
+	}
+
+	// grpcWebSocketsProtocol is the protocol spoken by improbable-eng's grpc-web browser client. As browsers cannot
+	// set headers on WebSocket handshakes, request headers are sent in the first message. Every other request message
+	// is prefixed by a flag byte, indicating either a chunk of the request body or its end.
+	grpcWebSocketsProtocol = &webSocketProtocol{
+		subprotocol:       grpcwebsocket.GRPCWebSocketsSubprotocolName,
+		readRequestHeader: readGRPCWebSocketsHeader,
+		decodeMessage:     decodeGRPCWebSocketsMessage,
+		noTrailersOnly:    true,
+	}
+
+	webSocketProtocols = []*webSocketProtocol{grpcWSV2Protocol, grpcWSProtocol, grpcWebSocketsProtocol}
+)
+
+// webSocketUpgradeProtocol returns the protocol of a gRPC WebSocket upgrade request, or nil if the request is not
+// one. The request is either an HTTP/1.1 upgrade request, or an HTTP/2 extended CONNECT request.
+func webSocketUpgradeProtocol(req *http.Request) (*webSocketProtocol, error) {
+	header := req.Header
+	var protocol *webSocketProtocol
+	for _, subprotocol := range strings.FieldsFunc(strings.Join(header.Values("Sec-Websocket-Protocol"), ","), spaceOrComma) {
+		for _, p := range webSocketProtocols {
+			if p.subprotocol == subprotocol {
+				protocol = p
+				break
+			}
+		}
+		if protocol != nil {
+			break
+		}
+	}
+	if protocol == nil {
+		return nil, nil
+	}
+	if isExtendedConnect(req) {
+		return protocol, nil
+	}
+
+	if !strings.EqualFold(header.Get("Connection"), "upgrade") {
+		return nil, errors.Errorf("missing 'Connection: Upgrade' header in %s request (this usually means your proxy or load balancer does not support websockets)", protocol.subprotocol)
+	}
+
+	if !strings.EqualFold(header.Get("Upgrade"), "websocket") {
+		return nil, errors.Errorf("missing 'Upgrade: websocket' header in %s request (this usually means your proxy or load balancer does not support websockets)", protocol.subprotocol)
+	}
+
+	return protocol, nil
+}
+
+func decodeGRPCWSMessage(msg []byte) ([]byte, error) {
+	// Expect either an EOS message from the client or a valid data frame.
+	// Headers are not expected to be handled here.
+	if err := grpcproto.ValidateGRPCFrame(msg); err != nil {
+		return nil, err
+	}
+	if grpcproto.IsEndOfStream(msg) {
+		return nil, io.EOF
+	}
+	if !grpcproto.IsDataFrame(msg) {
+		return nil, errors.Errorf("message is not a gRPC data frame")
+	}
+	return msg, nil
+}
+
+// closeWithError aborts the call because of the given error, and closes the connection.
+func (p *webSocketProtocol) closeWithError(ctx context.Context, conn *websocket.Conn, err error) {
+	if !p.controlFrames {
+		_ = conn.Close(websocket.StatusInternalError, err.Error())
+		return
+	}
+	if ctx.Err() != nil {
+		// The call was aborted, e.g., because the request violated a limit, which is why writing failed. Report the
+		// original cause instead, and still notify the client about it.
+		if _, ok := status.FromError(context.Cause(ctx)); ok {
+			err = context.Cause(ctx)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), cancelTimeout)
+		defer cancel()
+	}
+	st := status.Convert(err)
+	code := st.Code()
+	if code == codes.OK || code == codes.Unknown {
+		code = codes.Internal
+	}
+	_ = conn.Write(ctx, websocket.MessageBinary, grpcwebsocket.MakeCancelFrame(code, st.Message()))
+	_ = grpcwebsocket.CloseWithStatus(conn, code, st.Message())
+}
+
+func decodeGRPCWebSocketsMessage(msg []byte) ([]byte, error) {
+	if len(msg) == 0 {
+		return nil, nil // Empty messages are ignored.
+	}
+	switch msg[0] {
+	case grpcWebSocketsDataFlag:
+		return msg[1:], nil
+	case grpcWebSocketsEndStreamFlag:
+		return nil, io.EOF
+	default:
+		return nil, errors.Errorf("invalid grpc-websockets message flag %d", msg[0])
+	}
+}
+
+// readGRPCWebSocketsHeader reads the request headers from the first message, in which they are formatted like HTTP/1
+// headers. The content type is turned from a gRPC-Web into a gRPC content type.
+func readGRPCWebSocketsHeader(ctx context.Context, conn *websocket.Conn, limits grpcproto.MetadataLimits) (http.Header, error) {
+	_, msgReader, err := conn.Reader(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading request headers")
+	}
+	// Read at most one byte more than allowed, such that the limit is checked without buffering larger messages.
+	msg, err := io.ReadAll(io.LimitReader(msgReader, int64(limits.MaxSizeOrDefault())+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading request headers")
+	}
+	// Discard whatever exceeds the limit, such that the connection can still be closed gracefully.
+	if _, err := io.Copy(io.Discard, msgReader); err != nil {
+		return nil, errors.Wrap(err, "reading request headers")
+	}
+	header, err := grpcwebsocket.ParseMetadata(msg, limits)
+	if errors.Is(err, grpcproto.ErrMetadataLimitExceeded) {
+		return nil, status.Errorf(codes.ResourceExhausted, "parsing request headers: %v", err)
+	} else if err != nil {
+		return nil, errors.Wrap(err, "parsing request headers")
+	}
+
+	contentType, contentSubtype, _ := strings.Cut(header.Get("Content-Type"), "+")
+	switch contentType {
+	case "application/grpc-web":
+		grpcContentType := "application/grpc"
+		if contentSubtype != "" {
+			grpcContentType += "+" + contentSubtype
+		}
+		header.Set("Content-Type", grpcContentType)
+	case "application/grpc":
+	default:
+		return nil, errors.Errorf("unsupported content type %q", header.Get("Content-Type"))
+	}
+	return header, nil
+}
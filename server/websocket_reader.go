@@ -22,6 +22,9 @@ import (
 	"github.com/coder/websocket"
 	"github.com/pkg/errors"
 	"golang.stackrox.io/grpc-http1/internal/grpcproto"
+	"golang.stackrox.io/grpc-http1/internal/grpcwebsocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // readerResult stores the output from calls to (*wsReader).conn.Reader
@@ -37,6 +40,16 @@ type wsReader struct {
 	conn    *websocket.Conn
 	currMsg []byte
 
+	// decodeMessage returns the part of the request body contained in a WebSocket message, or io.EOF if the message
+	// marks the end of the request body.
+	decodeMessage func(msg []byte) ([]byte, error)
+	// metadataLimits is non-nil if messages are gRPC frames, and limits the size of metadata frames.
+	metadataLimits *grpcproto.MetadataLimits
+
+	// cancel is non-nil if the protocol has control frames, and cancels the call if the client sends a cancel frame
+	// or closes the connection. Messages are read until then, even after the end of the request body.
+	cancel context.CancelCauseFunc
+
 	// These are to prevent the WebSocket from closing due to
 	// (*websocket.Conn).Reader's context potentially expiring.
 	// This can happen if Read waits indefinitely, which we prevent
@@ -57,13 +70,18 @@ type wsReader struct {
 	err error
 }
 
-func newWebSocketReader(ctx context.Context, conn *websocket.Conn) io.ReadCloser {
+func newWebSocketReader(ctx context.Context, conn *websocket.Conn, protocol *webSocketProtocol, limits grpcproto.MetadataLimits, cancel context.CancelCauseFunc) io.ReadCloser {
 	r := &wsReader{
 		ctx:           ctx,
 		conn:          conn,
+		decodeMessage: protocol.decodeMessage,
+		cancel:        cancel,
 		readerResultC: make(chan readerResult),
 		barrierC:      make(chan struct{}, 1),
 	}
+	if protocol.grpcFrames {
+		r.metadataLimits = &limits
+	}
 	r.barrierC <- struct{}{}
 	r.readCtx, r.readCtxCancel = context.WithCancel(r.ctx)
 	go r.readerLoop()
@@ -98,7 +116,7 @@ func (r *wsReader) readerLoop() {
 }
 
 // Read reads from the WebSocket connection.
-// Read assumes each WebSocket message is a gRPC message or metadata frame.
+// Read assumes each WebSocket message can be decoded by the decodeMessage function.
 func (r *wsReader) Read(p []byte) (int, error) {
 	var n int
 	// Errors are "sticky", so if we've errored before, don't bother reading.
@@ -109,49 +127,103 @@ func (r *wsReader) Read(p []byte) (int, error) {
 }
 
 func (r *wsReader) doRead(p []byte) (int, error) {
-	if len(r.currMsg) == 0 {
-		var rr readerResult
-		select {
-		case <-r.readCtx.Done():
-			// CloseRead was called or the request's context expired.
-			// This is typically done in an error-case, only.
-			return 0, errors.Wrap(r.readCtx.Err(), "reading websocket message")
-		case rr = <-r.readerResultC:
+	for len(r.currMsg) == 0 {
+		msg, err := r.nextMessage()
+		if err != nil {
+			// io.EOF is where a connection without errors will terminate.
+			if err == io.EOF && r.cancel != nil {
+				go r.readAfterEndOfStream()
+			}
+			return 0, err
 		}
 
-		if rr.err != nil {
-			return 0, rr.err
-		}
+		r.currMsg = msg
+	}
+
+	n := copy(p, r.currMsg)
+	r.currMsg = r.currMsg[n:]
+
+	return n, nil
+}
+
+// nextMessage reads the next WebSocket message, and returns the part of the request body contained in it.
+func (r *wsReader) nextMessage() ([]byte, error) {
+	var rr readerResult
+	select {
+	case <-r.readCtx.Done():
+		// CloseRead was called or the request's context expired.
+		// This is typically done in an error-case, only.
+		return nil, errors.Wrap(r.readCtx.Err(), "reading websocket message")
+	case rr = <-r.readerResultC:
+	}
 
+	err := rr.err
+	if err == nil {
 		r.buf.Reset()
-		if _, err := r.buf.ReadFrom(rr.reader); err != nil {
-			return 0, err
+		err = r.readMessage(rr.reader)
+	}
+	if err != nil {
+		if r.cancel != nil {
+			if _, ok := status.FromError(err); ok {
+				r.cancel(err)
+			} else {
+				r.cancel(grpcwebsocket.CloseErrorStatus(err).Err())
+			}
 		}
+		return nil, err
+	}
 
-		// Allow (*wsReader).readerLoop to get a new reader.
-		r.barrierC <- struct{}{}
+	// Allow (*wsReader).readerLoop to get a new reader.
+	r.barrierC <- struct{}{}
 
-		// Expect either an EOS message from the client or a valid data frame.
-		// Headers are not expected to be handled here.
-		msg := r.buf.Bytes()
-		if err := grpcproto.ValidateGRPCFrame(msg); err != nil {
-			return 0, err
+	msg := r.buf.Bytes()
+	if r.cancel != nil && len(msg) > 0 && grpcwebsocket.IsControlFrame(msg) {
+		st, err := grpcwebsocket.ParseCancelFrame(msg)
+		if err != nil {
+			return nil, err
 		}
-		if grpcproto.IsEndOfStream(msg) {
-			// This is where a connection without errors will terminate.
-			return 0, io.EOF
+		r.cancel(st.Err())
+		return nil, st.Err()
+	}
+	return r.decodeMessage(msg)
+}
+
+// readMessage reads a message into the buffer. If messages are gRPC frames, the size declared by metadata frames is
+// checked against the limits before reading them completely.
+func (r *wsReader) readMessage(reader io.Reader) error {
+	if r.metadataLimits != nil {
+		if _, err := io.CopyN(&r.buf, reader, grpcproto.MessageHeaderLength); err != nil {
+			if err == io.EOF {
+				// Too short to be a gRPC frame, which is detected when decoding the message.
+				return nil
+			}
+			return err
 		}
-		if !grpcproto.IsDataFrame(msg) {
-			return 0, errors.Errorf("message is not a gRPC data frame")
+		if header := r.buf.Bytes(); grpcproto.IsMetadataFrame(header) {
+			_, length, _ := grpcproto.ParseMessageHeader(header)
+			if err := r.metadataLimits.CheckSize(int64(length)); err != nil {
+				// Discard the rest of the message without buffering it, such that the connection can still be
+				// closed gracefully.
+				_, _ = io.Copy(io.Discard, reader)
+				return status.Error(codes.ResourceExhausted, err.Error())
+			}
 		}
-
-		r.currMsg = msg
 	}
+	_, err := r.buf.ReadFrom(reader)
+	return err
+}
 
-	n := copy(p, r.currMsg)
-	r.currMsg = r.currMsg[n:]
-
-	return n, nil
+// readAfterEndOfStream reads messages after the end of the request body, such that the call is canceled once the
+// client sends a cancel frame or closes the connection. Any other message is a protocol violation.
+func (r *wsReader) readAfterEndOfStream() {
+	_, err := r.nextMessage()
+	if r.readCtx.Err() != nil {
+		return
+	}
+	if err == nil || err == io.EOF {
+		err = errors.New("received message after the end of the request body")
+	}
+	r.cancel(status.Error(codes.Internal, err.Error()))
 }
 
 // Close signals readerLoop that we are no longer accepting messages.
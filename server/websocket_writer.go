@@ -32,16 +32,20 @@ type wsResponseWriter struct {
 	header            http.Header
 	headerWritten     bool
 	announcedTrailers []string
+
+	// noTrailersOnly makes trailers-only responses be sent as a headers frame followed by a trailers frame.
+	noTrailersOnly bool
 }
 
 // newWebSocketResponseWriter returns a new WebSocket response writer and its relative io.ReadCloser.
 // (*wsResponseWriter).Close *must* be called when the struct is no longer needed to signal
 // to the reader that there will be no more messages.
-func newWebSocketResponseWriter() (*wsResponseWriter, io.ReadCloser) {
+func newWebSocketResponseWriter(noTrailersOnly bool) (*wsResponseWriter, io.ReadCloser) {
 	r, w := io.Pipe()
 	rw := &wsResponseWriter{
-		writer: w,
-		header: make(http.Header),
+		writer:         w,
+		header:         make(http.Header),
+		noTrailersOnly: noTrailersOnly,
 	}
 	return rw, r
 }
@@ -92,6 +96,10 @@ func (w *wsResponseWriter) Flush() {}
 
 // Close sends over trailers for normal and Trailer-Only gRPC responses.
 func (w *wsResponseWriter) Close() error {
+	if w.noTrailersOnly && !w.headerWritten {
+		w.WriteHeader(http.StatusOK)
+	}
+
 	hdr := w.header
 	var trailers http.Header
 	if w.announcedTrailers == nil {